@@ -0,0 +1,365 @@
+package dbconfig
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// migrations brings an existing database up to the schema the handlers
+// expect. Every statement must be safe to run again on each startup.
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS uploads (
+		id UUID PRIMARY KEY,
+		object_name VARCHAR(255) NOT NULL,
+		upload_id VARCHAR(255) NOT NULL,
+		size BIGINT NOT NULL,
+		chunk_size BIGINT NOT NULL,
+		completed BOOLEAN NOT NULL DEFAULT FALSE,
+		url TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		completed_at TIMESTAMP
+	)`,
+	`ALTER TABLE userform ALTER COLUMN poleimage TYPE TEXT, ALTER COLUMN multipleimages TYPE TEXT`,
+	`CREATE TABLE IF NOT EXISTS images (
+		sha256 CHAR(64) PRIMARY KEY,
+		object_name VARCHAR(255) NOT NULL UNIQUE,
+		size BIGINT NOT NULL,
+		ref_count INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS userform_images (
+		userform_id INTEGER NOT NULL REFERENCES userform(id) ON DELETE CASCADE,
+		sha256 CHAR(64) NOT NULL REFERENCES images(sha256),
+		role VARCHAR(32) NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS userform_images_sha256_idx ON userform_images (sha256)`,
+	`CREATE INDEX IF NOT EXISTS userform_images_userform_id_idx ON userform_images (userform_id)`,
+	`ALTER TABLE uploads ADD COLUMN IF NOT EXISTS sha256 CHAR(64)`,
+	`ALTER TABLE userform ADD COLUMN IF NOT EXISTS client_id VARCHAR(64)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS userform_client_id_key ON userform (client_id)`,
+	`CREATE TABLE IF NOT EXISTS idempotency_keys (
+		key VARCHAR(255) PRIMARY KEY,
+		path VARCHAR(255) NOT NULL,
+		state VARCHAR(16) NOT NULL,
+		response_status INTEGER,
+		content_type VARCHAR(255),
+		response_body BYTEA,
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS idempotency_keys_created_at_idx ON idempotency_keys (created_at)`,
+	`CREATE TABLE IF NOT EXISTS sync_changes (
+		seq BIGSERIAL PRIMARY KEY,
+		userform_id INTEGER NOT NULL,
+		op VARCHAR(8) NOT NULL,
+		changed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`,
+	// Seed the log with rows that predate it, only while it is still empty.
+	`INSERT INTO sync_changes (userform_id, op)
+		SELECT id, 'upsert' FROM userform
+		WHERE NOT EXISTS (SELECT 1 FROM sync_changes)
+		ORDER BY id`,
+	// userform_isps started out as (userform_id, selectisp JSONB); turn it
+	// into one row per provider attachment.
+	`CREATE TABLE IF NOT EXISTS userform_isps (
+		userform_id INTEGER REFERENCES userform(id) ON DELETE CASCADE
+	)`,
+	`ALTER TABLE userform_isps
+		ADD COLUMN IF NOT EXISTS id SERIAL,
+		ADD COLUMN IF NOT EXISTS provider VARCHAR(255),
+		ADD COLUMN IF NOT EXISTS cable_count INTEGER NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS cable_type VARCHAR(255) NOT NULL DEFAULT '',
+		ADD COLUMN IF NOT EXISTS tag_image TEXT`,
+	`DO $$
+	BEGIN
+		IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'userform_isps' AND column_name = 'selectisp') THEN
+			ALTER TABLE userform_isps DROP CONSTRAINT IF EXISTS userform_isps_pkey;
+			UPDATE userform_isps SET provider = COALESCE(selectisp->>'selectisp', selectisp#>>'{}') WHERE provider IS NULL;
+			ALTER TABLE userform_isps DROP COLUMN selectisp;
+		END IF;
+	END $$`,
+	`DELETE FROM userform_isps WHERE provider IS NULL OR userform_id IS NULL`,
+	`ALTER TABLE userform_isps ALTER COLUMN provider SET NOT NULL, ALTER COLUMN userform_id SET NOT NULL`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS userform_isps_id_key ON userform_isps (id)`,
+	`CREATE INDEX IF NOT EXISTS userform_isps_userform_id_idx ON userform_isps (userform_id)`,
+	// Carry the single selectisp value of older rows over as an attachment.
+	`INSERT INTO userform_isps (userform_id, provider)
+		SELECT uf.id, uf.selectisp FROM userform uf
+		WHERE COALESCE(uf.selectisp, '') <> ''
+		AND NOT EXISTS (SELECT 1 FROM userform_isps ui WHERE ui.userform_id = uf.id)`,
+	`CREATE TABLE IF NOT EXISTS isps (
+		code VARCHAR(32) PRIMARY KEY,
+		name VARCHAR(255) NOT NULL UNIQUE,
+		color VARCHAR(7) NOT NULL DEFAULT '#888888',
+		active BOOLEAN NOT NULL DEFAULT TRUE,
+		aliases TEXT[] NOT NULL DEFAULT '{}',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`,
+	// The providers the form used to hardcode.
+	`INSERT INTO isps (code, name, color, aliases) VALUES
+		('worldlink', 'World Link', '#e4002b', '{}'),
+		('ntc', 'Nepal Telecom', '#0054a6', '{NTC,NT}'),
+		('vianet', 'Vianet', '#6f2c91', '{}'),
+		('classictech', 'ClassicTech', '#f7941d', '{Classic Tech}'),
+		('subisu', 'Subisu', '#00a651', '{}')
+		ON CONFLICT (code) DO NOTHING`,
+	`ALTER TABLE userform_isps ADD COLUMN IF NOT EXISTS isp_code VARCHAR(32) REFERENCES isps(code) ON UPDATE CASCADE`,
+	`CREATE INDEX IF NOT EXISTS userform_isps_isp_code_idx ON userform_isps (isp_code)`,
+	// Exact names link up straight away; the rest is for the cleanup tool.
+	`UPDATE userform_isps ui SET isp_code = i.code FROM isps i
+		WHERE ui.isp_code IS NULL AND ui.provider = i.name`,
+	`CREATE TABLE IF NOT EXISTS attribute_options (
+		kind VARCHAR(32) NOT NULL,
+		value VARCHAR(255) NOT NULL,
+		position INTEGER NOT NULL DEFAULT 0,
+		active BOOLEAN NOT NULL DEFAULT TRUE,
+		PRIMARY KEY (kind, value)
+	)`,
+	// The choices the form used to hardcode.
+	`INSERT INTO attribute_options (kind, value, position) VALUES
+		('pole_type', 'Concrete Square Pole', 1),
+		('pole_type', 'Concrete Round Pole', 2),
+		('pole_type', 'Metal Pole', 3),
+		('pole_type', 'Wooden Pole', 4),
+		('pole_type', 'Bamboo Pole', 5),
+		('pole_condition', 'In Great Condition', 1),
+		('pole_condition', 'In Moderate Condition', 2),
+		('pole_condition', 'In Bad Condition', 3),
+		('pole_placement', 'Near House', 1),
+		('pole_placement', 'Inside House', 2),
+		('pole_placement', 'No House Nearby', 3),
+		('pole_placement', 'In Open Space', 4)
+		ON CONFLICT (kind, value) DO NOTHING`,
+	`ALTER TABLE userform ADD COLUMN IF NOT EXISTS user_id INTEGER`,
+	`ALTER TABLE userform ADD COLUMN IF NOT EXISTS surveyor VARCHAR(50)`,
+	`CREATE TABLE IF NOT EXISTS poles (
+		id SERIAL PRIMARY KEY,
+		latitude DOUBLE PRECISION NOT NULL,
+		longitude DOUBLE PRECISION NOT NULL,
+		pole_type VARCHAR(255),
+		location VARCHAR(255),
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS poles_latitude_longitude_idx ON poles (latitude, longitude)`,
+	`ALTER TABLE userform ADD COLUMN IF NOT EXISTS pole_id INTEGER REFERENCES poles(id)`,
+	`CREATE INDEX IF NOT EXISTS userform_pole_id_idx ON userform (pole_id)`,
+	// Every survey from before poles existed becomes its own pole; the
+	// duplicates among them are for the merge tooling to settle.
+	`DO $$
+	DECLARE
+		r RECORD;
+		new_id INTEGER;
+	BEGIN
+		FOR r IN SELECT id, latitude, longitude, selectpole, location, created_at FROM userform WHERE pole_id IS NULL ORDER BY id LOOP
+			INSERT INTO poles (latitude, longitude, pole_type, location, created_at, updated_at)
+			VALUES (COALESCE(r.latitude, 0), COALESCE(r.longitude, 0), r.selectpole, r.location, r.created_at, r.created_at)
+			RETURNING id INTO new_id;
+			UPDATE userform SET pole_id = new_id WHERE id = r.id;
+		END LOOP;
+	END $$`,
+	`CREATE TABLE IF NOT EXISTS duplicate_groups (
+		id SERIAL PRIMARY KEY,
+		status VARCHAR(16) NOT NULL DEFAULT 'pending',
+		score DOUBLE PRECISION NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		resolved_at TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS duplicate_group_members (
+		group_id INTEGER NOT NULL REFERENCES duplicate_groups(id) ON DELETE CASCADE,
+		userform_id INTEGER NOT NULL,
+		PRIMARY KEY (group_id, userform_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS merge_log (
+		id SERIAL PRIMARY KEY,
+		group_id INTEGER REFERENCES duplicate_groups(id),
+		primary_id INTEGER NOT NULL,
+		merged_ids INTEGER[] NOT NULL,
+		merged_by VARCHAR(255) NOT NULL DEFAULT '',
+		snapshot JSONB NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`,
+	// Bad condition raises a ticket by default, set only when the column is
+	// added so that an admin who turned it off is not overruled on restart.
+	`DO $$
+	BEGIN
+		IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'attribute_options' AND column_name = 'raises_work_order') THEN
+			ALTER TABLE attribute_options ADD COLUMN raises_work_order BOOLEAN NOT NULL DEFAULT FALSE;
+			UPDATE attribute_options SET raises_work_order = TRUE WHERE kind = 'pole_condition' AND value = 'In Bad Condition';
+		END IF;
+	END $$`,
+	`CREATE TABLE IF NOT EXISTS work_orders (
+		id SERIAL PRIMARY KEY,
+		pole_id INTEGER NOT NULL REFERENCES poles(id),
+		inspection_id INTEGER REFERENCES userform(id) ON DELETE SET NULL,
+		title VARCHAR(255) NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		source VARCHAR(16) NOT NULL,
+		status VARCHAR(16) NOT NULL DEFAULT 'open',
+		priority VARCHAR(16) NOT NULL DEFAULT 'normal',
+		assignee VARCHAR(50) NOT NULL DEFAULT '',
+		due_date DATE,
+		created_by VARCHAR(50) NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		resolved_at TIMESTAMP,
+		verified_at TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS work_orders_pole_id_idx ON work_orders (pole_id)`,
+	`CREATE INDEX IF NOT EXISTS work_orders_status_idx ON work_orders (status)`,
+	// At most one automatic ticket per pole is open at a time.
+	`CREATE UNIQUE INDEX IF NOT EXISTS work_orders_open_auto_key ON work_orders (pole_id)
+		WHERE source = 'auto' AND status NOT IN ('resolved', 'verified')`,
+	`CREATE TABLE IF NOT EXISTS work_order_comments (
+		id SERIAL PRIMARY KEY,
+		work_order_id INTEGER NOT NULL REFERENCES work_orders(id) ON DELETE CASCADE,
+		author VARCHAR(50) NOT NULL DEFAULT '',
+		body TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS work_order_photos (
+		id SERIAL PRIMARY KEY,
+		work_order_id INTEGER NOT NULL REFERENCES work_orders(id) ON DELETE CASCADE,
+		kind VARCHAR(8) NOT NULL,
+		sha256 CHAR(64) NOT NULL REFERENCES images(sha256),
+		url TEXT NOT NULL,
+		uploaded_by VARCHAR(50) NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS work_order_comments_work_order_id_idx ON work_order_comments (work_order_id)`,
+	`CREATE INDEX IF NOT EXISTS work_order_photos_work_order_id_idx ON work_order_photos (work_order_id)`,
+	`CREATE TABLE IF NOT EXISTS assignments (
+		id SERIAL PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		area JSONB NOT NULL,
+		routes JSONB,
+		due_date DATE,
+		status VARCHAR(16) NOT NULL DEFAULT 'active',
+		created_by VARCHAR(50) NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS assignment_surveyors (
+		assignment_id INTEGER NOT NULL REFERENCES assignments(id) ON DELETE CASCADE,
+		username VARCHAR(50) NOT NULL,
+		PRIMARY KEY (assignment_id, username)
+	)`,
+	`CREATE INDEX IF NOT EXISTS assignment_surveyors_username_idx ON assignment_surveyors (username)`,
+	`ALTER TABLE userform ADD COLUMN IF NOT EXISTS assignment_id INTEGER REFERENCES assignments(id) ON DELETE SET NULL`,
+	`ALTER TABLE userform ADD COLUMN IF NOT EXISTS outside_assignment BOOLEAN NOT NULL DEFAULT FALSE`,
+	`CREATE INDEX IF NOT EXISTS userform_assignment_id_idx ON userform (assignment_id)`,
+	// trip keeps only each user's current state; trip_sessions keeps every
+	// trip and trip_points its GPS breadcrumbs.
+	`CREATE TABLE IF NOT EXISTS trip_sessions (
+		id SERIAL PRIMARY KEY,
+		username VARCHAR(50) NOT NULL,
+		assignment_id INTEGER REFERENCES assignments(id) ON DELETE SET NULL,
+		started_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		ended_at TIMESTAMP
+	)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS trip_sessions_open_key ON trip_sessions (username) WHERE ended_at IS NULL`,
+	`CREATE INDEX IF NOT EXISTS trip_sessions_assignment_id_idx ON trip_sessions (assignment_id)`,
+	`CREATE TABLE IF NOT EXISTS trip_points (
+		id BIGSERIAL PRIMARY KEY,
+		trip_id INTEGER NOT NULL REFERENCES trip_sessions(id) ON DELETE CASCADE,
+		latitude DOUBLE PRECISION NOT NULL,
+		longitude DOUBLE PRECISION NOT NULL,
+		accuracy DOUBLE PRECISION,
+		recorded_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS trip_points_trip_id_idx ON trip_points (trip_id, recorded_at)`,
+	`CREATE TABLE IF NOT EXISTS admin_areas (
+		id SERIAL PRIMARY KEY,
+		province VARCHAR(255) NOT NULL DEFAULT '',
+		district VARCHAR(255) NOT NULL DEFAULT '',
+		municipality VARCHAR(255) NOT NULL DEFAULT '',
+		ward VARCHAR(255) NOT NULL DEFAULT '',
+		geometry JSONB NOT NULL,
+		source CHAR(64) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS admin_areas_source_idx ON admin_areas (source)`,
+	`ALTER TABLE userform ADD COLUMN IF NOT EXISTS province VARCHAR(255),
+		ADD COLUMN IF NOT EXISTS district VARCHAR(255),
+		ADD COLUMN IF NOT EXISTS municipality VARCHAR(255),
+		ADD COLUMN IF NOT EXISTS ward VARCHAR(255)`,
+	`CREATE INDEX IF NOT EXISTS userform_admin_area_idx ON userform (province, district, municipality, ward)`,
+	// Supervisors watch live positions by team.
+	`CREATE TABLE IF NOT EXISTS surveyor_teams (
+		username VARCHAR(50) PRIMARY KEY,
+		team VARCHAR(100) NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS surveyor_teams_team_idx ON surveyor_teams (team)`,
+	// Why a trip ended, and whether the surveyor has been told it was ended
+	// for them.
+	`ALTER TABLE trip_sessions ADD COLUMN IF NOT EXISTS end_reason VARCHAR(20),
+		ADD COLUMN IF NOT EXISTS end_notified_at TIMESTAMP`,
+	// Provisional references to images a submission in progress uses.
+	`ALTER TABLE images ADD COLUMN IF NOT EXISTS pending INTEGER NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS pending_since TIMESTAMP`,
+	// Headers of a stored idempotent response, beyond its Content-Type.
+	`ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS response_headers JSONB`,
+	// Whether a completed upload has handed its provisional reference over
+	// to a row. Uploads completed before it held none, so they start out
+	// claimed; only new ones default to unclaimed.
+	`ALTER TABLE uploads ADD COLUMN IF NOT EXISTS claimed BOOLEAN NOT NULL DEFAULT TRUE`,
+	`ALTER TABLE uploads ALTER COLUMN claimed SET DEFAULT FALSE`,
+}
+
+// Migrate applies the schema migrations in order.
+func Migrate(db *sql.DB) error {
+	for i, stmt := range migrations {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("migration %d failed: %w", i, err)
+		}
+	}
+	log.Printf("Applied %d schema migrations", len(migrations))
+	return nil
+}
+
+// postGISMigrations add a geography column, kept in step with latitude and
+// longitude, to userform and poles, with GiST indexes on it for distance
+// lookups and on its geometry for box lookups.
+var postGISMigrations = []string{
+	`CREATE EXTENSION IF NOT EXISTS postgis`,
+	`ALTER TABLE userform ADD COLUMN IF NOT EXISTS geog geography(Point, 4326)
+		GENERATED ALWAYS AS (ST_SetSRID(ST_MakePoint(longitude, latitude), 4326)::geography) STORED`,
+	`CREATE INDEX IF NOT EXISTS userform_geog_idx ON userform USING GIST (geog)`,
+	`CREATE INDEX IF NOT EXISTS userform_geom_idx ON userform USING GIST ((geog::geometry))`,
+	`ALTER TABLE poles ADD COLUMN IF NOT EXISTS geog geography(Point, 4326)
+		GENERATED ALWAYS AS (ST_SetSRID(ST_MakePoint(longitude, latitude), 4326)::geography) STORED`,
+	`CREATE INDEX IF NOT EXISTS poles_geog_idx ON poles USING GIST (geog)`,
+	`CREATE INDEX IF NOT EXISTS poles_geom_idx ON poles USING GIST ((geog::geometry))`,
+}
+
+// MigratePostGIS applies postGISMigrations if the server offers PostGIS.
+// It reports whether spatial queries can use them; without PostGIS the
+// schema is left alone.
+func MigratePostGIS(db *sql.DB) (bool, error) {
+	var available bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_available_extensions WHERE name = 'postgis')`).Scan(&available)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up PostGIS: %w", err)
+	}
+	if !available {
+		return false, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin PostGIS migrations: %w", err)
+	}
+	defer tx.Rollback()
+	for i, stmt := range postGISMigrations {
+		if _, err := tx.Exec(stmt); err != nil {
+			return false, fmt.Errorf("PostGIS migration %d failed: %w", i, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit PostGIS migrations: %w", err)
+	}
+	log.Printf("Applied %d PostGIS migrations", len(postGISMigrations))
+	return true, nil
+}
@@ -0,0 +1,82 @@
+package geo
+
+import "math"
+
+// MetersPerDegree is the length of one degree of latitude.
+const MetersPerDegree = 111320.0
+
+// PointIndex buckets points into a grid of square cells so that "is there a
+// point within r metres" only looks at neighbouring cells. Cell widths in
+// longitude are taken at the latitude of the first point, which is accurate
+// enough for an area a crew can walk.
+type PointIndex struct {
+	cell    float64
+	cellLat float64
+	cellLon float64
+	cells   map[[2]int][]Point
+}
+
+// NewPointIndex indexes points in cells of cell metres.
+func NewPointIndex(points []Point, cell float64) *PointIndex {
+	refLat := 0.0
+	if len(points) > 0 {
+		refLat = points[0].Lat
+	}
+	idx := &PointIndex{
+		cell:    cell,
+		cellLat: cell / MetersPerDegree,
+		cellLon: cell / (MetersPerDegree * math.Max(math.Cos(refLat*math.Pi/180), 0.01)),
+		cells:   make(map[[2]int][]Point),
+	}
+	for _, p := range points {
+		key := idx.key(p)
+		idx.cells[key] = append(idx.cells[key], p)
+	}
+	return idx
+}
+
+func (idx *PointIndex) key(p Point) [2]int {
+	return [2]int{int(math.Floor(p.Lat / idx.cellLat)), int(math.Floor(p.Lon / idx.cellLon))}
+}
+
+// Near reports whether an indexed point lies within radius metres of p.
+// radius must not exceed the cell size.
+func (idx *PointIndex) Near(p Point, radius float64) bool {
+	key := idx.key(p)
+	for dLat := -1; dLat <= 1; dLat++ {
+		for dLon := -1; dLon <= 1; dLon++ {
+			for _, q := range idx.cells[[2]int{key[0] + dLat, key[1] + dLon}] {
+				if DistanceMeters(p, q) <= radius {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// CoveredLength walks the lines in pieces of at most step metres and returns
+// their total length and the length of the pieces whose midpoint lies
+// within reach metres of a visited point.
+func CoveredLength(lines [][]Point, visited []Point, step, reach float64) (total, covered float64) {
+	idx := NewPointIndex(visited, reach)
+	for _, line := range lines {
+		for i := 1; i < len(line); i++ {
+			a, b := line[i-1], line[i]
+			length := DistanceMeters(a, b)
+			if length == 0 {
+				continue
+			}
+			pieces := math.Ceil(length / step)
+			for k := 0.0; k < pieces; k++ {
+				t := (k + 0.5) / pieces
+				mid := Point{Lat: a.Lat + (b.Lat-a.Lat)*t, Lon: a.Lon + (b.Lon-a.Lon)*t}
+				if len(visited) > 0 && idx.Near(mid, reach) {
+					covered += length / pieces
+				}
+			}
+			total += length
+		}
+	}
+	return total, covered
+}
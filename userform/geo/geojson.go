@@ -0,0 +1,288 @@
+// Package geo holds the small amount of planar and spherical geometry the
+// API needs: GeoJSON parsing, point-in-polygon tests and path lengths.
+package geo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// EarthRadius is the mean radius of the earth in metres.
+const EarthRadius = 6371000.0
+
+// Point is a WGS84 position.
+type Point struct {
+	Lat float64
+	Lon float64
+}
+
+// Ring is a closed sequence of points; the first and last point may or may
+// not repeat.
+type Ring []Point
+
+// Polygon is an outer ring followed by any holes.
+type Polygon []Ring
+
+// Shape collects the polygons and lines of a GeoJSON document. Points are
+// ignored.
+type Shape struct {
+	Polygons []Polygon
+	Lines    [][]Point
+}
+
+// BBox is a latitude/longitude bounding box.
+type BBox struct {
+	MinLat, MinLon, MaxLat, MaxLon float64
+}
+
+// Contains reports whether p lies inside the box, edges included.
+func (b BBox) Contains(p Point) bool {
+	return p.Lat >= b.MinLat && p.Lat <= b.MaxLat && p.Lon >= b.MinLon && p.Lon <= b.MaxLon
+}
+
+type geoJSON struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+	Geometry    *geoJSON        `json:"geometry"`
+	Geometries  []geoJSON       `json:"geometries"`
+	Features    []geoJSON       `json:"features"`
+}
+
+// ParseGeoJSON reads a Geometry, Feature or FeatureCollection.
+func ParseGeoJSON(data []byte) (*Shape, error) {
+	var doc geoJSON
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid GeoJSON: %w", err)
+	}
+	shape := &Shape{}
+	if err := shape.add(doc); err != nil {
+		return nil, err
+	}
+	return shape, nil
+}
+
+// ParseFeatures reads a FeatureCollection (or a single Feature) and returns
+// each feature's shape with its properties and raw geometry.
+func ParseFeatures(data []byte) ([]Feature, error) {
+	type rawFeature struct {
+		Type       string          `json:"type"`
+		Geometry   json.RawMessage `json:"geometry"`
+		Properties map[string]any  `json:"properties"`
+	}
+	var doc struct {
+		rawFeature
+		Features []rawFeature `json:"features"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid GeoJSON: %w", err)
+	}
+	docs := doc.Features
+	if doc.Type == "Feature" {
+		docs = []rawFeature{doc.rawFeature}
+	} else if doc.Type != "FeatureCollection" {
+		return nil, errors.New("GeoJSON must be a Feature or FeatureCollection")
+	}
+
+	features := make([]Feature, 0, len(docs))
+	for i, f := range docs {
+		feature := Feature{Shape: &Shape{}, Geometry: f.Geometry, Properties: f.Properties}
+		if len(f.Geometry) > 0 && string(f.Geometry) != "null" {
+			shape, err := ParseGeoJSON(f.Geometry)
+			if err != nil {
+				return nil, fmt.Errorf("feature %d: %w", i, err)
+			}
+			feature.Shape = shape
+		}
+		features = append(features, feature)
+	}
+	return features, nil
+}
+
+// Feature is one GeoJSON feature.
+type Feature struct {
+	Shape      *Shape
+	Geometry   json.RawMessage
+	Properties map[string]any
+}
+
+func (s *Shape) add(doc geoJSON) error {
+	switch doc.Type {
+	case "FeatureCollection":
+		for _, f := range doc.Features {
+			if err := s.add(f); err != nil {
+				return err
+			}
+		}
+	case "Feature":
+		if doc.Geometry != nil {
+			return s.add(*doc.Geometry)
+		}
+	case "GeometryCollection":
+		for _, g := range doc.Geometries {
+			if err := s.add(g); err != nil {
+				return err
+			}
+		}
+	case "Point", "MultiPoint":
+	case "LineString":
+		var coords [][]float64
+		if err := json.Unmarshal(doc.Coordinates, &coords); err != nil {
+			return fmt.Errorf("invalid LineString: %w", err)
+		}
+		line, err := toPoints(coords)
+		if err != nil {
+			return err
+		}
+		s.Lines = append(s.Lines, line)
+	case "MultiLineString":
+		var coords [][][]float64
+		if err := json.Unmarshal(doc.Coordinates, &coords); err != nil {
+			return fmt.Errorf("invalid MultiLineString: %w", err)
+		}
+		for _, c := range coords {
+			line, err := toPoints(c)
+			if err != nil {
+				return err
+			}
+			s.Lines = append(s.Lines, line)
+		}
+	case "Polygon":
+		var coords [][][]float64
+		if err := json.Unmarshal(doc.Coordinates, &coords); err != nil {
+			return fmt.Errorf("invalid Polygon: %w", err)
+		}
+		polygon, err := toPolygon(coords)
+		if err != nil {
+			return err
+		}
+		s.Polygons = append(s.Polygons, polygon)
+	case "MultiPolygon":
+		var coords [][][][]float64
+		if err := json.Unmarshal(doc.Coordinates, &coords); err != nil {
+			return fmt.Errorf("invalid MultiPolygon: %w", err)
+		}
+		for _, c := range coords {
+			polygon, err := toPolygon(c)
+			if err != nil {
+				return err
+			}
+			s.Polygons = append(s.Polygons, polygon)
+		}
+	default:
+		return fmt.Errorf("unsupported GeoJSON type %q", doc.Type)
+	}
+	return nil
+}
+
+func toPoints(coords [][]float64) ([]Point, error) {
+	points := make([]Point, 0, len(coords))
+	for _, c := range coords {
+		if len(c) < 2 {
+			return nil, errors.New("position needs longitude and latitude")
+		}
+		p := Point{Lat: c[1], Lon: c[0]}
+		if math.IsNaN(p.Lat) || p.Lat < -90 || p.Lat > 90 || math.IsNaN(p.Lon) || p.Lon < -180 || p.Lon > 180 {
+			return nil, fmt.Errorf("position %v is out of range", c)
+		}
+		points = append(points, p)
+	}
+	return points, nil
+}
+
+func toPolygon(coords [][][]float64) (Polygon, error) {
+	polygon := make(Polygon, 0, len(coords))
+	for _, c := range coords {
+		ring, err := toPoints(c)
+		if err != nil {
+			return nil, err
+		}
+		if len(ring) < 3 {
+			return nil, errors.New("polygon ring needs at least three positions")
+		}
+		polygon = append(polygon, Ring(ring))
+	}
+	if len(polygon) == 0 {
+		return nil, errors.New("polygon has no rings")
+	}
+	return polygon, nil
+}
+
+// BBox returns the bounding box of every polygon and line.
+func (s *Shape) BBox() BBox {
+	b := BBox{MinLat: 90, MinLon: 180, MaxLat: -90, MaxLon: -180}
+	extend := func(p Point) {
+		b.MinLat = math.Min(b.MinLat, p.Lat)
+		b.MaxLat = math.Max(b.MaxLat, p.Lat)
+		b.MinLon = math.Min(b.MinLon, p.Lon)
+		b.MaxLon = math.Max(b.MaxLon, p.Lon)
+	}
+	for _, polygon := range s.Polygons {
+		for _, p := range polygon[0] {
+			extend(p)
+		}
+	}
+	for _, line := range s.Lines {
+		for _, p := range line {
+			extend(p)
+		}
+	}
+	return b
+}
+
+// Contains reports whether p lies inside any polygon of the shape.
+func (s *Shape) Contains(p Point) bool {
+	for _, polygon := range s.Polygons {
+		if polygon.Contains(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Contains reports whether p lies inside the outer ring and outside every
+// hole.
+func (polygon Polygon) Contains(p Point) bool {
+	if !polygon[0].contains(p) {
+		return false
+	}
+	for _, hole := range polygon[1:] {
+		if hole.contains(p) {
+			return false
+		}
+	}
+	return true
+}
+
+// contains is the even-odd ray casting test, treating coordinates as planar.
+func (ring Ring) contains(p Point) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a.Lat > p.Lat) != (b.Lat > p.Lat) &&
+			p.Lon < (b.Lon-a.Lon)*(p.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lon {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// DistanceMeters is the great-circle distance between two points.
+func DistanceMeters(a, b Point) float64 {
+	lat1 := a.Lat * math.Pi / 180
+	lat2 := b.Lat * math.Pi / 180
+	dLat := lat2 - lat1
+	dLon := (b.Lon - a.Lon) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * EarthRadius * math.Atan2(math.Sqrt(h), math.Sqrt(1-h))
+}
+
+// PathLength sums the distances between consecutive points.
+func PathLength(points []Point) float64 {
+	total := 0.0
+	for i := 1; i < len(points); i++ {
+		total += DistanceMeters(points[i-1], points[i])
+	}
+	return total
+}
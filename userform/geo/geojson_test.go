@@ -0,0 +1,49 @@
+package geo
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDistanceMeters(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b Point
+		want float64
+	}{
+		{"same point", Point{Lat: 27.7, Lon: 85.3}, Point{Lat: 27.7, Lon: 85.3}, 0},
+		{"one degree of latitude", Point{Lat: 0, Lon: 0}, Point{Lat: 1, Lon: 0}, 111195},
+		{"one degree of longitude at 60°", Point{Lat: 60, Lon: 10}, Point{Lat: 60, Lon: 11}, 55597},
+		{"across the antimeridian", Point{Lat: 0, Lon: 179.5}, Point{Lat: 0, Lon: -179.5}, 111195},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DistanceMeters(tt.a, tt.b); math.Abs(got-tt.want) > 1 {
+				t.Errorf("DistanceMeters() = %.1f, want %.1f", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShapeContains(t *testing.T) {
+	square := Ring{{Lat: 0, Lon: 0}, {Lat: 0, Lon: 10}, {Lat: 10, Lon: 10}, {Lat: 10, Lon: 0}, {Lat: 0, Lon: 0}}
+	hole := Ring{{Lat: 4, Lon: 4}, {Lat: 4, Lon: 6}, {Lat: 6, Lon: 6}, {Lat: 6, Lon: 4}, {Lat: 4, Lon: 4}}
+	shape := &Shape{Polygons: []Polygon{{square, hole}}}
+
+	tests := []struct {
+		name string
+		p    Point
+		want bool
+	}{
+		{"inside", Point{Lat: 2, Lon: 2}, true},
+		{"in the hole", Point{Lat: 5, Lon: 5}, false},
+		{"outside", Point{Lat: 11, Lon: 5}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shape.Contains(tt.p); got != tt.want {
+				t.Errorf("Contains(%v) = %v, want %v", tt.p, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package geo
+
+import "math"
+
+// Grid divides a bounding box into rows and columns of cells that are
+// roughly CellMeters on each side. Column widths in degrees are taken at the
+// box's middle latitude.
+type Grid struct {
+	Origin     Point // south-west corner
+	CellMeters float64
+	CellLat    float64
+	CellLon    float64
+	Rows       int
+	Cols       int
+}
+
+// NewGrid covers b with cells of cellMeters.
+func NewGrid(b BBox, cellMeters float64) Grid {
+	midLat := (b.MinLat + b.MaxLat) / 2
+	g := Grid{
+		Origin:     Point{Lat: b.MinLat, Lon: b.MinLon},
+		CellMeters: cellMeters,
+		CellLat:    cellMeters / MetersPerDegree,
+		CellLon:    cellMeters / (MetersPerDegree * math.Max(math.Cos(midLat*math.Pi/180), 0.01)),
+	}
+	g.Rows = int(math.Max(1, math.Ceil((b.MaxLat-b.MinLat)/g.CellLat)))
+	g.Cols = int(math.Max(1, math.Ceil((b.MaxLon-b.MinLon)/g.CellLon)))
+	return g
+}
+
+// CellCount is the number of cells that would cover b at cellMeters,
+// without building the grid.
+func CellCount(b BBox, cellMeters float64) int {
+	g := NewGrid(b, cellMeters)
+	return g.Rows * g.Cols
+}
+
+// Cell returns the row and column holding p, or ok=false outside the grid.
+func (g Grid) Cell(p Point) (row, col int, ok bool) {
+	row = int(math.Floor((p.Lat - g.Origin.Lat) / g.CellLat))
+	col = int(math.Floor((p.Lon - g.Origin.Lon) / g.CellLon))
+	if row < 0 || row >= g.Rows || col < 0 || col >= g.Cols {
+		return 0, 0, false
+	}
+	return row, col, true
+}
+
+// Bounds returns the box of a cell.
+func (g Grid) Bounds(row, col int) BBox {
+	minLat := g.Origin.Lat + float64(row)*g.CellLat
+	minLon := g.Origin.Lon + float64(col)*g.CellLon
+	return BBox{MinLat: minLat, MinLon: minLon, MaxLat: minLat + g.CellLat, MaxLon: minLon + g.CellLon}
+}
+
+// Center returns the middle of a cell.
+func (g Grid) Center(row, col int) Point {
+	return Point{
+		Lat: g.Origin.Lat + (float64(row)+0.5)*g.CellLat,
+		Lon: g.Origin.Lon + (float64(col)+0.5)*g.CellLon,
+	}
+}
+
+// Ring returns the outline of b as a closed GeoJSON ring of [lon, lat]
+// positions, counter-clockwise.
+func (b BBox) Ring() [][]float64 {
+	return [][]float64{
+		{b.MinLon, b.MinLat},
+		{b.MaxLon, b.MinLat},
+		{b.MaxLon, b.MaxLat},
+		{b.MinLon, b.MaxLat},
+		{b.MinLon, b.MinLat},
+	}
+}
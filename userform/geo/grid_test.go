@@ -0,0 +1,30 @@
+package geo
+
+import "testing"
+
+func TestGridCell(t *testing.T) {
+	box := BBox{MinLat: 27, MinLon: 85, MaxLat: 27.01, MaxLon: 85.01}
+	g := NewGrid(box, 100)
+
+	tests := []struct {
+		name   string
+		p      Point
+		wantOK bool
+	}{
+		{"south-west corner", Point{Lat: 27, Lon: 85}, true},
+		{"middle", Point{Lat: 27.005, Lon: 85.005}, true},
+		{"south of the box", Point{Lat: 26.999, Lon: 85.005}, false},
+		{"east of the box", Point{Lat: 27.005, Lon: 85.02}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			row, col, ok := g.Cell(tt.p)
+			if ok != tt.wantOK {
+				t.Fatalf("Cell() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && !g.Bounds(row, col).Contains(tt.p) {
+				t.Errorf("cell %d,%d with bounds %v does not contain %v", row, col, g.Bounds(row, col), tt.p)
+			}
+		})
+	}
+}
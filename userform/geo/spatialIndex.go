@@ -0,0 +1,139 @@
+package geo
+
+import (
+	"math"
+	"sort"
+)
+
+// Entry is a point known by an ID, such as a row's.
+type Entry struct {
+	ID    int
+	Point Point
+}
+
+// Neighbour is an entry found near a place, with its distance in metres.
+type Neighbour struct {
+	Entry
+	Meters float64
+}
+
+// SpatialIndex finds entries by distance or box without looking at each
+// one. Unlike PointIndex it buckets them into cells of a fixed size in
+// degrees, so it holds points from anywhere and can change after it is
+// built. Changing an index is not safe while others read it; change a
+// Clone instead.
+type SpatialIndex struct {
+	cell    float64 // degrees
+	cells   map[[2]int][]Entry
+	entries map[int]Point
+}
+
+// NewSpatialIndex returns an empty index with cells of cell degrees.
+func NewSpatialIndex(cell float64) *SpatialIndex {
+	return &SpatialIndex{cell: cell, cells: make(map[[2]int][]Entry), entries: make(map[int]Point)}
+}
+
+func (idx *SpatialIndex) key(p Point) [2]int {
+	return [2]int{int(math.Floor(p.Lat / idx.cell)), int(math.Floor(p.Lon / idx.cell))}
+}
+
+// Len returns the number of entries.
+func (idx *SpatialIndex) Len() int {
+	return len(idx.entries)
+}
+
+// Put indexes id at p, moving it if it is already indexed.
+func (idx *SpatialIndex) Put(id int, p Point) {
+	idx.Remove(id)
+	idx.entries[id] = p
+	key := idx.key(p)
+	// Buckets may be shared with a clone, so they are never appended to in
+	// place.
+	bucket := idx.cells[key]
+	idx.cells[key] = append(bucket[:len(bucket):len(bucket)], Entry{ID: id, Point: p})
+}
+
+// Remove drops id, if it is indexed.
+func (idx *SpatialIndex) Remove(id int) {
+	p, ok := idx.entries[id]
+	if !ok {
+		return
+	}
+	delete(idx.entries, id)
+	key := idx.key(p)
+	var kept []Entry
+	for _, e := range idx.cells[key] {
+		if e.ID != id {
+			kept = append(kept, e)
+		}
+	}
+	if len(kept) == 0 {
+		delete(idx.cells, key)
+	} else {
+		idx.cells[key] = kept
+	}
+}
+
+// Clone returns a copy of idx that can be changed without affecting it.
+func (idx *SpatialIndex) Clone() *SpatialIndex {
+	c := &SpatialIndex{
+		cell:    idx.cell,
+		cells:   make(map[[2]int][]Entry, len(idx.cells)),
+		entries: make(map[int]Point, len(idx.entries)),
+	}
+	for key, bucket := range idx.cells {
+		c.cells[key] = bucket
+	}
+	for id, p := range idx.entries {
+		c.entries[id] = p
+	}
+	return c
+}
+
+// InBBox returns the entries inside b, edges included, by ID. Boxes across
+// the antimeridian are not supported.
+func (idx *SpatialIndex) InBBox(b BBox) []Entry {
+	lo := idx.key(Point{Lat: b.MinLat, Lon: b.MinLon})
+	hi := idx.key(Point{Lat: b.MaxLat, Lon: b.MaxLon})
+	var found []Entry
+	collect := func(bucket []Entry) {
+		for _, e := range bucket {
+			if b.Contains(e.Point) {
+				found = append(found, e)
+			}
+		}
+	}
+	// A box spanning more cells than are filled is cheaper to answer by
+	// visiting the filled ones.
+	if span := float64(hi[0]-lo[0]+1) * float64(hi[1]-lo[1]+1); span > float64(len(idx.cells)) {
+		for _, bucket := range idx.cells {
+			collect(bucket)
+		}
+	} else {
+		for row := lo[0]; row <= hi[0]; row++ {
+			for col := lo[1]; col <= hi[1]; col++ {
+				collect(idx.cells[[2]int{row, col}])
+			}
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].ID < found[j].ID })
+	return found
+}
+
+// Within returns the entries within radius metres of p, nearest first.
+func (idx *SpatialIndex) Within(p Point, radius float64) []Neighbour {
+	dLat := radius / MetersPerDegree
+	dLon := radius / (MetersPerDegree * math.Max(math.Cos(p.Lat*math.Pi/180), 0.01))
+	box := BBox{
+		MinLat: p.Lat - dLat, MaxLat: p.Lat + dLat,
+		MinLon: math.Max(p.Lon-dLon, -180), MaxLon: math.Min(p.Lon+dLon, 180),
+	}
+	var near []Neighbour
+	for _, e := range idx.InBBox(box) {
+		if d := DistanceMeters(p, e.Point); d <= radius {
+			near = append(near, Neighbour{Entry: e, Meters: d})
+		}
+	}
+	sort.SliceStable(near, func(i, j int) bool { return near[i].Meters < near[j].Meters })
+	return near
+}
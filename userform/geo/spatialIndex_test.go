@@ -0,0 +1,99 @@
+package geo
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// offset returns the point north and east metres from p.
+func offset(p Point, north, east float64) Point {
+	const metersPerDegree = EarthRadius * math.Pi / 180
+	return Point{
+		Lat: p.Lat + north/metersPerDegree,
+		Lon: p.Lon + east/(metersPerDegree*math.Cos(p.Lat*math.Pi/180)),
+	}
+}
+
+func TestSpatialIndexWithin(t *testing.T) {
+	centre := Point{Lat: 27.7, Lon: 85.3}
+	idx := NewSpatialIndex(0.001)
+	idx.Put(1, centre)
+	idx.Put(2, offset(centre, 3, 0))
+	idx.Put(3, offset(centre, 0, -8))
+	idx.Put(4, offset(centre, 150, 150))
+	idx.Put(5, offset(centre, -4000, 0))
+
+	tests := []struct {
+		name   string
+		radius float64
+		want   []int
+	}{
+		{"nothing but the point itself", 1, []int{1}},
+		{"nearest first", 10, []int{1, 2, 3}},
+		{"across cells", 250, []int{1, 2, 3, 4}},
+		{"everything", 5000, []int{1, 2, 3, 4, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []int
+			for _, n := range idx.Within(centre, tt.radius) {
+				if n.Meters > tt.radius {
+					t.Errorf("entry %d is %.1f m away, beyond %v", n.ID, n.Meters, tt.radius)
+				}
+				got = append(got, n.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Within(%v) = %v, want %v", tt.radius, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSpatialIndexInBBox(t *testing.T) {
+	idx := NewSpatialIndex(1)
+	idx.Put(1, Point{Lat: 10, Lon: 10})
+	idx.Put(2, Point{Lat: 10.5, Lon: 11})
+	idx.Put(3, Point{Lat: 12, Lon: 12})
+	idx.Put(4, Point{Lat: -30, Lon: 150})
+
+	tests := []struct {
+		name string
+		box  BBox
+		want []int
+	}{
+		{"edges included", BBox{MinLat: 10, MinLon: 10, MaxLat: 10.5, MaxLon: 11}, []int{1, 2}},
+		{"empty", BBox{MinLat: 0, MinLon: 0, MaxLat: 1, MaxLon: 1}, nil},
+		{"more cells than entries", BBox{MinLat: -90, MinLon: -180, MaxLat: 90, MaxLon: 180}, []int{1, 2, 3, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []int
+			for _, e := range idx.InBBox(tt.box) {
+				got = append(got, e.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("InBBox() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSpatialIndexClone(t *testing.T) {
+	idx := NewSpatialIndex(1)
+	idx.Put(1, Point{Lat: 10, Lon: 10})
+	idx.Put(2, Point{Lat: 10.2, Lon: 10.2})
+
+	clone := idx.Clone()
+	clone.Put(3, Point{Lat: 10.4, Lon: 10.4})
+	clone.Put(1, Point{Lat: 40, Lon: 40})
+	clone.Remove(2)
+
+	all := BBox{MinLat: -90, MinLon: -180, MaxLat: 90, MaxLon: 180}
+	if got := idx.InBBox(all); idx.Len() != 2 || len(got) != 2 || got[0].Point != (Point{Lat: 10, Lon: 10}) {
+		t.Errorf("changing the clone changed the index: %v", got)
+	}
+	if got := clone.InBBox(all); clone.Len() != 2 || len(got) != 2 || got[0].Point != (Point{Lat: 40, Lon: 40}) || got[1].ID != 3 {
+		t.Errorf("clone = %v, want 1 moved and 3 added", got)
+	}
+}
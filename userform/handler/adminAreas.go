@@ -0,0 +1,374 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"github/rabinam24/userform/geo"
+	"github/rabinam24/userform/models"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// maxAdminAreaBytes caps an uploaded boundary file.
+const maxAdminAreaBytes = 200 << 20
+
+// adminAreaProperties lists, per level, the feature property names read
+// for it, compared case-insensitively. They cover the plain names and the
+// ones used by the Survey Department's local level datasets.
+var adminAreaProperties = []struct {
+	level string
+	keys  []string
+}{
+	{"province", []string{"province", "pr_name", "state", "state_name"}},
+	{"district", []string{"district", "dist_name", "district_name"}},
+	{"municipality", []string{"municipality", "gapa_napa", "local_unit", "palika", "local_name"}},
+	{"ward", []string{"ward", "ward_no", "new_ward_n", "ward_name"}},
+}
+
+// adminAreaColumns are the userform columns holding the tags, in the order
+// of models.AdminAreaTags.
+var adminAreaColumns = []string{"province", "district", "municipality", "ward"}
+
+func tagFields(t *models.AdminAreaTags) []*string {
+	return []*string{&t.Province, &t.District, &t.Municipality, &t.Ward}
+}
+
+// areaTagsFromProperties reads the area names of a boundary feature.
+func areaTagsFromProperties(properties map[string]any) models.AdminAreaTags {
+	var tags models.AdminAreaTags
+	fields := tagFields(&tags)
+	for key, value := range properties {
+		if value == nil {
+			continue
+		}
+		for i, level := range adminAreaProperties {
+			if isOneOf(strings.ToLower(key), level.keys) && *fields[i] == "" {
+				*fields[i] = strings.TrimSpace(fmt.Sprint(value))
+			}
+		}
+	}
+	return tags
+}
+
+// loadedAdminArea is a boundary held in memory for tagging.
+type loadedAdminArea struct {
+	tags   models.AdminAreaTags
+	shape  *geo.Shape
+	bbox   geo.BBox
+	levels int     // how many levels the area names
+	size   float64 // bounding box area, in square degrees
+}
+
+// adminAreaIndex holds the loaded boundaries, most specific first.
+type adminAreaIndex struct {
+	mu    sync.RWMutex
+	areas []loadedAdminArea
+}
+
+// adminAreas is what submissions are tagged against.
+var adminAreas = &adminAreaIndex{}
+
+func (idx *adminAreaIndex) set(areas []loadedAdminArea) {
+	sort.SliceStable(areas, func(i, j int) bool {
+		if areas[i].levels != areas[j].levels {
+			return areas[i].levels > areas[j].levels
+		}
+		return areas[i].size < areas[j].size
+	})
+	idx.mu.Lock()
+	idx.areas = areas
+	idx.mu.Unlock()
+}
+
+// locate names the areas containing p. Each level comes from the most
+// specific boundary containing p that names it, so ward polygons and
+// separately loaded district polygons combine.
+func (idx *adminAreaIndex) locate(p geo.Point) models.AdminAreaTags {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var tags models.AdminAreaTags
+	fields := tagFields(&tags)
+	missing := len(fields)
+	for _, area := range idx.areas {
+		if missing == 0 {
+			break
+		}
+		if !area.bbox.Contains(p) || !area.shape.Contains(p) {
+			continue
+		}
+		areaFields := tagFields(&area.tags)
+		for i, field := range fields {
+			if *field == "" && *areaFields[i] != "" {
+				*field = *areaFields[i]
+				missing--
+			}
+		}
+	}
+	return tags
+}
+
+// LoadAdminAreas imports file (unless that exact file was loaded before)
+// and loads the stored boundaries for tagging submissions. Shapefiles must
+// be converted first, e.g. with ogr2ogr -f GeoJSON. When a new file was
+// imported, existing submissions are re-tagged in the background.
+func LoadAdminAreas(db *sql.DB, file string) error {
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		sum := sha256.Sum256(data)
+		var loaded bool
+		if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM admin_areas WHERE source = $1)`, hex.EncodeToString(sum[:])).Scan(&loaded); err != nil {
+			return fmt.Errorf("failed to check admin areas: %w", err)
+		}
+		if !loaded {
+			result, err := importAdminAreas(db, data, true)
+			if err != nil {
+				return fmt.Errorf("failed to import %s: %w", file, err)
+			}
+			log.Printf("Imported %d admin areas from %s (%d features skipped)", result.Areas, file, result.Skipped)
+			go func() {
+				n, err := retagAdminAreas(db)
+				if err != nil {
+					log.Printf("Error re-tagging submissions with admin areas: %v", err)
+					return
+				}
+				log.Printf("Re-tagged %d submissions with admin areas", n)
+			}()
+			return nil
+		}
+	}
+	return reloadAdminAreas(db)
+}
+
+// reloadAdminAreas replaces the in-memory boundaries with the stored ones.
+func reloadAdminAreas(db *sql.DB) error {
+	rows, err := db.Query(`SELECT id, province, district, municipality, ward, geometry FROM admin_areas`)
+	if err != nil {
+		return fmt.Errorf("failed to query admin areas: %w", err)
+	}
+	defer rows.Close()
+
+	var areas []loadedAdminArea
+	for rows.Next() {
+		var id int
+		var area loadedAdminArea
+		var geometry []byte
+		if err := rows.Scan(&id, &area.tags.Province, &area.tags.District, &area.tags.Municipality, &area.tags.Ward, &geometry); err != nil {
+			return fmt.Errorf("failed to scan admin area: %w", err)
+		}
+		if area.shape, err = geo.ParseGeoJSON(geometry); err != nil {
+			log.Printf("Skipping admin area %d with unreadable geometry: %v", id, err)
+			continue
+		}
+		areas = append(areas, newLoadedAdminArea(area.tags, area.shape))
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating over admin areas: %w", err)
+	}
+	adminAreas.set(areas)
+	return nil
+}
+
+func newLoadedAdminArea(tags models.AdminAreaTags, shape *geo.Shape) loadedAdminArea {
+	area := loadedAdminArea{tags: tags, shape: shape, bbox: shape.BBox()}
+	for _, field := range tagFields(&area.tags) {
+		if *field != "" {
+			area.levels++
+		}
+	}
+	area.size = math.Abs((area.bbox.MaxLat - area.bbox.MinLat) * (area.bbox.MaxLon - area.bbox.MinLon))
+	return area
+}
+
+// importAdminAreas stores the boundary features of a GeoJSON file, replacing
+// all stored boundaries if replace is set, and reloads the in-memory index.
+// Features without a polygon or any area name are skipped.
+func importAdminAreas(db *sql.DB, data []byte, replace bool) (models.AdminAreaImport, error) {
+	var result models.AdminAreaImport
+	features, err := geo.ParseFeatures(data)
+	if err != nil {
+		var problems fieldErrors
+		problems.add("file", "%v", err)
+		return result, problems.err()
+	}
+	sum := sha256.Sum256(data)
+	source := hex.EncodeToString(sum[:])
+
+	tx, err := db.Begin()
+	if err != nil {
+		return result, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if replace {
+		if _, err := tx.Exec(`DELETE FROM admin_areas`); err != nil {
+			return result, fmt.Errorf("failed to clear admin areas: %w", err)
+		}
+	}
+	stmt, err := tx.Prepare(`INSERT INTO admin_areas (province, district, municipality, ward, geometry, source)
+		VALUES ($1, $2, $3, $4, $5, $6)`)
+	if err != nil {
+		return result, fmt.Errorf("failed to prepare admin area insert: %w", err)
+	}
+	defer stmt.Close()
+	for _, feature := range features {
+		tags := areaTagsFromProperties(feature.Properties)
+		if len(feature.Shape.Polygons) == 0 || tags == (models.AdminAreaTags{}) {
+			result.Skipped++
+			continue
+		}
+		if _, err := stmt.Exec(tags.Province, tags.District, tags.Municipality, tags.Ward, []byte(feature.Geometry), source); err != nil {
+			return result, fmt.Errorf("failed to store admin area: %w", err)
+		}
+		result.Areas++
+	}
+	if err := tx.Commit(); err != nil {
+		return result, fmt.Errorf("failed to commit admin areas: %w", err)
+	}
+	return result, reloadAdminAreas(db)
+}
+
+// retagAdminAreas tags every submission with the loaded boundaries and
+// returns how many changed.
+func retagAdminAreas(db *sql.DB) (int, error) {
+	type taggedRow struct {
+		id   int
+		tags models.AdminAreaTags
+	}
+	rows, err := db.Query(`SELECT id, latitude, longitude, COALESCE(province, ''), COALESCE(district, ''),
+		COALESCE(municipality, ''), COALESCE(ward, '') FROM userform WHERE latitude IS NOT NULL AND longitude IS NOT NULL`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query submissions: %w", err)
+	}
+	var changed []taggedRow
+	for rows.Next() {
+		var row taggedRow
+		var p geo.Point
+		if err := rows.Scan(&row.id, &p.Lat, &p.Lon, &row.tags.Province, &row.tags.District, &row.tags.Municipality, &row.tags.Ward); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan submission: %w", err)
+		}
+		if tags := adminAreas.locate(p); tags != row.tags {
+			changed = append(changed, taggedRow{row.id, tags})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error iterating over submissions: %w", err)
+	}
+
+	const batch = 500
+	for start := 0; start < len(changed); start += batch {
+		end := min(start+batch, len(changed))
+		tx, err := db.Begin()
+		if err != nil {
+			return start, fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		for _, row := range changed[start:end] {
+			_, err := tx.Exec(`UPDATE userform SET province = $2, district = $3, municipality = $4, ward = $5 WHERE id = $1`,
+				row.id, nullString(row.tags.Province), nullString(row.tags.District), nullString(row.tags.Municipality), nullString(row.tags.Ward))
+			if err == nil {
+				err = recordChange(tx, row.id, "upsert")
+			}
+			if err != nil {
+				tx.Rollback()
+				return start, fmt.Errorf("failed to tag submission %d: %w", row.id, err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return start, fmt.Errorf("failed to commit tags: %w", err)
+		}
+	}
+	return len(changed), nil
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// adminAreaConditions turns the province, district, municipality and ward
+// query parameters into conditions on the userform alias uf, numbering
+// placeholders after args.
+func adminAreaConditions(query url.Values, args []interface{}) ([]string, []interface{}) {
+	var conditions []string
+	for _, column := range adminAreaColumns {
+		if value := query.Get(column); value != "" {
+			args = append(args, value)
+			conditions = append(conditions, fmt.Sprintf("uf.%s = $%d", column, len(args)))
+		}
+	}
+	return conditions, args
+}
+
+// HandleImportAdminAreas loads a GeoJSON FeatureCollection of boundaries
+// from the request body and re-tags every submission. The upload replaces
+// all stored boundaries unless ?replace=false, which adds to them, e.g. to
+// load districts and wards from separate files.
+func HandleImportAdminAreas(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxAdminAreaBytes))
+		if err != nil {
+			writeFormError(w, err)
+			return
+		}
+
+		result, err := importAdminAreas(db, data, r.URL.Query().Get("replace") != "false")
+		if err != nil {
+			log.Printf("Error importing admin areas: %v", err)
+			writeFormError(w, err)
+			return
+		}
+		result.Retagged, err = retagAdminAreas(db)
+		if err != nil {
+			log.Printf("Error re-tagging submissions with admin areas: %v", err)
+			http.Error(w, "Boundaries were stored but re-tagging failed", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Imported %d admin areas, re-tagged %d submissions", result.Areas, result.Retagged)
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+// HandleListAdminAreas lists the loaded boundaries without their geometry,
+// for building area filters.
+func HandleListAdminAreas(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query(`SELECT id, province, district, municipality, ward, source, created_at FROM admin_areas
+			ORDER BY province, district, municipality, ward, id`)
+		if err != nil {
+			log.Printf("Error listing admin areas: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		areas := []models.AdminArea{}
+		for rows.Next() {
+			var area models.AdminArea
+			if err := rows.Scan(&area.ID, &area.Province, &area.District, &area.Municipality, &area.Ward, &area.Source, &area.CreatedAt); err != nil {
+				log.Printf("Error scanning admin area: %v", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			areas = append(areas, area)
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("Error iterating over admin areas: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, areas)
+	}
+}
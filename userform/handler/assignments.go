@@ -0,0 +1,537 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github/rabinam24/userform/geo"
+	"github/rabinam24/userform/models"
+	"github/rabinam24/userform/track"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var assignmentStatuses = []string{"active", "completed", "cancelled"}
+
+const (
+	// streetSampleStep is the length of the route pieces checked for
+	// coverage, in metres.
+	streetSampleStep = 10.0
+	// streetCoverageReach is how close a pole or trip position must be to a
+	// route piece for it to count as walked, in metres.
+	streetCoverageReach = 25.0
+)
+
+// activeAssignmentOrder picks the assignment a surveyor is working on when
+// several are active: the one due first.
+const activeAssignmentOrder = `ORDER BY a.due_date NULLS LAST, a.id`
+
+// assignmentColumns selects everything models.Assignment holds, aliased as
+// a.
+const assignmentColumns = `a.id, a.name, a.area, a.routes, a.due_date, a.status, a.created_by, a.created_at, a.updated_at,
+	ARRAY(SELECT s.username FROM assignment_surveyors s WHERE s.assignment_id = a.id ORDER BY s.username)`
+
+// queryAssignments runs "SELECT assignmentColumns FROM assignments a
+// <clauses>" and scans the result.
+func queryAssignments(db *sql.DB, clauses string, args ...interface{}) ([]models.Assignment, error) {
+	rows, err := db.Query("SELECT "+assignmentColumns+" FROM assignments a "+clauses, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query assignments: %w", err)
+	}
+	defer rows.Close()
+
+	assignments := []models.Assignment{}
+	for rows.Next() {
+		var a models.Assignment
+		var area, routes []byte
+		var dueDate sql.NullTime
+		var surveyors pq.StringArray
+		err := rows.Scan(&a.ID, &a.Name, &area, &routes, &dueDate, &a.Status, &a.CreatedBy, &a.CreatedAt, &a.UpdatedAt, &surveyors)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan assignment: %w", err)
+		}
+		a.Area = area
+		if routes != nil {
+			a.Routes = routes
+		}
+		if dueDate.Valid {
+			a.DueDate = dueDate.Time.Format(dueDateLayout)
+		}
+		a.Surveyors = surveyors
+		assignments = append(assignments, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over assignments: %w", err)
+	}
+	return assignments, nil
+}
+
+// isGeoJSONNull reports whether an optional GeoJSON field was left out.
+func isGeoJSONNull(raw json.RawMessage) bool {
+	trimmed := strings.TrimSpace(string(raw))
+	return trimmed == "" || trimmed == "null"
+}
+
+// validateAssignment checks an assignment before it is stored and normalises
+// its surveyor list.
+func validateAssignment(a *models.Assignment, problems *fieldErrors) {
+	a.Name = strings.TrimSpace(a.Name)
+	if a.Name == "" || len(a.Name) > maxTextBytes {
+		problems.add("name", "must be 1-%d bytes", maxTextBytes)
+	}
+
+	if isGeoJSONNull(a.Area) {
+		problems.add("area", "is required")
+	} else if shape, err := geo.ParseGeoJSON(a.Area); err != nil {
+		problems.add("area", "%v", err)
+	} else if len(shape.Polygons) == 0 {
+		problems.add("area", "must contain a Polygon or MultiPolygon")
+	}
+
+	if isGeoJSONNull(a.Routes) {
+		a.Routes = nil
+	} else if shape, err := geo.ParseGeoJSON(a.Routes); err != nil {
+		problems.add("routes", "%v", err)
+	} else if len(shape.Lines) == 0 {
+		problems.add("routes", "must contain a LineString or MultiLineString")
+	}
+
+	seen := make(map[string]bool)
+	surveyors := []string{}
+	for i, username := range a.Surveyors {
+		username = strings.TrimSpace(username)
+		if username == "" || len(username) > 50 {
+			problems.add(fmt.Sprintf("surveyors[%d]", i), "must be 1-50 bytes")
+			continue
+		}
+		if !seen[username] {
+			seen[username] = true
+			surveyors = append(surveyors, username)
+		}
+	}
+	a.Surveyors = surveyors
+	if len(surveyors) == 0 && !problems.has("surveyors") {
+		problems.add("surveyors", "at least one surveyor is required")
+	}
+
+	if a.DueDate != "" {
+		if _, err := time.Parse(dueDateLayout, a.DueDate); err != nil {
+			problems.add("due_date", "must be a date like 2006-01-02")
+		}
+	}
+	if !isOneOf(a.Status, assignmentStatuses) {
+		problems.add("status", "must be one of: %s", strings.Join(assignmentStatuses, ", "))
+	}
+}
+
+// setAssignmentSurveyors replaces the surveyors of an assignment.
+func setAssignmentSurveyors(tx *sql.Tx, id int, surveyors []string) error {
+	if _, err := tx.Exec(`DELETE FROM assignment_surveyors WHERE assignment_id = $1`, id); err != nil {
+		return fmt.Errorf("failed to clear surveyors of assignment %d: %w", id, err)
+	}
+	_, err := tx.Exec(`INSERT INTO assignment_surveyors (assignment_id, username) SELECT $1, unnest($2::text[])`, id, pq.Array(surveyors))
+	if err != nil {
+		return fmt.Errorf("failed to assign surveyors to assignment %d: %w", id, err)
+	}
+	return nil
+}
+
+func nullJSON(raw json.RawMessage) interface{} {
+	if raw == nil {
+		return nil
+	}
+	return []byte(raw)
+}
+
+// activeAssignment is an active assignment of a surveyor with its parsed
+// area.
+type activeAssignment struct {
+	id   int
+	name string
+	area *geo.Shape
+}
+
+// activeAssignments returns the active assignments of a surveyor, the one
+// due first first.
+func activeAssignments(db *sql.DB, username string) ([]activeAssignment, error) {
+	rows, err := db.Query(`SELECT a.id, a.name, a.area FROM assignments a
+		JOIN assignment_surveyors s ON s.assignment_id = a.id
+		WHERE s.username = $1 AND a.status = 'active' `+activeAssignmentOrder, username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query assignments of %s: %w", username, err)
+	}
+	defer rows.Close()
+
+	var assignments []activeAssignment
+	for rows.Next() {
+		var a activeAssignment
+		var area []byte
+		if err := rows.Scan(&a.id, &a.name, &area); err != nil {
+			return nil, fmt.Errorf("failed to scan assignment: %w", err)
+		}
+		if a.area, err = geo.ParseGeoJSON(area); err != nil {
+			log.Printf("Skipping assignment %d with unreadable area: %v", a.id, err)
+			continue
+		}
+		assignments = append(assignments, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over assignments: %w", err)
+	}
+	return assignments, nil
+}
+
+// linkAssignment links a submission to the surveyor's active assignment
+// whose area contains it. A submission outside every assigned area is still
+// linked to the assignment due first, flagged, and a warning for the
+// surveyor is returned.
+func linkAssignment(db *sql.DB, formData *models.FormData) (string, error) {
+	formData.AssignmentID = 0
+	formData.OutsideAssignment = false
+	if formData.Surveyor == "" {
+		return "", nil
+	}
+	assignments, err := activeAssignments(db, formData.Surveyor)
+	if err != nil || len(assignments) == 0 {
+		return "", err
+	}
+
+	point := geo.Point{Lat: formData.Latitude, Lon: formData.Longitude}
+	for _, a := range assignments {
+		if a.area.Contains(point) {
+			formData.AssignmentID = a.id
+			return "", nil
+		}
+	}
+	formData.AssignmentID = assignments[0].id
+	formData.OutsideAssignment = true
+	return fmt.Sprintf("Submission is outside the area of assignment %d (%s)", assignments[0].id, assignments[0].name), nil
+}
+
+// HandleListAssignments lists assignments, newest first. Filters: status
+// (comma separated) and username.
+func HandleListAssignments(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		var conditions []string
+		var args []interface{}
+		if status := query.Get("status"); status != "" {
+			args = append(args, pq.Array(strings.Split(status, ",")))
+			conditions = append(conditions, fmt.Sprintf("a.status = ANY($%d)", len(args)))
+		}
+		if username := query.Get("username"); username != "" {
+			args = append(args, username)
+			conditions = append(conditions, fmt.Sprintf("EXISTS (SELECT 1 FROM assignment_surveyors s WHERE s.assignment_id = a.id AND s.username = $%d)", len(args)))
+		}
+		clauses := ""
+		if len(conditions) > 0 {
+			clauses = "WHERE " + strings.Join(conditions, " AND ")
+		}
+
+		assignments, err := queryAssignments(db, clauses+" ORDER BY a.created_at DESC, a.id DESC", args...)
+		if err != nil {
+			log.Printf("Error listing assignments: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, assignments)
+	}
+}
+
+// HandleCreateAssignment stores an area and assigns it to surveyors.
+func HandleCreateAssignment(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a := models.Assignment{Status: "active"}
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		var problems fieldErrors
+		validateAssignment(&a, &problems)
+		if err := problems.err(); err != nil {
+			writeFormError(w, err)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Error beginning transaction: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		query := `INSERT INTO assignments (name, area, routes, due_date, status, created_by)
+			VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
+		err = tx.QueryRow(query, a.Name, []byte(a.Area), nullJSON(a.Routes), nullDate(a.DueDate), a.Status, a.CreatedBy).Scan(&a.ID)
+		if err != nil {
+			log.Printf("Error creating assignment: %v", err)
+			http.Error(w, "Failed to create assignment", http.StatusInternalServerError)
+			return
+		}
+		if err := setAssignmentSurveyors(tx, a.ID, a.Surveyors); err != nil {
+			log.Printf("Error creating assignment: %v", err)
+			http.Error(w, "Failed to create assignment", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("Error committing assignment: %v", err)
+			http.Error(w, "Failed to create assignment", http.StatusInternalServerError)
+			return
+		}
+
+		assignments, err := queryAssignments(db, "WHERE a.id = $1", a.ID)
+		if err != nil || len(assignments) == 0 {
+			log.Printf("Error loading assignment %d: %v", a.ID, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, assignments[0])
+	}
+}
+
+// HandleAssignment serves one assignment.
+func HandleAssignment(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		assignments, err := queryAssignments(db, "WHERE a.id = $1", id)
+		if err != nil {
+			log.Printf("Error loading assignment %d: %v", id, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if len(assignments) == 0 {
+			http.Error(w, "Assignment not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, assignments[0])
+	}
+}
+
+// HandleUpdateAssignment changes the fields given in the request. Sending
+// "routes": null removes the planned routes.
+func HandleUpdateAssignment(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		var update models.AssignmentUpdate
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		assignments, err := queryAssignments(db, "WHERE a.id = $1", id)
+		if err != nil {
+			log.Printf("Error loading assignment %d: %v", id, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if len(assignments) == 0 {
+			http.Error(w, "Assignment not found", http.StatusNotFound)
+			return
+		}
+		a := assignments[0]
+
+		if update.Name != nil {
+			a.Name = *update.Name
+		}
+		if update.Area != nil {
+			a.Area = update.Area
+		}
+		if update.Routes != nil {
+			a.Routes = update.Routes
+		}
+		if update.Surveyors != nil {
+			a.Surveyors = *update.Surveyors
+		}
+		if update.DueDate != nil {
+			a.DueDate = *update.DueDate
+		}
+		if update.Status != nil {
+			a.Status = *update.Status
+		}
+		var problems fieldErrors
+		validateAssignment(&a, &problems)
+		if err := problems.err(); err != nil {
+			writeFormError(w, err)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Error beginning transaction: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		query := `UPDATE assignments SET name = $2, area = $3, routes = $4, due_date = $5, status = $6,
+			updated_at = CURRENT_TIMESTAMP WHERE id = $1`
+		if _, err := tx.Exec(query, id, a.Name, []byte(a.Area), nullJSON(a.Routes), nullDate(a.DueDate), a.Status); err != nil {
+			log.Printf("Error updating assignment %d: %v", id, err)
+			http.Error(w, "Failed to update assignment", http.StatusInternalServerError)
+			return
+		}
+		if update.Surveyors != nil {
+			if err := setAssignmentSurveyors(tx, id, a.Surveyors); err != nil {
+				log.Printf("Error updating assignment %d: %v", id, err)
+				http.Error(w, "Failed to update assignment", http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("Error committing assignment %d: %v", id, err)
+			http.Error(w, "Failed to update assignment", http.StatusInternalServerError)
+			return
+		}
+
+		assignments, err = queryAssignments(db, "WHERE a.id = $1", id)
+		if err != nil || len(assignments) == 0 {
+			log.Printf("Error loading assignment %d: %v", id, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, assignments[0])
+	}
+}
+
+// HandleAssignmentProgress reports how far the surveyors of an assignment
+// got.
+func HandleAssignmentProgress(db *sql.DB, opts track.Options) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		assignments, err := queryAssignments(db, "WHERE a.id = $1", id)
+		if err != nil {
+			log.Printf("Error loading assignment %d: %v", id, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if len(assignments) == 0 {
+			http.Error(w, "Assignment not found", http.StatusNotFound)
+			return
+		}
+
+		progress, err := assignmentProgress(db, assignments[0], opts)
+		if err != nil {
+			log.Printf("Error measuring progress of assignment %d: %v", id, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, progress)
+	}
+}
+
+// assignmentProgress counts the submissions linked to an assignment and
+// measures the distance travelled for it. A surveyor's day is measured
+// along the GPS breadcrumbs of their trips for the assignment, or, for days
+// without any, by chaining that day's submissions in order, both raw and
+// cleaned with opts.
+func assignmentProgress(db *sql.DB, a models.Assignment, opts track.Options) (*models.AssignmentProgress, error) {
+	progress := &models.AssignmentProgress{AssignmentID: a.ID}
+	err := db.QueryRow(`SELECT COUNT(*), COUNT(DISTINCT pole_id), COUNT(*) FILTER (WHERE outside_assignment)
+		FROM userform WHERE assignment_id = $1`, a.ID).
+		Scan(&progress.Submissions, &progress.PolesRecorded, &progress.OutsideAreaSubmissions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count submissions: %w", err)
+	}
+
+	type dayKey struct {
+		username string
+		day      string
+	}
+	type tripDay struct {
+		trip int
+		dayKey
+	}
+	var visited []geo.Point
+	tracks := make(map[tripDay][]track.Fix)
+	tracked := make(map[dayKey]bool)
+	chains := make(map[dayKey][]track.Fix)
+
+	rows, err := db.Query(`SELECT s.id, s.username, p.recorded_at, p.latitude, p.longitude, COALESCE(p.accuracy, 0)
+		FROM trip_points p JOIN trip_sessions s ON s.id = p.trip_id
+		WHERE s.assignment_id = $1 ORDER BY s.id, p.recorded_at, p.id`, a.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query trip points: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key tripDay
+		var f track.Fix
+		if err := rows.Scan(&key.trip, &key.username, &f.Time, &f.Lat, &f.Lon, &f.Accuracy); err != nil {
+			return nil, fmt.Errorf("failed to scan trip point: %w", err)
+		}
+		key.day = f.Time.Format(dueDateLayout)
+		f.Time = fromStored(f.Time)
+		tracks[key] = append(tracks[key], f)
+		tracked[key.dayKey] = true
+		visited = append(visited, geo.Point{Lat: f.Lat, Lon: f.Lon})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over trip points: %w", err)
+	}
+
+	subRows, err := db.Query(`SELECT COALESCE(surveyor, ''), created_at, latitude, longitude
+		FROM userform WHERE assignment_id = $1 ORDER BY created_at, id`, a.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query submissions: %w", err)
+	}
+	defer subRows.Close()
+	for subRows.Next() {
+		var key dayKey
+		var f track.Fix
+		if err := subRows.Scan(&key.username, &f.Time, &f.Lat, &f.Lon); err != nil {
+			return nil, fmt.Errorf("failed to scan submission: %w", err)
+		}
+		key.day = f.Time.Format(dueDateLayout)
+		f.Time = fromStored(f.Time)
+		chains[key] = append(chains[key], f)
+		visited = append(visited, geo.Point{Lat: f.Lat, Lon: f.Lon})
+	}
+	if err := subRows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over submissions: %w", err)
+	}
+
+	var travelled distance
+	for _, fixes := range tracks {
+		travelled.add(measureTrack(fixes, opts))
+	}
+	for key, chain := range chains {
+		if !tracked[key] {
+			travelled.add(measureTrack(chain, opts))
+		}
+	}
+	progress.KmTravelled = roundKm(travelled.cleaned)
+	progress.KmTravelledRaw = roundKm(travelled.raw)
+
+	if a.Routes != nil {
+		routes, err := geo.ParseGeoJSON(a.Routes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read routes: %w", err)
+		}
+		total, covered := geo.CoveredLength(routes.Lines, visited, streetSampleStep, streetCoverageReach)
+		progress.StreetLengthKm = math.Round(total) / 1000
+		if total > 0 {
+			percent := math.Round(covered/total*1000) / 10
+			progress.StreetCoveragePercent = &percent
+		}
+	}
+	return progress, nil
+}
@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github/rabinam24/userform/models"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// HandleListAttributeOptions serves the choices for the enumerated pole
+// attributes, keyed by kind.
+func HandleListAttributeOptions(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		options, err := loadAttributeOptions(db)
+		if err != nil {
+			log.Printf("Error loading attribute options: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, options)
+	}
+}
+
+// HandleReplaceAttributeOptions sets the options of one attribute kind in
+// the given order. Listed values are active unless marked otherwise; values
+// left out are deactivated rather than deleted, as existing surveys may
+// still use them.
+func HandleReplaceAttributeOptions(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		kind := r.PathValue("kind")
+		known := false
+		for _, k := range attributeKinds {
+			known = known || k.Kind == kind
+		}
+		if !known {
+			http.Error(w, "Unknown attribute kind", http.StatusNotFound)
+			return
+		}
+
+		// Listed options are active unless they say "active": false.
+		var raw []json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		options := make([]models.AttributeOption, len(raw))
+		for i, item := range raw {
+			options[i] = models.AttributeOption{Active: true}
+			if err := json.Unmarshal(item, &options[i]); err != nil {
+				http.Error(w, "Invalid request payload", http.StatusBadRequest)
+				return
+			}
+		}
+		var problems fieldErrors
+		seen := make(map[string]bool)
+		for i := range options {
+			options[i].Value = strings.TrimSpace(options[i].Value)
+			value := options[i].Value
+			field := fmt.Sprintf("[%d].value", i)
+			switch {
+			case value == "" || len(value) > maxTextBytes:
+				problems.add(field, "must be 1-%d bytes", maxTextBytes)
+			case seen[strings.ToLower(value)]:
+				problems.add(field, "duplicates another option")
+			}
+			seen[strings.ToLower(value)] = true
+		}
+		if err := problems.err(); err != nil {
+			writeFormError(w, err)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Error beginning transaction: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec(`UPDATE attribute_options SET active = FALSE WHERE kind = $1`, kind); err != nil {
+			log.Printf("Error deactivating %s options: %v", kind, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		query := `INSERT INTO attribute_options (kind, value, position, active, raises_work_order) VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (kind, value) DO UPDATE SET position = EXCLUDED.position, active = EXCLUDED.active, raises_work_order = EXCLUDED.raises_work_order`
+		for i, option := range options {
+			if _, err := tx.Exec(query, kind, option.Value, i+1, option.Active, option.RaisesWorkOrder); err != nil {
+				log.Printf("Error storing %s option %q: %v", kind, option.Value, err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			log.Printf("Error committing %s options: %v", kind, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		all, err := loadAttributeOptions(db)
+		if err != nil {
+			log.Printf("Error loading attribute options: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, all[kind])
+	}
+}
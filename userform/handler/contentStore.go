@@ -0,0 +1,250 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"github/rabinam24/userform/models"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// Images are stored once per distinct content under contentPrefix followed
+// by their SHA-256. The images table counts how many userform image slots
+// point at each object; an object is removed when its count drops to zero.
+// Images not yet saved with a row are held by provisional references
+// (pending), so that one submission cannot remove an image another has
+// just deduplicated onto.
+const contentPrefix = "sha256/"
+
+// StoreContentAddressed moves a freshly uploaded object to its
+// content-addressed key. If identical content is already stored the upload
+// is dropped and the existing object is returned instead. Created reports
+// whether this call created the stored object. Either way the image is
+// held by a provisional reference, which the caller gives up with
+// DropUnreferencedImage once its rows are saved or abandoned. References
+// that are never given up lapse after the orphan grace period.
+func StoreContentAddressed(ctx context.Context, db *sql.DB, minioClient *minio.Client, endpoint, bucketName string, uploaded *StoredObject) (*StoredObject, bool, error) {
+	defer RemoveObjects(minioClient, bucketName, []string{uploaded.Name})
+	return storeContent(ctx, db, minioClient, endpoint, bucketName, uploaded)
+}
+
+// storeContent is StoreContentAddressed leaving the source object in place.
+func storeContent(ctx context.Context, db *sql.DB, minioClient *minio.Client, endpoint, bucketName string, uploaded *StoredObject) (*StoredObject, bool, error) {
+	ext := ".jpeg"
+	if idx := strings.LastIndex(uploaded.Name, "."); idx >= 0 {
+		ext = uploaded.Name[idx:]
+	}
+	objectName := contentPrefix + uploaded.SHA256 + ext
+
+	// Waits for a DropUnreferencedImage holding the row, so an image is
+	// either kept for us or removed before we store it again.
+	var created bool
+	err := db.QueryRow(`INSERT INTO images (sha256, object_name, size, pending, pending_since) VALUES ($1, $2, $3, 1, $4)
+		ON CONFLICT (sha256) DO UPDATE SET pending = images.pending + 1, pending_since = EXCLUDED.pending_since
+		RETURNING object_name, xmax = 0`,
+		uploaded.SHA256, objectName, uploaded.Size, time.Now()).Scan(&objectName, &created)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to record image %s: %w", uploaded.SHA256, err)
+	}
+
+	if !created {
+		log.Printf("Image %s is a duplicate of %s", uploaded.Name, objectName)
+	} else {
+		_, err := minioClient.CopyObject(ctx,
+			minio.CopyDestOptions{Bucket: bucketName, Object: objectName},
+			minio.CopySrcOptions{Bucket: bucketName, Object: uploaded.Name})
+		if err != nil {
+			DropUnreferencedImage(db, minioClient, bucketName, uploaded.SHA256)
+			return nil, false, fmt.Errorf("failed to copy %s to %s: %w", uploaded.Name, objectName, err)
+		}
+	}
+
+	return &StoredObject{
+		Name:   objectName,
+		URL:    objectURL(endpoint, bucketName, objectName),
+		SHA256: uploaded.SHA256,
+		Size:   uploaded.Size,
+	}, created, nil
+}
+
+// HashObject streams an object back from the bucket to compute its SHA-256.
+func HashObject(ctx context.Context, minioClient *minio.Client, endpoint, bucketName, objectName string) (*StoredObject, error) {
+	object, err := minioClient.GetObject(ctx, bucketName, objectName, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open object %s: %w", objectName, err)
+	}
+	defer object.Close()
+
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, object)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object %s: %w", objectName, err)
+	}
+
+	return &StoredObject{
+		Name:   objectName,
+		URL:    objectURL(endpoint, bucketName, objectName),
+		SHA256: hex.EncodeToString(hasher.Sum(nil)),
+		Size:   size,
+	}, nil
+}
+
+// DropUnreferencedImage gives up a provisional reference taken by
+// StoreContentAddressed and removes the image if nothing else holds it.
+// Failures are only logged; the orphan reconciler catches leftovers.
+func DropUnreferencedImage(db *sql.DB, minioClient *minio.Client, bucketName, sum string) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error releasing image %s: %v", sum, err)
+		return
+	}
+	defer tx.Rollback()
+
+	var objectName string
+	var refCount, pending int
+	err = tx.QueryRow(`UPDATE images SET pending = GREATEST(pending - 1, 0) WHERE sha256 = $1
+		RETURNING object_name, ref_count, pending`, sum).Scan(&objectName, &refCount, &pending)
+	if err == sql.ErrNoRows {
+		return
+	}
+	if err != nil {
+		log.Printf("Error releasing image %s: %v", sum, err)
+		return
+	}
+	if refCount == 0 && pending == 0 {
+		// The object goes while the row is still locked, so no one can
+		// deduplicate onto it in between.
+		if err := minioClient.RemoveObject(context.Background(), bucketName, objectName, minio.RemoveObjectOptions{}); err != nil {
+			log.Printf("Error removing image %s: %v", objectName, err)
+			return
+		}
+		if _, err := tx.Exec(`DELETE FROM images WHERE sha256 = $1`, sum); err != nil {
+			log.Printf("Error dropping image %s: %v", sum, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error releasing image %s: %v", sum, err)
+	}
+}
+
+// contentHashFromURL returns the SHA-256 of a content-addressed image URL,
+// or "" for images stored before deduplication.
+func contentHashFromURL(imageURL string) string {
+	idx := strings.Index(imageURL, "/"+contentPrefix)
+	if idx < 0 {
+		return ""
+	}
+	sum := imageURL[idx+1+len(contentPrefix):]
+	if dot := strings.Index(sum, "."); dot >= 0 {
+		sum = sum[:dot]
+	}
+	return sum
+}
+
+// imageRef is one image slot of a userform row.
+type imageRef struct {
+	URL  string
+	Role string // poleimage, multipleimages or isp_tag
+}
+
+// formImageRefs lists every image slot of formData.
+func formImageRefs(formData models.FormData) []imageRef {
+	var refs []imageRef
+	if formData.PoleImage != "" {
+		refs = append(refs, imageRef{formData.PoleImage, "poleimage"})
+	}
+	for _, imageURL := range formData.MultipleImages {
+		refs = append(refs, imageRef{imageURL, "multipleimages"})
+	}
+	refs = append(refs, ispImageRefs(formData.ISPs)...)
+	return refs
+}
+
+// addImageReferences records that a userform row uses the given images and
+// bumps their reference counts. It fails if an image has been removed in
+// the meantime, so the caller's transaction is rolled back.
+func addImageReferences(tx *sql.Tx, userformID int, refs []imageRef) error {
+	for _, ref := range refs {
+		sum := contentHashFromURL(ref.URL)
+		if sum == "" {
+			continue
+		}
+		res, err := tx.Exec(`UPDATE images SET ref_count = ref_count + 1 WHERE sha256 = $1`, sum)
+		if err != nil {
+			return fmt.Errorf("failed to reference image %s: %w", sum, err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return fmt.Errorf("image %s is no longer stored", sum)
+		}
+		if _, err := tx.Exec(`INSERT INTO userform_images (userform_id, sha256, role) VALUES ($1, $2, $3)`, userformID, sum, ref.Role); err != nil {
+			return fmt.Errorf("failed to link image %s: %w", sum, err)
+		}
+	}
+	return nil
+}
+
+// releaseImageReferences drops the references a userform row holds, limited
+// to one role unless role is empty, and returns the hashes it released.
+// Counts may reach zero here; pass the hashes to dropUnusedImages once any
+// new references of the same transaction have been added.
+func releaseImageReferences(tx *sql.Tx, userformID int, role string) ([]string, error) {
+	rows, err := tx.Query(`SELECT sha256, COUNT(*) FROM userform_images WHERE userform_id = $1 AND ($2 = '' OR role = $2) GROUP BY sha256`, userformID, role)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query image references: %w", err)
+	}
+	counts := make(map[string]int)
+	for rows.Next() {
+		var sum string
+		var n int
+		if err := rows.Scan(&sum, &n); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan image reference: %w", err)
+		}
+		counts[sum] = n
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over image references: %w", err)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM userform_images WHERE userform_id = $1 AND ($2 = '' OR role = $2)`, userformID, role); err != nil {
+		return nil, fmt.Errorf("failed to unlink images: %w", err)
+	}
+
+	var released []string
+	for sum, n := range counts {
+		if _, err := tx.Exec(`UPDATE images SET ref_count = ref_count - $2 WHERE sha256 = $1`, sum, n); err != nil {
+			return nil, fmt.Errorf("failed to release image %s: %w", sum, err)
+		}
+		released = append(released, sum)
+	}
+	return released, nil
+}
+
+// dropUnusedImages deletes the image records among sums that have no
+// references left, provisional ones included, and returns their object
+// names. The objects should only
+// be removed from the bucket after the transaction commits.
+func dropUnusedImages(tx *sql.Tx, sums []string) ([]string, error) {
+	var unused []string
+	for _, sum := range sums {
+		var objectName string
+		err := tx.QueryRow(`DELETE FROM images WHERE sha256 = $1 AND ref_count <= 0 AND pending = 0 RETURNING object_name`, sum).Scan(&objectName)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to drop image %s: %w", sum, err)
+		}
+		unused = append(unused, objectName)
+	}
+	return unused, nil
+}
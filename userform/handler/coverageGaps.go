@@ -0,0 +1,180 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github/rabinam24/userform/geo"
+	"github/rabinam24/userform/models"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	minCoverageCellSize = 10.0
+	maxCoverageCellSize = 10000.0
+	maxCoverageCells    = 250000
+	// coverageCacheSize is how many analyses are kept.
+	coverageCacheSize = 32
+)
+
+// HandleCoverageGaps divides a boundary into a grid and returns the cells
+// with fewer than min_poles surveyed poles as GeoJSON. A cell belongs to the
+// boundary when its centre does. Results are cached per boundary, cell size
+// and threshold until the next survey is stored, changed or deleted.
+func HandleCoverageGaps(db *sql.DB) http.HandlerFunc {
+	cache := newVersionedCache[*models.CoverageGaps](coverageCacheSize)
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := models.CoverageGapRequest{MinPoles: 1}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		var problems fieldErrors
+		if req.AssignmentID != 0 {
+			err := db.QueryRow(`SELECT area FROM assignments WHERE id = $1`, req.AssignmentID).Scan((*[]byte)(&req.Boundary))
+			if err == sql.ErrNoRows {
+				problems.add("assignment_id", "assignment %d does not exist", req.AssignmentID)
+			} else if err != nil {
+				log.Printf("Error loading area of assignment %d: %v", req.AssignmentID, err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+		}
+		var boundary *geo.Shape
+		if !problems.has("assignment_id") {
+			var err error
+			if isGeoJSONNull(req.Boundary) {
+				problems.add("boundary", "is required unless assignment_id is given")
+			} else if boundary, err = geo.ParseGeoJSON(req.Boundary); err != nil {
+				problems.add("boundary", "%v", err)
+			} else if len(boundary.Polygons) == 0 {
+				problems.add("boundary", "must contain a Polygon or MultiPolygon")
+			}
+		}
+		if req.CellSize < minCoverageCellSize || req.CellSize > maxCoverageCellSize {
+			problems.add("cell_size", "must be between %.0f and %.0f metres", minCoverageCellSize, maxCoverageCellSize)
+		}
+		if req.MinPoles < 1 {
+			problems.add("min_poles", "must be at least 1")
+		}
+		if boundary != nil && !problems.has("cell_size") {
+			if n := geo.CellCount(boundary.BBox(), req.CellSize); n > maxCoverageCells {
+				problems.add("cell_size", "is too small for this boundary: %d cells, at most %d", n, maxCoverageCells)
+			}
+		}
+		if err := problems.err(); err != nil {
+			writeFormError(w, err)
+			return
+		}
+
+		version, err := dataVersion(db)
+		if err != nil {
+			log.Printf("Error computing coverage gaps: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		h := sha256.New()
+		h.Write(req.Boundary)
+		fmt.Fprintf(h, "|%g|%d", req.CellSize, req.MinPoles)
+		key := hex.EncodeToString(h.Sum(nil))
+		if gaps, ok := cache.get(key, version); ok {
+			writeJSON(w, http.StatusOK, gaps)
+			return
+		}
+
+		gaps, err := coverageGaps(db, boundary, req.CellSize, req.MinPoles)
+		if err != nil {
+			log.Printf("Error computing coverage gaps: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		cache.put(key, version, gaps)
+		writeJSON(w, http.StatusOK, gaps)
+	}
+}
+
+// coverageGaps counts the distinct poles surveyed in each grid cell of
+// boundary. Submissions not yet attached to a pole count on their own.
+func coverageGaps(db *sql.DB, boundary *geo.Shape, cellSize float64, minPoles int) (*models.CoverageGaps, error) {
+	bbox := boundary.BBox()
+	grid := geo.NewGrid(bbox, cellSize)
+
+	conditions := `latitude BETWEEN $1 AND $2 AND longitude BETWEEN $3 AND $4`
+	if usePostGIS {
+		// The index keeps its boxes in single precision, so the exact
+		// conditions above still decide the edges.
+		conditions = `geog::geometry && ST_MakeEnvelope($3, $1, $4, $2, 4326) AND ` + conditions
+	}
+	rows, err := db.Query(`SELECT latitude, longitude, COALESCE(pole_id, -id) FROM userform WHERE `+conditions,
+		bbox.MinLat, bbox.MaxLat, bbox.MinLon, bbox.MaxLon)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query surveys: %w", err)
+	}
+	defer rows.Close()
+
+	poles := make(map[[2]int]map[int]bool)
+	for rows.Next() {
+		var p geo.Point
+		var poleKey int
+		if err := rows.Scan(&p.Lat, &p.Lon, &poleKey); err != nil {
+			return nil, fmt.Errorf("failed to scan survey: %w", err)
+		}
+		if !boundary.Contains(p) {
+			continue
+		}
+		row, col, ok := grid.Cell(p)
+		if !ok {
+			continue
+		}
+		cell := [2]int{row, col}
+		if poles[cell] == nil {
+			poles[cell] = make(map[int]bool)
+		}
+		poles[cell][poleKey] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over surveys: %w", err)
+	}
+
+	gaps := &models.CoverageGaps{
+		Type:       "FeatureCollection",
+		Features:   []models.GeoJSONFeature{},
+		CellSize:   cellSize,
+		MinPoles:   minPoles,
+		ComputedAt: time.Now(),
+	}
+	for row := 0; row < grid.Rows; row++ {
+		for col := 0; col < grid.Cols; col++ {
+			if !boundary.Contains(grid.Center(row, col)) {
+				continue
+			}
+			gaps.TotalCells++
+			count := len(poles[[2]int{row, col}])
+			if count >= minPoles {
+				continue
+			}
+			status := "under_surveyed"
+			if count == 0 {
+				status = "empty"
+				gaps.EmptyCells++
+			}
+			gaps.GapCells++
+			gaps.Features = append(gaps.Features, models.GeoJSONFeature{
+				Type:     "Feature",
+				Geometry: models.GeoJSONGeometry{Type: "Polygon", Coordinates: [][][]float64{grid.Bounds(row, col).Ring()}},
+				Properties: map[string]interface{}{
+					"row":    row,
+					"col":    col,
+					"poles":  count,
+					"status": status,
+				},
+			})
+		}
+	}
+	return gaps, nil
+}
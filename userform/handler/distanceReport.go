@@ -0,0 +1,276 @@
+package handler
+
+import (
+	"database/sql"
+	"fmt"
+	"github/rabinam24/userform/models"
+	"github/rabinam24/userform/track"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxDistanceReportDays bounds the range of one distance report.
+const maxDistanceReportDays = 3 * 366
+
+var distanceGranularities = []string{"day", "week", "month"}
+
+// fromStored reads a TIMESTAMP column, which holds the server's local wall
+// clock, as the instant it stands for.
+func fromStored(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.Local)
+}
+
+// toStored turns an instant into the wall clock TIMESTAMP columns hold.
+func toStored(t time.Time) time.Time {
+	return t.In(time.Local)
+}
+
+// userDailyDistances returns the distance each user covered per day, keyed
+// by username and then by the YYYY-MM-DD date in loc, for [from, to). A day
+// on which the user recorded trip breadcrumbs is measured along them, trip
+// by trip; any other day by chaining the user's own submissions in order.
+// Either way the fixes are measured raw and cleaned with opts. Submissions
+// with no known user are left out, as they cannot be chained.
+func userDailyDistances(db *sql.DB, from, to time.Time, loc *time.Location, username string, opts track.Options) (map[string]map[string]distance, error) {
+	type userDay struct {
+		username string
+		day      string
+	}
+	distances := make(map[string]map[string]distance)
+	add := func(key userDay, fixes []track.Fix) {
+		if distances[key.username] == nil {
+			distances[key.username] = make(map[string]distance)
+		}
+		d := distances[key.username][key.day]
+		d.add(measureTrack(fixes, opts))
+		distances[key.username][key.day] = d
+	}
+
+	args := []interface{}{toStored(from), toStored(to)}
+	userFilter := ""
+	if username != "" {
+		args = append(args, username)
+		userFilter = " AND s.username = $3"
+	}
+	rows, err := db.Query(`SELECT s.username, s.id, p.recorded_at, p.latitude, p.longitude, COALESCE(p.accuracy, 0)
+		FROM trip_points p JOIN trip_sessions s ON s.id = p.trip_id
+		WHERE p.recorded_at >= $1 AND p.recorded_at < $2`+userFilter+`
+		ORDER BY s.id, p.recorded_at, p.id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query trip points: %w", err)
+	}
+	defer rows.Close()
+
+	tracked := make(map[userDay]bool)
+	var prevKey userDay
+	var prevTrip int
+	var fixes []track.Fix
+	for rows.Next() {
+		var key userDay
+		var tripID int
+		var f track.Fix
+		if err := rows.Scan(&key.username, &tripID, &f.Time, &f.Lat, &f.Lon, &f.Accuracy); err != nil {
+			return nil, fmt.Errorf("failed to scan trip point: %w", err)
+		}
+		f.Time = fromStored(f.Time)
+		key.day = f.Time.In(loc).Format(dueDateLayout)
+		if len(fixes) > 0 && (tripID != prevTrip || key != prevKey) {
+			add(prevKey, fixes)
+			fixes = fixes[:0]
+		}
+		fixes = append(fixes, f)
+		tracked[key] = true
+		prevKey, prevTrip = key, tripID
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over trip points: %w", err)
+	}
+	if len(fixes) > 0 {
+		add(prevKey, fixes)
+	}
+
+	userFilter = ""
+	if username != "" {
+		userFilter = " AND COALESCE(uf.surveyor, u.username) = $3"
+	}
+	subRows, err := db.Query(`SELECT COALESCE(uf.surveyor, u.username), uf.created_at, uf.latitude, uf.longitude
+		FROM userform uf LEFT JOIN users u ON u.id = uf.user_id
+		WHERE uf.created_at >= $1 AND uf.created_at < $2 AND COALESCE(uf.surveyor, u.username) IS NOT NULL
+		AND uf.latitude IS NOT NULL AND uf.longitude IS NOT NULL`+userFilter+`
+		ORDER BY 1, uf.created_at, uf.id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query submissions: %w", err)
+	}
+	defer subRows.Close()
+
+	prevKey = userDay{}
+	fixes = fixes[:0]
+	for subRows.Next() {
+		var key userDay
+		var f track.Fix
+		if err := subRows.Scan(&key.username, &f.Time, &f.Lat, &f.Lon); err != nil {
+			return nil, fmt.Errorf("failed to scan submission: %w", err)
+		}
+		f.Time = fromStored(f.Time)
+		key.day = f.Time.In(loc).Format(dueDateLayout)
+		if tracked[key] {
+			continue
+		}
+		if len(fixes) > 0 && key != prevKey {
+			add(prevKey, fixes)
+			fixes = fixes[:0]
+		}
+		fixes = append(fixes, f)
+		prevKey = key
+	}
+	if err := subRows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over submissions: %w", err)
+	}
+	if len(fixes) > 0 {
+		add(prevKey, fixes)
+	}
+	return distances, nil
+}
+
+// periodStart returns the first day of the day, ISO week or month holding
+// day.
+func periodStart(day time.Time, granularity string) time.Time {
+	switch granularity {
+	case "week":
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case "month":
+		return time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, day.Location())
+	default:
+		return day
+	}
+}
+
+func roundKm(meters float64) float64 {
+	return math.Round(meters) / 1000
+}
+
+// HandleDistanceReport reports the distance each surveyor and the whole
+// team covered between ?from= and ?to= (YYYY-MM-DD, inclusive, default the
+// last 7 days), bucketed by ?granularity= day (default), week or month in
+// the ?tz= time zone (IANA name, default UTC). ?username= limits the report
+// to one surveyor. See userDailyDistances for how a day is measured; km
+// figures follow the track cleaned with opts, raw_km ones every fix.
+func HandleDistanceReport(db *sql.DB, opts track.Options) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		var problems fieldErrors
+
+		tz := query.Get("tz")
+		if tz == "" {
+			tz = "UTC"
+		}
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			problems.add("tz", "must be an IANA time zone like Asia/Kathmandu")
+			loc = time.UTC
+		}
+		granularity := query.Get("granularity")
+		if granularity == "" {
+			granularity = "day"
+		}
+		if !isOneOf(granularity, distanceGranularities) {
+			problems.add("granularity", "must be one of: %s", strings.Join(distanceGranularities, ", "))
+		}
+
+		now := time.Now().In(loc)
+		to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+		from := to.AddDate(0, 0, -6)
+		for _, bound := range []struct {
+			name string
+			dest *time.Time
+		}{{"from", &from}, {"to", &to}} {
+			if raw := query.Get(bound.name); raw != "" {
+				day, err := time.ParseInLocation(dueDateLayout, raw, loc)
+				if err != nil {
+					problems.add(bound.name, "must be a date like 2006-01-02")
+					continue
+				}
+				*bound.dest = day
+			}
+		}
+		if !problems.has("from") && !problems.has("to") {
+			if to.Before(from) {
+				problems.add("to", "must not be before from")
+			} else if to.Sub(from) > maxDistanceReportDays*24*time.Hour {
+				problems.add("from", "range must not exceed %d days", maxDistanceReportDays)
+			}
+		}
+		if err := problems.err(); err != nil {
+			writeFormError(w, err)
+			return
+		}
+
+		daily, err := userDailyDistances(db, from, to.AddDate(0, 0, 1), loc, query.Get("username"), opts)
+		if err != nil {
+			log.Printf("Error computing distance report: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		// Every bucket of the range is listed, empty or not.
+		var periods []string
+		index := make(map[string]int)
+		for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+			period := periodStart(day, granularity).Format(dueDateLayout)
+			if _, ok := index[period]; !ok {
+				index[period] = len(periods)
+				periods = append(periods, period)
+			}
+		}
+		bucketsOf := func(distances []distance) []models.DistanceBucket {
+			buckets := make([]models.DistanceBucket, len(periods))
+			for i, period := range periods {
+				buckets[i] = models.DistanceBucket{Period: period, Km: roundKm(distances[i].cleaned), RawKm: roundKm(distances[i].raw)}
+			}
+			return buckets
+		}
+
+		report := models.DistanceReport{
+			From:        from.Format(dueDateLayout),
+			To:          to.Format(dueDateLayout),
+			Granularity: granularity,
+			TimeZone:    loc.String(),
+			Users:       []models.UserDistance{},
+		}
+		team := make([]distance, len(periods))
+		var teamTotal distance
+		for username, days := range daily {
+			distances := make([]distance, len(periods))
+			var total distance
+			for dayStr, d := range days {
+				day, err := time.ParseInLocation(dueDateLayout, dayStr, loc)
+				if err != nil {
+					continue
+				}
+				i, ok := index[periodStart(day, granularity).Format(dueDateLayout)]
+				if !ok {
+					continue
+				}
+				distances[i].add(d)
+				team[i].add(d)
+				total.add(d)
+			}
+			teamTotal.add(total)
+			report.Users = append(report.Users, models.UserDistance{
+				Username:   username,
+				TotalKm:    roundKm(total.cleaned),
+				RawTotalKm: roundKm(total.raw),
+				Buckets:    bucketsOf(distances),
+			})
+		}
+		sort.Slice(report.Users, func(i, j int) bool { return report.Users[i].Username < report.Users[j].Username })
+		report.Team = bucketsOf(team)
+		report.TotalKm = roundKm(teamTotal.cleaned)
+		report.RawTotalKm = roundKm(teamTotal.raw)
+		writeJSON(w, http.StatusOK, report)
+	}
+}
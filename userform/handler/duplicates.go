@@ -0,0 +1,793 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github/rabinam24/userform/models"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/minio/minio-go/v7"
+)
+
+// surveyPoint is what the duplicate scan compares surveys on.
+type surveyPoint struct {
+	id, poleID int
+	lat, lon   float64
+	poleType   string
+	isps       map[string]bool
+}
+
+// StartDuplicateScanner runs ScanDuplicates every interval until ctx is
+// done. A zero interval leaves scanning to the admin endpoint.
+func StartDuplicateScanner(ctx context.Context, db *sql.DB, radius float64, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if result, err := ScanDuplicates(db, radius); err != nil {
+				log.Printf("Error scanning for duplicate surveys: %v", err)
+			} else {
+				log.Printf("Duplicate scan found %d groups among %d surveys", result.Groups, result.Surveys)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// ScanDuplicates rebuilds the pending duplicate groups. Two surveys are
+// candidates when they lie within radius metres of each other on different
+// poles and share the pole type or most of their ISPs; candidates are
+// chained into groups. Pairs an admin already dismissed are left apart.
+func ScanDuplicates(db *sql.DB, radius float64) (models.DuplicateScanResult, error) {
+	var result models.DuplicateScanResult
+	if radius <= 0 {
+		return result, fmt.Errorf("duplicate radius must be positive, got %v", radius)
+	}
+
+	points, err := loadSurveyPoints(db)
+	if err != nil {
+		return result, err
+	}
+	result.Surveys = len(points)
+
+	dismissed, err := dismissedPairs(db)
+	if err != nil {
+		return result, err
+	}
+
+	var pairs [][2]int
+	if usePostGIS {
+		pairs, err = nearbySurveyPairs(db, points, radius)
+		if err != nil {
+			return result, err
+		}
+	} else {
+		pairs = gridSurveyPairs(points, radius)
+	}
+
+	parent := make([]int, len(points))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	type candidate struct {
+		i     int
+		score float64
+	}
+	var candidates []candidate
+
+	for _, pair := range pairs {
+		i, j := pair[0], pair[1]
+		p, q := points[i], points[j]
+		if (p.poleID != 0 && p.poleID == q.poleID) || dismissed[[2]int{p.id, q.id}] {
+			continue
+		}
+		score, ok := duplicateScore(p, q, radius)
+		if !ok {
+			continue
+		}
+		candidates = append(candidates, candidate{i, score})
+		parent[find(i)] = find(j)
+	}
+
+	pairScores := make(map[int][]float64)
+	for _, c := range candidates {
+		root := find(c.i)
+		pairScores[root] = append(pairScores[root], c.score)
+	}
+	members := make(map[int][]int)
+	for i := range points {
+		root := find(i)
+		if len(pairScores[root]) > 0 {
+			members[root] = append(members[root], points[i].id)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return result, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM duplicate_groups WHERE status = 'pending'`); err != nil {
+		return result, fmt.Errorf("failed to clear pending duplicate groups: %w", err)
+	}
+	for root, ids := range members {
+		total := 0.0
+		for _, s := range pairScores[root] {
+			total += s
+		}
+		score := math.Round(total/float64(len(pairScores[root]))*1000) / 1000
+
+		var groupID int
+		if err := tx.QueryRow(`INSERT INTO duplicate_groups (score) VALUES ($1) RETURNING id`, score).Scan(&groupID); err != nil {
+			return result, fmt.Errorf("failed to store duplicate group: %w", err)
+		}
+		_, err := tx.Exec(`INSERT INTO duplicate_group_members (group_id, userform_id) SELECT $1, unnest($2::int[])`, groupID, pq.Array(ids))
+		if err != nil {
+			return result, fmt.Errorf("failed to store duplicate group members: %w", err)
+		}
+		result.Groups++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return result, fmt.Errorf("failed to commit duplicate groups: %w", err)
+	}
+	return result, nil
+}
+
+// gridSurveyPairs lists, as indexes into points, the pairs of surveys that
+// may lie within radius metres of each other, the one with the lower ID
+// first. Surveys are bucketed into cells one radius high so only
+// neighbouring cells need comparing; duplicateScore checks the distance.
+func gridSurveyPairs(points []surveyPoint, radius float64) [][2]int {
+	cellSize := radius / metersPerDegree
+	cells := make(map[[2]int][]int)
+	for i, p := range points {
+		key := [2]int{int(math.Floor(p.lat / cellSize)), int(math.Floor(p.lon / cellSize))}
+		cells[key] = append(cells[key], i)
+	}
+
+	var pairs [][2]int
+	for i, p := range points {
+		row := int(math.Floor(p.lat / cellSize))
+		col := int(math.Floor(p.lon / cellSize))
+		// A degree of longitude shrinks away from the equator, so the radius
+		// spans more columns than rows.
+		span := int(math.Ceil(1 / math.Max(math.Cos(p.lat*math.Pi/180), 0.01)))
+		for dr := -1; dr <= 1; dr++ {
+			for dc := -span; dc <= span; dc++ {
+				for _, j := range cells[[2]int{row + dr, col + dc}] {
+					if points[j].id > p.id {
+						pairs = append(pairs, [2]int{i, j})
+					}
+				}
+			}
+		}
+	}
+	return pairs
+}
+
+// nearbySurveyPairs is gridSurveyPairs answered by the GiST index on
+// userform.geog. Surveys stored since points were loaded are left for the
+// next scan.
+func nearbySurveyPairs(db *sql.DB, points []surveyPoint, radius float64) ([][2]int, error) {
+	index := make(map[int]int, len(points))
+	for i, p := range points {
+		index[p.id] = i
+	}
+
+	rows, err := db.Query(`SELECT a.id, b.id FROM userform a JOIN userform b
+		ON a.id < b.id AND ST_DWithin(a.geog, b.geog, $1, false)`, radius)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query nearby surveys: %w", err)
+	}
+	defer rows.Close()
+
+	var pairs [][2]int
+	for rows.Next() {
+		var a, b int
+		if err := rows.Scan(&a, &b); err != nil {
+			return nil, fmt.Errorf("failed to scan nearby surveys: %w", err)
+		}
+		i, okA := index[a]
+		j, okB := index[b]
+		if okA && okB {
+			pairs = append(pairs, [2]int{i, j})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over nearby surveys: %w", err)
+	}
+	return pairs, nil
+}
+
+// duplicateScore rates how likely two surveys describe the same pole, from
+// 0 to 1, and reports whether they are candidates at all.
+func duplicateScore(p, q surveyPoint, radius float64) (float64, bool) {
+	distance := CalculateDistance(p.lat, p.lon, q.lat, q.lon) * 1000
+	if distance > radius {
+		return 0, false
+	}
+	sameType := p.poleType != "" && strings.EqualFold(p.poleType, q.poleType)
+
+	// Surveys without ISPs say nothing either way.
+	ispSimilarity := 0.5
+	if len(p.isps) > 0 || len(q.isps) > 0 {
+		shared := 0
+		for isp := range p.isps {
+			if q.isps[isp] {
+				shared++
+			}
+		}
+		ispSimilarity = float64(shared) / float64(len(p.isps)+len(q.isps)-shared)
+	}
+	if !sameType && ispSimilarity < 0.5 {
+		return 0, false
+	}
+
+	score := 0.5 * (1 - distance/radius)
+	if sameType {
+		score += 0.25
+	}
+	score += 0.25 * ispSimilarity
+	return score, true
+}
+
+// loadSurveyPoints reads the location, type and ISPs of every survey.
+func loadSurveyPoints(db *sql.DB) ([]surveyPoint, error) {
+	rows, err := db.Query(`SELECT id, latitude, longitude, COALESCE(selectpole, ''), COALESCE(pole_id, 0) FROM userform
+		WHERE latitude IS NOT NULL AND longitude IS NOT NULL ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query surveys: %w", err)
+	}
+	defer rows.Close()
+
+	var points []surveyPoint
+	index := make(map[int]int)
+	for rows.Next() {
+		p := surveyPoint{isps: make(map[string]bool)}
+		if err := rows.Scan(&p.id, &p.lat, &p.lon, &p.poleType, &p.poleID); err != nil {
+			return nil, fmt.Errorf("failed to scan survey: %w", err)
+		}
+		index[p.id] = len(points)
+		points = append(points, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over surveys: %w", err)
+	}
+
+	ispRows, err := db.Query(`SELECT userform_id, COALESCE(isp_code, provider) FROM userform_isps`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query ISPs: %w", err)
+	}
+	defer ispRows.Close()
+	for ispRows.Next() {
+		var id int
+		var isp string
+		if err := ispRows.Scan(&id, &isp); err != nil {
+			return nil, fmt.Errorf("failed to scan ISP: %w", err)
+		}
+		if i, ok := index[id]; ok {
+			points[i].isps[strings.ToLower(isp)] = true
+		}
+	}
+	if err := ispRows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over ISPs: %w", err)
+	}
+	return points, nil
+}
+
+// dismissedPairs returns the survey pairs, lower ID first, that share a
+// dismissed group.
+func dismissedPairs(db *sql.DB) (map[[2]int]bool, error) {
+	rows, err := db.Query(`
+	SELECT a.userform_id, b.userform_id
+	FROM duplicate_group_members a
+	JOIN duplicate_group_members b ON b.group_id = a.group_id AND a.userform_id < b.userform_id
+	JOIN duplicate_groups g ON g.id = a.group_id
+	WHERE g.status = 'dismissed'`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query dismissed duplicates: %w", err)
+	}
+	defer rows.Close()
+
+	pairs := make(map[[2]int]bool)
+	for rows.Next() {
+		var a, b int
+		if err := rows.Scan(&a, &b); err != nil {
+			return nil, fmt.Errorf("failed to scan dismissed duplicate: %w", err)
+		}
+		pairs[[2]int{a, b}] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over dismissed duplicates: %w", err)
+	}
+	return pairs, nil
+}
+
+// loadDuplicateGroups returns the groups selected by clauses (on
+// duplicate_groups g) with their surveys that still exist. Pending groups
+// with fewer than two surveys left are skipped.
+func loadDuplicateGroups(db querier, clauses string, args ...interface{}) ([]models.DuplicateGroup, error) {
+	rows, err := db.Query(`SELECT g.id, g.status, g.score, g.created_at, g.resolved_at,
+		ARRAY(SELECT m.userform_id FROM duplicate_group_members m WHERE m.group_id = g.id ORDER BY m.userform_id)
+		FROM duplicate_groups g `+clauses, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query duplicate groups: %w", err)
+	}
+	defer rows.Close()
+
+	var groups []models.DuplicateGroup
+	var memberIDs [][]int64
+	var allIDs []int64
+	for rows.Next() {
+		var group models.DuplicateGroup
+		var resolvedAt sql.NullTime
+		var ids pq.Int64Array
+		if err := rows.Scan(&group.ID, &group.Status, &group.Score, &group.CreatedAt, &resolvedAt, &ids); err != nil {
+			return nil, fmt.Errorf("failed to scan duplicate group: %w", err)
+		}
+		if resolvedAt.Valid {
+			group.ResolvedAt = &resolvedAt.Time
+		}
+		groups = append(groups, group)
+		memberIDs = append(memberIDs, ids)
+		allIDs = append(allIDs, ids...)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over duplicate groups: %w", err)
+	}
+
+	surveys := make(map[int]models.FormData)
+	if len(allIDs) > 0 {
+		data, err := queryFormData(db, "WHERE uf.id = ANY($1)", pq.Array(allIDs))
+		if err != nil {
+			return nil, err
+		}
+		for _, formData := range data {
+			surveys[formData.ID] = formData
+		}
+	}
+
+	result := []models.DuplicateGroup{}
+	for i, group := range groups {
+		group.Members = []models.FormData{}
+		for _, id := range memberIDs[i] {
+			if formData, ok := surveys[int(id)]; ok {
+				group.Members = append(group.Members, formData)
+			}
+		}
+		if group.Status == "pending" && len(group.Members) < 2 {
+			continue
+		}
+		result = append(result, group)
+	}
+	return result, nil
+}
+
+// mergeSurveys merges the poles of a duplicate group into the primary's
+// pole: every inspection of the other members' poles moves to it, along
+// with their work orders. The members in duplicates, which a reviewer found
+// to be the primary submitted again, are folded into it: their photos and
+// the ISPs it lacks move over, and they are deleted. The other members are
+// kept as inspections of the merged pole. It returns the objects no survey
+// uses any more.
+func mergeSurveys(tx *sql.Tx, primary models.FormData, others []models.FormData, duplicates map[int]bool) ([]string, error) {
+	var folded []models.FormData
+	for _, other := range others {
+		if duplicates[other.ID] {
+			folded = append(folded, other)
+		}
+	}
+
+	var released []string
+	for _, survey := range append([]models.FormData{primary}, folded...) {
+		sums, err := releaseImageReferences(tx, survey.ID, "")
+		if err != nil {
+			return nil, err
+		}
+		released = append(released, sums...)
+	}
+
+	combined := primary
+	seen := map[string]bool{primary.PoleImage: true}
+	for _, imageURL := range primary.MultipleImages {
+		seen[imageURL] = true
+	}
+	haveISP := make(map[string]bool)
+	for _, isp := range primary.ISPs {
+		haveISP[strings.ToLower(isp.Provider)] = true
+	}
+
+	var foldedIDs []int64
+	for _, other := range folded {
+		foldedIDs = append(foldedIDs, int64(other.ID))
+		for _, imageURL := range append([]string{other.PoleImage}, other.MultipleImages...) {
+			if imageURL == "" || seen[imageURL] {
+				continue
+			}
+			seen[imageURL] = true
+			if combined.PoleImage == "" {
+				combined.PoleImage = imageURL
+			} else {
+				combined.MultipleImages = append(combined.MultipleImages, imageURL)
+			}
+		}
+		for _, isp := range other.ISPs {
+			if haveISP[strings.ToLower(isp.Provider)] {
+				continue
+			}
+			haveISP[strings.ToLower(isp.Provider)] = true
+			if _, err := tx.Exec(`UPDATE userform_isps SET userform_id = $1 WHERE id = $2`, primary.ID, isp.ID); err != nil {
+				return nil, fmt.Errorf("failed to move ISP %d: %w", isp.ID, err)
+			}
+			combined.ISPs = append(combined.ISPs, isp)
+		}
+	}
+
+	if len(combined.ISPs) > 0 {
+		combined.SelectISP = combined.ISPs[0].Provider
+	}
+	multipleImagesJSON, err := json.Marshal(combined.MultipleImages)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal image URLs to JSON: %w", err)
+	}
+	_, err = tx.Exec(`UPDATE userform SET poleimage = $2, multipleimages = $3, selectisp = $4 WHERE id = $1`,
+		primary.ID, sql.NullString{String: combined.PoleImage, Valid: combined.PoleImage != ""}, string(multipleImagesJSON), combined.SelectISP)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update survey %d: %w", primary.ID, err)
+	}
+
+	var otherPoles, moved []int
+	for _, other := range others {
+		if primary.PoleID == 0 || other.PoleID == 0 || other.PoleID == primary.PoleID || slices.Contains(otherPoles, other.PoleID) {
+			continue
+		}
+		ids, err := movePoleInspections(tx, other.PoleID, primary.PoleID)
+		if err != nil {
+			return nil, err
+		}
+		moved = append(moved, ids...)
+		// An automatic ticket already open on the primary pole wins.
+		_, err = tx.Exec(`UPDATE work_orders SET pole_id = $1 WHERE pole_id = $2
+			AND NOT (source = 'auto' AND status NOT IN ('resolved', 'verified')
+				AND EXISTS (SELECT 1 FROM work_orders o WHERE o.pole_id = $1 AND o.source = 'auto' AND o.status NOT IN ('resolved', 'verified')))`,
+			primary.PoleID, other.PoleID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to move work orders of pole %d: %w", other.PoleID, err)
+		}
+		otherPoles = append(otherPoles, other.PoleID)
+	}
+
+	if len(foldedIDs) > 0 {
+		if _, err := tx.Exec(`DELETE FROM userform WHERE id = ANY($1)`, pq.Array(foldedIDs)); err != nil {
+			return nil, fmt.Errorf("failed to delete duplicate surveys: %w", err)
+		}
+	}
+	for _, poleID := range otherPoles {
+		if err := dropEmptyPole(tx, poleID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := addImageReferences(tx, primary.ID, formImageRefs(combined)); err != nil {
+		return nil, err
+	}
+	unused, err := dropUnusedImages(tx, released)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := recordChange(tx, primary.ID, "upsert"); err != nil {
+		return nil, err
+	}
+	for _, id := range moved {
+		if id == primary.ID || duplicates[id] {
+			continue
+		}
+		if err := recordChange(tx, id, "upsert"); err != nil {
+			return nil, err
+		}
+	}
+	for _, other := range folded {
+		if err := recordChange(tx, other.ID, "delete"); err != nil {
+			return nil, err
+		}
+	}
+	return unused, nil
+}
+
+// movePoleInspections re-points every inspection of pole from to pole to
+// and returns their IDs.
+func movePoleInspections(tx *sql.Tx, from, to int) ([]int, error) {
+	rows, err := tx.Query(`UPDATE userform SET pole_id = $1 WHERE pole_id = $2 RETURNING id`, to, from)
+	if err != nil {
+		return nil, fmt.Errorf("failed to move inspections of pole %d: %w", from, err)
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan moved inspection: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error moving inspections of pole %d: %w", from, err)
+	}
+	return ids, nil
+}
+
+// HandleScanDuplicates rebuilds the pending duplicate groups on demand.
+func HandleScanDuplicates(db *sql.DB, radius float64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result, err := ScanDuplicates(db, radius)
+		if err != nil {
+			log.Printf("Error scanning for duplicate surveys: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+// HandleListDuplicateGroups lists duplicate groups with ?status= (pending by
+// default), most likely duplicates first.
+func HandleListDuplicateGroups(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := r.URL.Query().Get("status")
+		if status == "" {
+			status = "pending"
+		}
+		groups, err := loadDuplicateGroups(db, "WHERE g.status = $1 ORDER BY g.score DESC, g.id", status)
+		if err != nil {
+			log.Printf("Error listing duplicate groups: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, groups)
+	}
+}
+
+// HandleDuplicateGroup serves one duplicate group for review.
+func HandleDuplicateGroup(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		groups, err := loadDuplicateGroups(db, "WHERE g.id = $1", id)
+		if err != nil {
+			log.Printf("Error loading duplicate group %d: %v", id, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if len(groups) == 0 {
+			http.Error(w, "Duplicate group not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, groups[0])
+	}
+}
+
+// HandleDismissDuplicateGroup marks a group as not being duplicates, so
+// later scans keep its surveys apart.
+func HandleDismissDuplicateGroup(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		res, err := db.Exec(`UPDATE duplicate_groups SET status = 'dismissed', resolved_at = CURRENT_TIMESTAMP WHERE id = $1 AND status = 'pending'`, id)
+		if err != nil {
+			log.Printf("Error dismissing duplicate group %d: %v", id, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "No pending duplicate group with this ID", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandleMergeDuplicateGroup merges the poles of a pending group into the
+// chosen primary survey's pole, deletes the members marked as duplicate
+// submissions (see mergeSurveys), and records the merge in the audit trail.
+func HandleMergeDuplicateGroup(db *sql.DB, minioClient *minio.Client, bucketName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		var req models.MergeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Error beginning transaction: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		var status string
+		err = tx.QueryRow(`SELECT status FROM duplicate_groups WHERE id = $1 FOR UPDATE`, id).Scan(&status)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Duplicate group not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error locking duplicate group %d: %v", id, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if status != "pending" {
+			http.Error(w, "Duplicate group is already "+status, http.StatusConflict)
+			return
+		}
+		// Hold the surveys until the merge commits.
+		if _, err := tx.Exec(`SELECT id FROM userform WHERE id IN (SELECT userform_id FROM duplicate_group_members WHERE group_id = $1) FOR UPDATE`, id); err != nil {
+			log.Printf("Error locking surveys of group %d: %v", id, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		groups, err := loadDuplicateGroups(tx, "WHERE g.id = $1 FOR UPDATE", id)
+		if err != nil {
+			log.Printf("Error loading duplicate group %d: %v", id, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if len(groups) == 0 {
+			http.Error(w, "Fewer than two surveys of this group are left", http.StatusConflict)
+			return
+		}
+		members := groups[0].Members
+
+		var primary models.FormData
+		var others []models.FormData
+		for _, member := range members {
+			if member.ID == req.PrimaryID {
+				primary = member
+			} else {
+				others = append(others, member)
+			}
+		}
+		if primary.ID == 0 {
+			http.Error(w, "primary_id must be one of the group's surveys", http.StatusBadRequest)
+			return
+		}
+
+		// Only members the reviewer marked are deleted, and never another
+		// inspection of the primary's own pole.
+		duplicates := make(map[int]bool)
+		mergedIDs := []int64{}
+		for _, duplicateID := range req.DuplicateIDs {
+			i := slices.IndexFunc(others, func(other models.FormData) bool { return other.ID == duplicateID })
+			switch {
+			case i < 0:
+				http.Error(w, fmt.Sprintf("duplicate_ids: survey %d is not another survey of the group", duplicateID), http.StatusBadRequest)
+				return
+			case primary.PoleID != 0 && others[i].PoleID == primary.PoleID:
+				http.Error(w, fmt.Sprintf("duplicate_ids: survey %d is an inspection of the primary's pole and is kept", duplicateID), http.StatusBadRequest)
+				return
+			case !duplicates[duplicateID]:
+				duplicates[duplicateID] = true
+				mergedIDs = append(mergedIDs, int64(duplicateID))
+			}
+		}
+
+		unused, err := mergeSurveys(tx, primary, others, duplicates)
+		if err != nil {
+			log.Printf("Error merging duplicate group %d: %v", id, err)
+			http.Error(w, "Failed to merge surveys", http.StatusInternalServerError)
+			return
+		}
+
+		snapshot, err := json.Marshal(members)
+		if err != nil {
+			log.Printf("Error encoding merge snapshot: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		var record models.MergeRecord
+		err = tx.QueryRow(`INSERT INTO merge_log (group_id, primary_id, merged_ids, merged_by, snapshot) VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at`,
+			id, primary.ID, pq.Array(mergedIDs), req.MergedBy, snapshot).Scan(&record.ID, &record.CreatedAt)
+		if err != nil {
+			log.Printf("Error recording merge of group %d: %v", id, err)
+			http.Error(w, "Failed to merge surveys", http.StatusInternalServerError)
+			return
+		}
+		if _, err := tx.Exec(`UPDATE duplicate_groups SET status = 'merged', resolved_at = CURRENT_TIMESTAMP WHERE id = $1`, id); err != nil {
+			log.Printf("Error closing duplicate group %d: %v", id, err)
+			http.Error(w, "Failed to merge surveys", http.StatusInternalServerError)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			log.Printf("Error committing merge of group %d: %v", id, err)
+			http.Error(w, "Failed to merge surveys", http.StatusInternalServerError)
+			return
+		}
+		RemoveObjects(minioClient, bucketName, unused)
+
+		record.GroupID = id
+		record.PrimaryID = primary.ID
+		record.MergedBy = req.MergedBy
+		record.Snapshot = snapshot
+		record.MergedIDs = []int{}
+		for _, mergedID := range mergedIDs {
+			record.MergedIDs = append(record.MergedIDs, int(mergedID))
+		}
+		writeJSON(w, http.StatusOK, record)
+	}
+}
+
+// HandleListMerges serves the merge audit trail, newest first.
+func HandleListMerges(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query(`SELECT id, COALESCE(group_id, 0), primary_id, merged_ids, merged_by, snapshot, created_at FROM merge_log ORDER BY id DESC`)
+		if err != nil {
+			log.Printf("Error querying merge log: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		records := []models.MergeRecord{}
+		for rows.Next() {
+			var record models.MergeRecord
+			var mergedIDs pq.Int64Array
+			var snapshot []byte
+			if err := rows.Scan(&record.ID, &record.GroupID, &record.PrimaryID, &mergedIDs, &record.MergedBy, &snapshot, &record.CreatedAt); err != nil {
+				log.Printf("Error scanning merge log: %v", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			for _, mergedID := range mergedIDs {
+				record.MergedIDs = append(record.MergedIDs, int(mergedID))
+			}
+			record.Snapshot = snapshot
+			records = append(records, record)
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("Error iterating over merge log: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, records)
+	}
+}
@@ -3,69 +3,172 @@ package handler
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"github/rabinam24/userform/models"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
 )
 
-func HandleUserData(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		log.Println("Fetching user data...")
+// formDataColumns selects everything models.FormData holds from userform,
+// aliased as uf.
+const formDataColumns = `uf.id, uf.location, uf.latitude, uf.longitude, uf.selectpole, uf.selectpolestatus,
+               uf.selectpolelocation, uf.description, uf.poleimage, uf.availableisp, uf.selectisp,
+               uf.multipleimages, uf.client_id, uf.pole_id, uf.surveyor, uf.assignment_id,
+               uf.outside_assignment, uf.province, uf.district, uf.municipality, uf.ward, uf.created_at`
+
+// querier reads from the database, or from within a transaction.
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
 
-		rows, err := db.Query("SELECT id, location, latitude, longitude, selectpole, selectpolestatus, selectpolelocation, description, poleimage, availableisp, selectisp, multipleimages, created_at FROM userform")
+// queryFormData runs "SELECT formDataColumns FROM userform uf <clauses>" and
+// scans the result.
+func queryFormData(db querier, clauses string, args ...interface{}) ([]models.FormData, error) {
+	rows, err := db.Query("SELECT "+formDataColumns+" FROM userform uf "+clauses, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query form data: %w", err)
+	}
+	defer rows.Close()
+
+	var data []models.FormData
+	for rows.Next() {
+		var formData models.FormData
+		var poleImageJSON, multipleImagesJSON, clientID, surveyor sql.NullString
+		var province, district, municipality, ward sql.NullString
+		var poleID, assignmentID sql.NullInt64
+
+		err := rows.Scan(
+			&formData.ID,
+			&formData.Location,
+			&formData.Latitude,
+			&formData.Longitude,
+			&formData.SelectPole,
+			&formData.SelectPoleStatus,
+			&formData.SelectPoleLocation,
+			&formData.Description,
+			&poleImageJSON,
+			&formData.AvailableISP,
+			&formData.SelectISP,
+			&multipleImagesJSON,
+			&clientID,
+			&poleID,
+			&surveyor,
+			&assignmentID,
+			&formData.OutsideAssignment,
+			&province,
+			&district,
+			&municipality,
+			&ward,
+			&formData.CreatedAt,
+		)
 		if err != nil {
-			log.Printf("Error querying database: %v", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
+			return nil, fmt.Errorf("failed to scan form data: %w", err)
 		}
-		defer rows.Close()
-
-		var data []models.FormData
-		for rows.Next() {
-			var formData models.FormData
-			var poleImageJSON, multipleImagesJSON sql.NullString
-
-			err := rows.Scan(
-				&formData.ID,
-				&formData.Location,
-				&formData.Latitude,
-				&formData.Longitude,
-				&formData.SelectPole,
-				&formData.SelectPoleStatus,
-				&formData.SelectPoleLocation,
-				&formData.Description,
-				&poleImageJSON,
-				&formData.AvailableISP,
-				&formData.SelectISP,
-				&multipleImagesJSON,
-				&formData.CreatedAt,
-			)
-			if err != nil {
-				log.Printf("Error scanning row: %v", err)
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-				return
-			}
 
-			// Handle NULL values for poleImage
-			if poleImageJSON.Valid {
-				formData.PoleImage = poleImageJSON.String
-			}
+		// Handle NULL values for poleImage
+		if poleImageJSON.Valid {
+			formData.PoleImage = poleImageJSON.String
+		}
 
-			// Handle NULL values for multipleImages
-			if multipleImagesJSON.Valid && multipleImagesJSON.String != "" {
-				if err := json.Unmarshal([]byte(multipleImagesJSON.String), &formData.MultipleImages); err != nil {
-					log.Printf("Error unmarshalling JSON: %v", err)
-					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-					return
-				}
+		// Handle NULL values for multipleImages
+		if multipleImagesJSON.Valid && multipleImagesJSON.String != "" {
+			if err := json.Unmarshal([]byte(multipleImagesJSON.String), &formData.MultipleImages); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal image URLs: %w", err)
 			}
+		}
+
+		formData.ClientID = clientID.String
+		formData.PoleID = int(poleID.Int64)
+		formData.Surveyor = surveyor.String
+		formData.AssignmentID = int(assignmentID.Int64)
+		formData.Province = province.String
+		formData.District = district.String
+		formData.Municipality = municipality.String
+		formData.Ward = ward.String
+		data = append(data, formData)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over form data: %w", err)
+	}
+
+	if len(data) == 0 {
+		return data, nil
+	}
+	ids := make([]int64, len(data))
+	for i := range data {
+		ids[i] = int64(data[i].ID)
+	}
+	isps, err := loadISPs(db, ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range data {
+		data[i].ISPs = isps[data[i].ID]
+		if data[i].ISPs == nil {
+			data[i].ISPs = []models.ISPAttachment{}
+		}
+	}
+
+	return data, nil
+}
 
-			data = append(data, formData)
+// formDataFilters turns the list filters into a WHERE clause on the
+// userform alias uf: from and to (YYYY-MM-DD, both inclusive), username,
+// and province, district, municipality and ward.
+func formDataFilters(query url.Values, problems *fieldErrors) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	for _, name := range []string{"from", "to"} {
+		raw := query.Get(name)
+		if raw == "" {
+			continue
 		}
+		if _, err := time.Parse(dueDateLayout, raw); err != nil {
+			problems.add(name, "must be a date like 2006-01-02")
+			continue
+		}
+		args = append(args, raw)
+		if name == "from" {
+			conditions = append(conditions, fmt.Sprintf("uf.created_at >= $%d::date", len(args)))
+		} else {
+			conditions = append(conditions, fmt.Sprintf("uf.created_at < $%d::date + 1", len(args)))
+		}
+	}
+	if username := query.Get("username"); username != "" {
+		args = append(args, username)
+		conditions = append(conditions, fmt.Sprintf("(uf.surveyor = $%[1]d OR uf.user_id IN (SELECT id FROM users WHERE username = $%[1]d))", len(args)))
+	}
+	areaConditions, args := adminAreaConditions(query, args)
+	conditions = append(conditions, areaConditions...)
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return "WHERE " + strings.Join(conditions, " AND "), args
+}
 
-		if err := rows.Err(); err != nil {
-			log.Printf("Row iteration error: %v", err)
+// HandleUserData lists every submission, optionally filtered as described
+// at formDataFilters.
+func HandleUserData(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("Fetching user data...")
+
+		var problems fieldErrors
+		clauses, args := formDataFilters(r.URL.Query(), &problems)
+		if err := problems.err(); err != nil {
+			writeFormError(w, err)
+			return
+		}
+		data, err := queryFormData(db, clauses, args...)
+		if err != nil {
+			log.Printf("Error querying database: %v", err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
@@ -79,6 +182,8 @@ func HandleUserData(db *sql.DB) http.HandlerFunc {
 	}
 }
 
+// HandleUserDataParticular lists the submissions of ?username=, optionally
+// filtered further as described at formDataFilters.
 func HandleUserDataParticular(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		username := r.URL.Query().Get("username")
@@ -89,71 +194,18 @@ func HandleUserDataParticular(db *sql.DB) http.HandlerFunc {
 
 		log.Printf("Fetching the user details for the particular user: %s", username)
 
-		query := `
-        SELECT uf.id, uf.location, uf.latitude, uf.longitude, uf.selectpole, uf.selectpolestatus, 
-               uf.selectpolelocation, uf.description, uf.poleimage, uf.availableisp, uf.selectisp, 
-               uf.multipleimages, uf.created_at 
-        FROM userform uf
-        JOIN users u ON uf.user_id = u.id
-        WHERE u.username = $1
-        `
-
-		rows, err := db.Query(query, username)
+		var problems fieldErrors
+		clauses, args := formDataFilters(r.URL.Query(), &problems)
+		if err := problems.err(); err != nil {
+			writeFormError(w, err)
+			return
+		}
+		data, err := queryFormData(db, clauses, args...)
 		if err != nil {
 			log.Printf("Error querying the database for particular users: %v", err)
 			http.Error(w, "Error querying the database", http.StatusInternalServerError)
 			return
 		}
-		defer rows.Close()
-
-		var data []models.FormData
-		for rows.Next() {
-			var formData models.FormData
-			var poleImageJSON, multipleImagesJSON sql.NullString
-
-			err := rows.Scan(
-				&formData.ID,
-				&formData.Location,
-				&formData.Latitude,
-				&formData.Longitude,
-				&formData.SelectPole,
-				&formData.SelectPoleStatus,
-				&formData.SelectPoleLocation,
-				&formData.Description,
-				&poleImageJSON,
-				&formData.AvailableISP,
-				&formData.SelectISP,
-				&multipleImagesJSON,
-				&formData.CreatedAt,
-			)
-			if err != nil {
-				log.Printf("Error scanning row: %v", err)
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-				return
-			}
-
-			// Handle NULL values for poleImage
-			if poleImageJSON.Valid {
-				formData.PoleImage = poleImageJSON.String
-			}
-
-			// Handle NULL values for multipleImages
-			if multipleImagesJSON.Valid && multipleImagesJSON.String != "" {
-				if err := json.Unmarshal([]byte(multipleImagesJSON.String), &formData.MultipleImages); err != nil {
-					log.Printf("Error unmarshalling JSON: %v", err)
-					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-					return
-				}
-			}
-
-			data = append(data, formData)
-		}
-
-		if err := rows.Err(); err != nil {
-			log.Printf("Row iteration error: %v", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
-		}
 
 		w.Header().Set("Content-Type", "application/json")
 		if err := json.NewEncoder(w).Encode(data); err != nil {
@@ -168,7 +220,8 @@ func IsInvalidFloat(value float64) bool {
 	return value != value
 }
 
-func HandleDeleteData(db *sql.DB) http.HandlerFunc {
+// HandleDeleteData deletes a submission together with the images it refers to.
+func HandleDeleteData(db *sql.DB, minioClient *minio.Client, bucketName string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		idStr := r.URL.Path[len("/api/data/"):]
 		id, err := strconv.Atoi(idStr)
@@ -177,14 +230,76 @@ func HandleDeleteData(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		query := "DELETE FROM userform WHERE id = $1"
-		_, err = db.Exec(query, id)
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Error beginning transaction: %v", err)
+			http.Error(w, "Failed to delete data", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		released, err := releaseImageReferences(tx, id, "")
+		if err != nil {
+			log.Printf("Error releasing images of %d: %v", id, err)
+			http.Error(w, "Failed to delete data", http.StatusInternalServerError)
+			return
+		}
+		unused, err := dropUnusedImages(tx, released)
+		if err != nil {
+			log.Printf("Error dropping images of %d: %v", id, err)
+			http.Error(w, "Failed to delete data", http.StatusInternalServerError)
+			return
+		}
+
+		query := "DELETE FROM userform WHERE id = $1 RETURNING poleimage, multipleimages, pole_id"
+		var poleImage, multipleImagesJSON sql.NullString
+		var poleID sql.NullInt64
+		err = tx.QueryRow(query, id).Scan(&poleImage, &multipleImagesJSON, &poleID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Data not found", http.StatusNotFound)
+			return
+		}
 		if err != nil {
 			log.Printf("Error deleting data: %v", err)
 			http.Error(w, "Failed to delete data", http.StatusInternalServerError)
 			return
 		}
 
+		if poleID.Valid {
+			if err := dropEmptyPole(tx, int(poleID.Int64)); err != nil {
+				log.Printf("Error dropping pole of %d: %v", id, err)
+				http.Error(w, "Failed to delete data", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if err := recordChange(tx, id, "delete"); err != nil {
+			log.Printf("Error recording delete of %d: %v", id, err)
+			http.Error(w, "Failed to delete data", http.StatusInternalServerError)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			log.Printf("Error committing delete: %v", err)
+			http.Error(w, "Failed to delete data", http.StatusInternalServerError)
+			return
+		}
+		refreshPoleIndex(db, id, int(poleID.Int64))
+
+		// Images from before deduplication belong to this row alone. The row
+		// is gone, so any object left behind here is picked up by the orphan
+		// reconciler later.
+		names, err := imageObjectNames(bucketName, poleImage, multipleImagesJSON)
+		if err != nil {
+			log.Printf("Error reading image references of %d: %v", id, err)
+		}
+		for _, name := range names {
+			if !strings.HasPrefix(name, contentPrefix) {
+				unused = append(unused, name)
+			}
+		}
+		RemoveObjects(minioClient, bucketName, unused)
+
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("Data deleted successfully"))
 	}
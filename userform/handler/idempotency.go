@@ -0,0 +1,190 @@
+package handler
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// staleClaimAfter is how long an in-flight claim is honoured before another
+// attempt may take it over, covering a server that died mid-request.
+const staleClaimAfter = 10 * time.Minute
+
+// WithIdempotency makes next safe to retry. A request carrying an
+// Idempotency-Key header is executed at most once per key within window;
+// retries get the stored response replayed. A retry that arrives while the
+// first attempt is still running waits up to wait for it to finish.
+// Only successful responses are stored, with the headers next set; after
+// an error, such as a validation failure or a pole proposal, the key is
+// given back so that a corrected retry runs for real.
+func WithIdempotency(db *sql.DB, window, wait time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > 255 {
+			http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+			return
+		}
+
+		claimed, err := claimIdempotencyKey(db, key, r.URL.Path, window)
+		if err != nil {
+			log.Printf("Error claiming idempotency key: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		if claimed {
+			rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+			completed := false
+			defer func() {
+				if !completed {
+					db.Exec(`DELETE FROM idempotency_keys WHERE key = $1`, key)
+				}
+			}()
+
+			before := w.Header().Clone()
+			next(rec, r)
+
+			if rec.status < 200 || rec.status >= 300 {
+				return
+			}
+			sent := rec.header
+			if sent == nil {
+				sent = w.Header()
+			}
+			headers, err := json.Marshal(addedHeaders(before, sent))
+			if err != nil {
+				log.Printf("Error encoding idempotent response headers for %s: %v", key, err)
+				return
+			}
+			query := `UPDATE idempotency_keys SET state = 'done', response_status = $1, content_type = $2, response_body = $3,
+				response_headers = $4, updated_at = $5 WHERE key = $6`
+			if _, err := db.Exec(query, rec.status, sent.Get("Content-Type"), rec.body.Bytes(), string(headers), time.Now(), key); err != nil {
+				log.Printf("Error storing idempotent response for %s: %v", key, err)
+				return
+			}
+			completed = true
+			return
+		}
+
+		deadline := time.Now().Add(wait)
+		for {
+			var path, state string
+			var status sql.NullInt64
+			var contentType sql.NullString
+			var body, headers []byte
+			query := `SELECT path, state, response_status, content_type, response_body, response_headers FROM idempotency_keys WHERE key = $1`
+			err := db.QueryRow(query, key).Scan(&path, &state, &status, &contentType, &body, &headers)
+			if err == sql.ErrNoRows {
+				// The first attempt failed and gave the key back; run this one.
+				WithIdempotency(db, window, time.Until(deadline), next)(w, r)
+				return
+			}
+			if err != nil {
+				log.Printf("Error loading idempotency key: %v", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			if path != r.URL.Path {
+				http.Error(w, "Idempotency-Key was already used for a different request", http.StatusUnprocessableEntity)
+				return
+			}
+
+			if state == "done" {
+				if contentType.Valid && contentType.String != "" {
+					w.Header().Set("Content-Type", contentType.String)
+				}
+				if len(headers) > 0 {
+					var stored http.Header
+					if err := json.Unmarshal(headers, &stored); err != nil {
+						log.Printf("Error decoding idempotent response headers for %s: %v", key, err)
+					}
+					for name, values := range stored {
+						w.Header()[name] = values
+					}
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(int(status.Int64))
+				w.Write(body)
+				return
+			}
+
+			if time.Now().After(deadline) {
+				w.Header().Set("Retry-After", "5")
+				http.Error(w, "A request with this Idempotency-Key is still being processed", http.StatusConflict)
+				return
+			}
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(250 * time.Millisecond):
+			}
+		}
+	}
+}
+
+// claimIdempotencyKey records key as in flight. It reports false if another
+// attempt already holds or has completed the key within the window.
+func claimIdempotencyKey(db *sql.DB, key, path string, window time.Duration) (bool, error) {
+	now := time.Now()
+	_, err := db.Exec(`DELETE FROM idempotency_keys WHERE created_at < $1 OR (state = 'in_flight' AND updated_at < $2)`,
+		now.Add(-window), now.Add(-staleClaimAfter))
+	if err != nil {
+		return false, fmt.Errorf("failed to purge expired idempotency keys: %w", err)
+	}
+
+	res, err := db.Exec(`INSERT INTO idempotency_keys (key, path, state, created_at, updated_at) VALUES ($1, $2, 'in_flight', $3, $3) ON CONFLICT (key) DO NOTHING`,
+		key, path, now)
+	if err != nil {
+		return false, fmt.Errorf("failed to claim idempotency key: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+// addedHeaders returns the headers of after that are new or changed since
+// before.
+func addedHeaders(before, after http.Header) http.Header {
+	added := make(http.Header)
+	for name, values := range after {
+		if !slices.Equal(before[name], values) {
+			added[name] = values
+		}
+	}
+	return added
+}
+
+// responseRecorder passes a response through while keeping a copy of it,
+// headers as they were sent included.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	header      http.Header
+	body        bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+		rec.header = rec.ResponseWriter.Header().Clone()
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
@@ -0,0 +1,217 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/lib/pq"
+	"github.com/minio/minio-go/v7"
+)
+
+// legacyImageBatch is how many surveys the image backfill looks at a time.
+const legacyImageBatch = 100
+
+// StartImageBackfill runs BackfillLegacyImages once in the background.
+func StartImageBackfill(ctx context.Context, db *sql.DB, minioClient *minio.Client, endpoint, bucketName string) {
+	go func() {
+		moved, err := BackfillLegacyImages(ctx, db, minioClient, endpoint, bucketName)
+		if err != nil {
+			log.Printf("Error backfilling legacy images: %v", err)
+		}
+		if moved > 0 {
+			log.Printf("Moved %d legacy images to content-addressed storage", moved)
+		}
+	}()
+}
+
+// BackfillLegacyImages moves the images stored before deduplication to
+// their content-addressed keys and records the references surveys hold on
+// them, so that reports such as HandleSharedPhotosReport see them too.
+// Each survey is moved in a transaction of its own and its old objects are
+// removed once it commits; an image that cannot be read is left as it was.
+// Running it again only picks up what is left. It returns how many images
+// were moved.
+func BackfillLegacyImages(ctx context.Context, db *sql.DB, minioClient *minio.Client, endpoint, bucketName string) (int, error) {
+	moved, after := 0, 0
+	for {
+		surveys, err := legacyImageSurveys(db, bucketName, after)
+		if err != nil {
+			return moved, err
+		}
+		if len(surveys) == 0 {
+			return moved, nil
+		}
+		for _, s := range surveys {
+			if err := ctx.Err(); err != nil {
+				return moved, err
+			}
+			after = s.id
+			if len(s.urls) == 0 {
+				continue
+			}
+			n, err := backfillSurveyImages(ctx, db, minioClient, endpoint, bucketName, s.id, s.urls)
+			if err != nil {
+				log.Printf("Error backfilling images of %d: %v", s.id, err)
+			}
+			moved += n
+		}
+	}
+}
+
+// legacySurvey is a survey and the images it still keeps outside
+// content-addressed storage.
+type legacySurvey struct {
+	id   int
+	urls []string
+}
+
+// legacyImageSurveys returns the next batch of surveys after the given ID,
+// each with its legacy image URLs, which may be none.
+func legacyImageSurveys(db *sql.DB, bucketName string, after int) ([]legacySurvey, error) {
+	rows, err := db.Query(`SELECT uf.id, uf.poleimage, uf.multipleimages,
+			ARRAY(SELECT ui.tag_image FROM userform_isps ui WHERE ui.userform_id = uf.id AND ui.tag_image IS NOT NULL)
+		FROM userform uf WHERE uf.id > $1 ORDER BY uf.id LIMIT $2`, after, legacyImageBatch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query survey images: %w", err)
+	}
+	defer rows.Close()
+
+	var surveys []legacySurvey
+	for rows.Next() {
+		var s legacySurvey
+		var poleImage, multipleImagesJSON sql.NullString
+		var tagImages []string
+		if err := rows.Scan(&s.id, &poleImage, &multipleImagesJSON, pq.Array(&tagImages)); err != nil {
+			return nil, fmt.Errorf("failed to scan survey images: %w", err)
+		}
+		urls := tagImages
+		if poleImage.String != "" {
+			urls = append(urls, poleImage.String)
+		}
+		if multipleImagesJSON.String != "" {
+			var multipleImages []string
+			if err := json.Unmarshal([]byte(multipleImagesJSON.String), &multipleImages); err != nil {
+				log.Printf("Skipping malformed image URLs of %d: %v", s.id, err)
+			}
+			urls = append(urls, multipleImages...)
+		}
+		seen := make(map[string]bool)
+		for _, u := range urls {
+			if u != "" && !seen[u] && contentHashFromURL(u) == "" && objectNameFromURL(u, bucketName) != "" {
+				seen[u] = true
+				s.urls = append(s.urls, u)
+			}
+		}
+		surveys = append(surveys, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over survey images: %w", err)
+	}
+	return surveys, nil
+}
+
+// backfillSurveyImages moves the legacy images urls of survey id and
+// returns how many it moved.
+func backfillSurveyImages(ctx context.Context, db *sql.DB, minioClient *minio.Client, endpoint, bucketName string, id int, urls []string) (int, error) {
+	moves := make(map[string]*StoredObject)
+	defer func() {
+		for _, stored := range moves {
+			DropUnreferencedImage(db, minioClient, bucketName, stored.SHA256)
+		}
+	}()
+	for _, u := range urls {
+		uploaded, err := HashObject(ctx, minioClient, endpoint, bucketName, objectNameFromURL(u, bucketName))
+		if err != nil {
+			log.Printf("Leaving image %s of %d as it is: %v", u, id, err)
+			continue
+		}
+		stored, _, err := storeContent(ctx, db, minioClient, endpoint, bucketName, uploaded)
+		if err != nil {
+			return 0, err
+		}
+		moves[u] = stored
+	}
+	if len(moves) == 0 {
+		return 0, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// The survey may have changed since it was read; only what it still
+	// holds is moved.
+	var poleImage, multipleImagesJSON sql.NullString
+	err = tx.QueryRow(`SELECT poleimage, multipleimages FROM userform WHERE id = $1 FOR UPDATE`, id).Scan(&poleImage, &multipleImagesJSON)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to lock survey: %w", err)
+	}
+
+	var refs []imageRef
+	moved := make(map[string]bool)
+	if stored, ok := moves[poleImage.String]; ok {
+		moved[poleImage.String] = true
+		poleImage.String = stored.URL
+		refs = append(refs, imageRef{stored.URL, "poleimage"})
+	}
+	if multipleImagesJSON.String != "" {
+		var multipleImages []string
+		if err := json.Unmarshal([]byte(multipleImagesJSON.String), &multipleImages); err == nil {
+			for i, u := range multipleImages {
+				if stored, ok := moves[u]; ok {
+					moved[u] = true
+					multipleImages[i] = stored.URL
+					refs = append(refs, imageRef{stored.URL, "multipleimages"})
+				}
+			}
+			encoded, err := json.Marshal(multipleImages)
+			if err != nil {
+				return 0, fmt.Errorf("failed to marshal image URLs to JSON: %w", err)
+			}
+			multipleImagesJSON.String = string(encoded)
+		}
+	}
+	if _, err := tx.Exec(`UPDATE userform SET poleimage = $2, multipleimages = $3 WHERE id = $1`, id, poleImage, multipleImagesJSON); err != nil {
+		return 0, fmt.Errorf("failed to update image URLs: %w", err)
+	}
+	for u, stored := range moves {
+		res, err := tx.Exec(`UPDATE userform_isps SET tag_image = $3 WHERE userform_id = $1 AND tag_image = $2`, id, u, stored.URL)
+		if err != nil {
+			return 0, fmt.Errorf("failed to update ISP label photos: %w", err)
+		}
+		n, _ := res.RowsAffected()
+		for ; n > 0; n-- {
+			moved[u] = true
+			refs = append(refs, imageRef{stored.URL, "isp_tag"})
+		}
+	}
+	if len(refs) == 0 {
+		return 0, nil
+	}
+
+	if err := addImageReferences(tx, id, refs); err != nil {
+		return 0, err
+	}
+	if err := recordChange(tx, id, "upsert"); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit moved images: %w", err)
+	}
+
+	// Images from before deduplication belong to this survey alone.
+	var names []string
+	for u := range moved {
+		names = append(names, objectNameFromURL(u, bucketName))
+	}
+	RemoveObjects(minioClient, bucketName, names)
+	return len(moved), nil
+}
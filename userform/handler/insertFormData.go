@@ -1,137 +1,329 @@
 package handler
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github/rabinam24/userform/geo"
+	"github/rabinam24/userform/live"
 	"github/rabinam24/userform/models"
 	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
+	"net/url"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/minio/minio-go/v7"
 )
 
+// maxFieldBytes caps the size of a single non-file form value.
+const maxFieldBytes = 64 << 10
+
 // HandleFormData handles the incoming form data and processes it.
-func HandleFormData(db *sql.DB, minioClient *minio.Client, bucketName string, endpoint string) http.HandlerFunc {
+// A submission close to existing poles (within poleRadius metres) that
+// names neither a pole_id nor new_pole=true is stored as an inspection of
+// the nearest, and answered with the candidate poles; with confirm_pole=true,
+// as a form field or query parameter, it is answered with 409 and the
+// candidates instead. A submission outside the surveyor's assigned area is
+// stored but answered with a Warning header.
+func HandleFormData(db *sql.DB, minioClient *minio.Client, bucketName string, endpoint string, limits models.UploadConfig, poleRadius float64) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var formData models.FormData
+		r.Body = http.MaxBytesReader(w, r.Body, limits.MaxRequestBytes)
 
-		// Parse the incoming multipart form data
-		err := r.ParseMultipartForm(10 << 20) // 10 MB limit
+		// Stream the multipart body part by part so images go straight to
+		// the object store instead of being buffered in memory or on disk.
+		reader, err := r.MultipartReader()
 		if err != nil {
-			log.Printf("Error parsing multipart form: %v", err)
+			log.Printf("Error reading multipart form: %v", err)
 			http.Error(w, "Failed to parse form data", http.StatusBadRequest)
 			return
 		}
 
-		// Populate formData fields from the form values
-		formData.Location = r.FormValue("location")
-		formData.Latitude, _ = strconv.ParseFloat(r.FormValue("latitude"), 64)
-		formData.Longitude, _ = strconv.ParseFloat(r.FormValue("longitude"), 64)
-		formData.SelectPole = r.FormValue("selectpole")
-		formData.SelectPoleStatus = r.FormValue("selectpolestatus")
-		formData.SelectPoleLocation = r.FormValue("selectpolelocation")
-		formData.Description = r.FormValue("description")
-		formData.AvailableISP = r.FormValue("availableisp")
-		formData.SelectISP = r.FormValue("selectisp")
+		sub, err := readFormParts(r.Context(), db, reader, minioClient, bucketName, endpoint, limits)
+		if err != nil {
+			log.Printf("Error streaming form data: %v", err)
+			sub.release(db, minioClient, bucketName)
+			writeFormError(w, err)
+			return
+		}
 
-		// Handle single image upload for pole image
-		if file, _, err := r.FormFile("poleimage"); err == nil {
-			defer file.Close()
+		if err := validateFormData(db, &sub.FormData, sub.Problems); err != nil {
+			log.Printf("Rejecting invalid submission: %v", err)
+			sub.release(db, minioClient, bucketName)
+			writeFormError(w, err)
+			return
+		}
 
-			poleImageData, err := io.ReadAll(file)
-			if err != nil {
-				log.Printf("Error reading single image: %v", err)
-				http.Error(w, "Failed to read pole image", http.StatusInternalServerError)
-				return
-			}
+		confirmPole := sub.Fields.Get("confirm_pole") == "true" || r.URL.Query().Get("confirm_pole") == "true"
+		candidates, err := matchPole(db, &sub.FormData, sub.Fields.Get("new_pole") == "true", confirmPole, poleRadius)
+		if err != nil {
+			log.Printf("Not storing submission: %v", err)
+			sub.release(db, minioClient, bucketName)
+			writeFormError(w, err)
+			return
+		}
 
-			poleImageName := fmt.Sprintf("%d-poleimage.jpeg", time.Now().UnixNano())
-			poleImageURLs, err := UploadToMinIO(minioClient, endpoint, bucketName, []string{poleImageName}, [][]byte{poleImageData})
-			if err != nil {
-				log.Printf("Error uploading pole image to MinIO: %v", err)
-				http.Error(w, "Failed to upload pole image", http.StatusInternalServerError)
-				return
-			}
+		// Images sent earlier through the resumable upload endpoints
+		if err := resolveUploadReferences(db, &sub.FormData, sub.Fields); err != nil {
+			log.Printf("Error resolving uploaded images: %v", err)
+			sub.release(db, minioClient, bucketName)
+			writeFormError(w, err)
+			return
+		}
 
-			formData.PoleImage = poleImageURLs[0]
-			log.Println("Uploaded Pole Image:", poleImageURLs[0])
-		} else if err != http.ErrMissingFile {
-			log.Printf("Error handling pole image: %v", err)
-			http.Error(w, "Failed to handle pole image", http.StatusInternalServerError)
+		uploads, err := resolveISPs(db, sub.FormData.ISPs, sub.Files, nil)
+		if err != nil {
+			log.Printf("Error resolving ISPs: %v", err)
+			sub.release(db, minioClient, bucketName)
+			writeFormError(w, err)
 			return
-		} else {
-			formData.PoleImage = "" // Set to empty if no image provided
 		}
+		sub.FormData.UploadIDs = append(sub.FormData.UploadIDs, uploads...)
 
-		// Handle multiple images upload
-		multipleImageFiles := r.MultipartForm.File["multipleimages"]
-		var multipleImageURLs []string
+		warning, err := linkAssignment(db, &sub.FormData)
+		if err != nil {
+			log.Printf("Error linking submission to an assignment: %v", err)
+			sub.release(db, minioClient, bucketName)
+			http.Error(w, "Failed to insert data into database", http.StatusInternalServerError)
+			return
+		}
 
-		for i, fileHeader := range multipleImageFiles {
-			file, err := fileHeader.Open()
-			if err != nil {
-				log.Printf("Error opening multiple image %d: %v", i, err)
-				http.Error(w, fmt.Sprintf("Failed to open image %d", i), http.StatusInternalServerError)
-				return
-			}
+		// Insert form data into the database
+		_, err = InsertData(db, sub.FormData)
+		// A stored row now holds its images by itself; whatever an attempt
+		// that was not stored uploaded is dropped.
+		sub.release(db, minioClient, bucketName)
+		if errors.Is(err, ErrDuplicateSubmission) {
+			// A retry of a submission we already have: answer as the first
+			// attempt did.
+			log.Printf("Duplicate submission for client_id %s", sub.FormData.ClientID)
+		} else if err != nil {
+			log.Printf("Error inserting data into database: %v", err)
+			http.Error(w, "Failed to insert data into database", http.StatusInternalServerError)
+			return
+		}
 
-			imageData, err := io.ReadAll(file)
-			file.Close()
-			if err != nil {
-				log.Printf("Error reading multiple image %d: %v", i, err)
-				http.Error(w, fmt.Sprintf("Failed to read image %d", i), http.StatusInternalServerError)
-				return
-			}
+		if warning != "" {
+			log.Printf("Submission by %s: %s", sub.FormData.Surveyor, warning)
+			w.Header().Set("Warning", "299 - "+strconv.QuoteToASCII(warning))
+		}
+		if len(candidates) > 0 {
+			writeJSON(w, http.StatusOK, models.PoleMatch{
+				Message:    "Data inserted successfully",
+				PoleID:     sub.FormData.PoleID,
+				Candidates: candidates,
+			})
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Data inserted successfully"))
+	}
+}
+
+// formError is a client-side problem with a submission, reported with its
+// own HTTP status instead of a generic 500.
+type formError struct {
+	status  int
+	message string
+}
+
+func (e *formError) Error() string {
+	return e.message
+}
+
+func writeFormError(w http.ResponseWriter, err error) {
+	var fe *formError
+	if errors.As(err, &fe) {
+		http.Error(w, fe.message, fe.status)
+		return
+	}
+	var ve *validationError
+	if errors.As(err, &ve) {
+		writeJSON(w, http.StatusUnprocessableEntity, models.ValidationErrorResponse{Error: "Validation failed", Fields: ve.fields})
+		return
+	}
+	var proposal *poleProposal
+	if errors.As(err, &proposal) {
+		writeJSON(w, http.StatusConflict, models.PoleProposal{Error: "Submission is close to existing poles", Candidates: proposal.candidates})
+		return
+	}
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		http.Error(w, "Form submission is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, "Failed to process form data", http.StatusInternalServerError)
+}
+
+// formSubmission is a form being received. It remembers every image stored
+// on its behalf, each held by a provisional reference until the submission
+// is saved or abandoned.
+type formSubmission struct {
+	FormData models.FormData
+	Fields   url.Values
+	Files    map[string]string // ISP label photo part name to URL
+	Problems fieldErrors       // found while parsing, reported by validation
+	Stored   []*StoredObject
+}
+
+// release gives up the submission's provisional references, removing the
+// images no saved row uses, as when the submission is not saved.
+func (sub *formSubmission) release(db *sql.DB, minioClient *minio.Client, bucketName string) {
+	for _, stored := range sub.Stored {
+		DropUnreferencedImage(db, minioClient, bucketName, stored.SHA256)
+	}
+}
+
+// readFormParts walks the multipart body, collecting the text fields and
+// streaming every image part into MinIO as it arrives. The returned
+// submission is never nil, even on error.
+func readFormParts(ctx context.Context, db *sql.DB, reader *multipart.Reader, minioClient *minio.Client, bucketName, endpoint string, limits models.UploadConfig) (*formSubmission, error) {
+	sub := &formSubmission{Fields: make(url.Values), Files: make(map[string]string)}
+	formData := &sub.FormData
+	fields := sub.Fields
+	imageCount := 0
 
-			imageName := fmt.Sprintf("%d-multipleimage-%d.jpeg", time.Now().UnixNano(), i)
-			imageURLs, err := UploadToMinIO(minioClient, endpoint, bucketName, []string{imageName}, [][]byte{imageData})
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return sub, fmt.Errorf("failed to read form part: %w", err)
+		}
+
+		name := part.FormName()
+		if part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, maxFieldBytes+1))
+			part.Close()
 			if err != nil {
-				log.Printf("Error uploading multiple image %d to MinIO: %v", i, err)
-				http.Error(w, fmt.Sprintf("Failed to upload image %d", i), http.StatusInternalServerError)
-				return
+				return sub, fmt.Errorf("failed to read field %s: %w", name, err)
 			}
+			if len(value) > maxFieldBytes {
+				return sub, &formError{http.StatusRequestEntityTooLarge, fmt.Sprintf("Field %s is too large", name)}
+			}
+			fields.Add(name, string(value))
+			continue
+		}
 
-			multipleImageURLs = append(multipleImageURLs, imageURLs...)
+		if name != "poleimage" && name != "multipleimages" && !strings.HasPrefix(name, ispTagPartPrefix) {
+			part.Close()
+			log.Printf("Ignoring unexpected file field %q", name)
+			continue
 		}
 
-		formData.MultipleImages = multipleImageURLs
-		log.Println("Uploaded multiple images:", multipleImageURLs)
+		imageCount++
+		if imageCount > limits.MaxImages {
+			part.Close()
+			return sub, &formError{http.StatusRequestEntityTooLarge, fmt.Sprintf("At most %d images are allowed", limits.MaxImages)}
+		}
 
-		// Insert form data into the database
-		if err := InsertData(db, formData); err != nil {
-			log.Printf("Error inserting data into database: %v", err)
-			http.Error(w, "Failed to insert data into database", http.StatusInternalServerError)
-			return
+		// Stream to a temporary key first; the final key is the content hash,
+		// which is only known once the whole part has been read.
+		tempName := fmt.Sprintf("tmp/%d-%s%s", time.Now().UnixNano(), name, imageExt(part.FileName()))
+		uploaded, err := StreamToMinIO(ctx, minioClient, endpoint, bucketName, tempName, part, limits.MaxImageBytes, limits.PartSize)
+		part.Close()
+		if errors.Is(err, ErrImageTooLarge) {
+			return sub, &formError{http.StatusRequestEntityTooLarge, fmt.Sprintf("Image %s exceeds %d bytes", part.FileName(), limits.MaxImageBytes)}
+		}
+		if err != nil {
+			return sub, fmt.Errorf("failed to upload %s: %w", name, err)
 		}
 
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("Data inserted successfully"))
+		stored, _, err := StoreContentAddressed(ctx, db, minioClient, endpoint, bucketName, uploaded)
+		if err != nil {
+			return sub, fmt.Errorf("failed to store %s: %w", name, err)
+		}
+		sub.Stored = append(sub.Stored, stored)
+		log.Printf("Uploaded %s to %s (%d bytes, sha256 %s)", name, stored.URL, stored.Size, stored.SHA256)
+
+		switch name {
+		case "poleimage":
+			formData.PoleImage = stored.URL
+		case "multipleimages":
+			formData.MultipleImages = append(formData.MultipleImages, stored.URL)
+		default:
+			sub.Files[name] = stored.URL
+		}
 	}
+
+	// Populate formData fields from the form values
+	formData.Location = fields.Get("location")
+	formData.Latitude = parseCoordinate(fields, "latitude", &sub.Problems)
+	formData.Longitude = parseCoordinate(fields, "longitude", &sub.Problems)
+	formData.SelectPole = fields.Get("selectpole")
+	formData.SelectPoleStatus = fields.Get("selectpolestatus")
+	formData.SelectPoleLocation = fields.Get("selectpolelocation")
+	formData.Description = fields.Get("description")
+	formData.AvailableISP = fields.Get("availableisp")
+	formData.SelectISP = fields.Get("selectisp")
+	formData.ClientID = fields.Get("client_id")
+	formData.Surveyor = strings.TrimSpace(fields.Get("username"))
+	if raw := fields.Get("pole_id"); raw != "" {
+		poleID, err := strconv.Atoi(raw)
+		if err != nil || poleID <= 0 {
+			sub.Problems.add("pole_id", "must be a pole ID")
+		}
+		formData.PoleID = poleID
+	}
+
+	isps, err := parseISPs(fields)
+	if err != nil {
+		return sub, err
+	}
+	formData.ISPs = isps
+
+	return sub, nil
 }
 
-// InsertData inserts the form data into the database.
-func InsertData(db *sql.DB, formData models.FormData) error {
+// ErrDuplicateSubmission is returned by InsertData when a row with the same
+// client-generated ID already exists.
+var ErrDuplicateSubmission = errors.New("submission already recorded")
+
+// InsertData inserts the form data into the database and returns the new
+// row's ID. The row and its image references are written in one transaction.
+// If formData carries a ClientID that was already stored, the existing row's
+// ID is returned together with ErrDuplicateSubmission.
+func InsertData(db *sql.DB, formData models.FormData) (int, error) {
 	multipleImagesJSON, err := json.Marshal(formData.MultipleImages)
 	if err != nil {
-		return fmt.Errorf("failed to marshal image URLs to JSON: %w", err)
+		return 0, fmt.Errorf("failed to marshal image URLs to JSON: %w", err)
+	}
+
+	// selectisp stays the primary provider for clients reading only that
+	if len(formData.ISPs) > 0 {
+		formData.SelectISP = formData.ISPs[0].Provider
 	}
+	formData.AdminAreaTags = adminAreas.locate(geo.Point{Lat: formData.Latitude, Lon: formData.Longitude})
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
 
 	query := `
         INSERT INTO userform (
 			location, latitude, longitude, selectpole, 
 			selectpolestatus, selectpolelocation, description, 
-			poleimage, availableisp, selectisp, multipleimages, created_at
+			poleimage, availableisp, selectisp, multipleimages, client_id, surveyor,
+			assignment_id, outside_assignment, province, district, municipality, ward, created_at
 		) 
 		VALUES (
-			$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12
-		);`
+			$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20
+		)
+		ON CONFLICT (client_id) DO NOTHING
+		RETURNING id;`
 
 	log.Println("Attempting to insert data into the database.")
-	_, err = db.Exec(query,
+	var id int
+	err = tx.QueryRow(query,
 		formData.Location,
 		formData.Latitude,
 		formData.Longitude,
@@ -143,14 +335,75 @@ func InsertData(db *sql.DB, formData models.FormData) error {
 		formData.AvailableISP,
 		formData.SelectISP,
 		string(multipleImagesJSON),
+		sql.NullString{String: formData.ClientID, Valid: formData.ClientID != ""},
+		sql.NullString{String: formData.Surveyor, Valid: formData.Surveyor != ""},
+		sql.NullInt64{Int64: int64(formData.AssignmentID), Valid: formData.AssignmentID != 0},
+		formData.OutsideAssignment,
+		nullString(formData.Province),
+		nullString(formData.District),
+		nullString(formData.Municipality),
+		nullString(formData.Ward),
 		time.Now(),
-	)
+	).Scan(&id)
 
+	if err == sql.ErrNoRows {
+		err = db.QueryRow(`SELECT id FROM userform WHERE client_id = $1`, formData.ClientID).Scan(&id)
+		if err != nil {
+			return 0, fmt.Errorf("failed to look up duplicate submission: %w", err)
+		}
+		return id, ErrDuplicateSubmission
+	}
 	if err != nil {
 		log.Printf("Error executing SQL query: %v", err)
-		return fmt.Errorf("failed to insert data into database: %w", err)
+		return 0, fmt.Errorf("failed to insert data into database: %w", err)
+	}
+
+	if err := attachPole(tx, id, &formData); err != nil {
+		return 0, err
+	}
+
+	if err := openAutoWorkOrder(tx, id, formData); err != nil {
+		return 0, err
+	}
+
+	if err := insertISPs(tx, id, formData.ISPs); err != nil {
+		return 0, err
+	}
+
+	if err := addImageReferences(tx, id, formImageRefs(formData)); err != nil {
+		return 0, err
+	}
+
+	if err := claimUploads(tx, formData.UploadIDs); err != nil {
+		return 0, err
+	}
+
+	if err := recordChange(tx, id, "upsert"); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit form data: %w", err)
 	}
 
 	log.Println("Data inserted successfully.")
-	return nil
+	refreshPoleIndex(db, id, formData.PoleID)
+	publishLive(db, live.EventSubmission, formData.Surveyor, models.LiveSubmission{
+		ID:               id,
+		Latitude:         formData.Latitude,
+		Longitude:        formData.Longitude,
+		SelectPole:       formData.SelectPole,
+		SelectPoleStatus: formData.SelectPoleStatus,
+	})
+	return id, nil
+}
+
+// imageExt keeps the extension of an uploaded file name if it is one of the
+// image types we serve, defaulting to .jpeg like the original uploads.
+func imageExt(filename string) string {
+	ext := strings.ToLower(filepath.Ext(filename))
+	if ext != ".jpg" && ext != ".jpeg" && ext != ".png" {
+		ext = ".jpeg"
+	}
+	return ext
 }
@@ -0,0 +1,289 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github/rabinam24/userform/models"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/minio/minio-go/v7"
+)
+
+const (
+	// ispTagPartPrefix marks multipart file parts holding ISP label photos.
+	ispTagPartPrefix = "isp_tag_"
+	// maxISPsPerPole bounds the attachments accepted for one pole.
+	maxISPsPerPole = 20
+)
+
+// parseISPs reads the ISP attachments of a submission from the isps JSON
+// field. Older clients only send selectisp, plus the extra providers in
+// additionalInfo; those become attachments without cable details.
+func parseISPs(fields url.Values) ([]models.ISPAttachment, error) {
+	if raw := fields.Get("isps"); raw != "" {
+		var isps []models.ISPAttachment
+		if err := json.Unmarshal([]byte(raw), &isps); err != nil {
+			return nil, &formError{http.StatusBadRequest, "Field isps must be a JSON array of ISP attachments"}
+		}
+		return isps, nil
+	}
+
+	var isps []models.ISPAttachment
+	if provider := strings.TrimSpace(fields.Get("selectisp")); provider != "" {
+		isps = append(isps, models.ISPAttachment{Provider: provider})
+	}
+	if raw := fields.Get("additionalInfo"); raw != "" {
+		var additional []struct {
+			SelectISP string `json:"selectisp"`
+		}
+		if err := json.Unmarshal([]byte(raw), &additional); err != nil {
+			log.Printf("Ignoring malformed additionalInfo: %v", err)
+		}
+		for _, info := range additional {
+			if provider := strings.TrimSpace(info.SelectISP); provider != "" {
+				isps = append(isps, models.ISPAttachment{Provider: provider})
+			}
+		}
+	}
+	return isps, nil
+}
+
+// resolveISPs checks ISP attachments against the catalogue, storing the
+// entry's code and name, and fills in their label photo URLs.
+// A photo comes from a file part of the same request (files maps part names
+// to URLs), a completed resumable upload, or, when editing, one of the
+// photos the row already has (keep). It returns the uploads used, for the
+// caller to claim along with the row.
+func resolveISPs(db *sql.DB, isps []models.ISPAttachment, files map[string]string, keep map[string]bool) ([]string, error) {
+	var problems fieldErrors
+	if len(isps) > maxISPsPerPole {
+		problems.add("isps", "at most %d ISPs per pole", maxISPsPerPole)
+		return nil, problems.err()
+	}
+	if len(isps) == 0 {
+		return nil, nil
+	}
+
+	catalogue, err := loadISPCatalogue(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var uploads []string
+	for i := range isps {
+		isp := &isps[i]
+		field := fmt.Sprintf("isps[%d]", i)
+		isp.ID = 0
+		provider := isp.Provider
+		if provider == "" {
+			provider = isp.ISPCode
+		}
+		if entry, ok := catalogue.match(provider); !ok {
+			problems.add(field+".provider", "unknown provider %q", provider)
+		} else if !entry.Active {
+			problems.add(field+".provider", "%s is no longer offered", entry.Name)
+		} else {
+			isp.Provider = entry.Name
+			isp.ISPCode = entry.Code
+		}
+		if isp.CableCount < 0 {
+			problems.add(field+".cable_count", "must not be negative")
+		}
+		if len(isp.CableType) > maxTextBytes {
+			problems.add(field+".cable_type", "must be at most %d bytes", maxTextBytes)
+		}
+
+		switch {
+		case isp.TagImagePart != "":
+			imageURL, ok := files[isp.TagImagePart]
+			if !ok {
+				problems.add(field+".tag_image_part", "refers to missing file part %s", isp.TagImagePart)
+			}
+			isp.TagImage = imageURL
+		case isp.TagImageID != "":
+			session, err := GetUploadSession(db, isp.TagImageID)
+			if err != nil {
+				return nil, err
+			}
+			if session == nil || !session.Completed {
+				problems.add(field+".tag_image_id", "upload %s is unknown or incomplete", isp.TagImageID)
+			} else {
+				isp.TagImage = session.URL
+				uploads = append(uploads, isp.TagImageID)
+			}
+		case isp.TagImage != "" && keep[isp.TagImage]:
+		default:
+			isp.TagImage = ""
+		}
+		isp.TagImagePart = ""
+		isp.TagImageID = ""
+	}
+	if err := problems.err(); err != nil {
+		return nil, err
+	}
+	return uploads, nil
+}
+
+// ispImageRefs lists the label photos of isps as image slots.
+func ispImageRefs(isps []models.ISPAttachment) []imageRef {
+	var refs []imageRef
+	for _, isp := range isps {
+		if isp.TagImage != "" {
+			refs = append(refs, imageRef{isp.TagImage, "isp_tag"})
+		}
+	}
+	return refs
+}
+
+// insertISPs stores the attachments of a userform row, setting their IDs.
+func insertISPs(tx *sql.Tx, userformID int, isps []models.ISPAttachment) error {
+	query := `INSERT INTO userform_isps (userform_id, provider, isp_code, cable_count, cable_type, tag_image) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
+	for i := range isps {
+		isp := &isps[i]
+		err := tx.QueryRow(query, userformID, isp.Provider, sql.NullString{String: isp.ISPCode, Valid: isp.ISPCode != ""},
+			isp.CableCount, isp.CableType, sql.NullString{String: isp.TagImage, Valid: isp.TagImage != ""}).Scan(&isp.ID)
+		if err != nil {
+			return fmt.Errorf("failed to insert ISP %s: %w", isp.Provider, err)
+		}
+	}
+	return nil
+}
+
+// replaceISPs swaps the attachments of a userform row for isps, moving the
+// label photo references along. It returns the objects no longer used.
+func replaceISPs(tx *sql.Tx, userformID int, isps []models.ISPAttachment) ([]string, error) {
+	released, err := releaseImageReferences(tx, userformID, "isp_tag")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM userform_isps WHERE userform_id = $1`, userformID); err != nil {
+		return nil, fmt.Errorf("failed to delete ISPs: %w", err)
+	}
+	if err := insertISPs(tx, userformID, isps); err != nil {
+		return nil, err
+	}
+	if err := addImageReferences(tx, userformID, ispImageRefs(isps)); err != nil {
+		return nil, err
+	}
+	return dropUnusedImages(tx, released)
+}
+
+// loadISPs fetches the attachments of the given userform rows.
+func loadISPs(db querier, userformIDs []int64) (map[int][]models.ISPAttachment, error) {
+	rows, err := db.Query(`SELECT id, userform_id, provider, isp_code, cable_count, cable_type, tag_image FROM userform_isps WHERE userform_id = ANY($1) ORDER BY id`,
+		pq.Array(userformIDs))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query ISPs: %w", err)
+	}
+	defer rows.Close()
+
+	isps := make(map[int][]models.ISPAttachment)
+	for rows.Next() {
+		var isp models.ISPAttachment
+		var userformID int
+		var ispCode, tagImage sql.NullString
+		if err := rows.Scan(&isp.ID, &userformID, &isp.Provider, &ispCode, &isp.CableCount, &isp.CableType, &tagImage); err != nil {
+			return nil, fmt.Errorf("failed to scan ISP: %w", err)
+		}
+		isp.ISPCode = ispCode.String
+		isp.TagImage = tagImage.String
+		isps[userformID] = append(isps[userformID], isp)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over ISPs: %w", err)
+	}
+	return isps, nil
+}
+
+// HandleUpdateISPs replaces the ISP attachments of a pole. Label photos may
+// be kept by sending back their tag_image_url, or replaced through
+// tag_image_id with a completed resumable upload.
+func HandleUpdateISPs(db *sql.DB, minioClient *minio.Client, bucketName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+
+		var isps []models.ISPAttachment
+		if err := json.NewDecoder(r.Body).Decode(&isps); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		current, err := loadISPs(db, []int64{int64(id)})
+		if err != nil {
+			log.Printf("Error loading ISPs of %d: %v", id, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		keep := make(map[string]bool)
+		for _, isp := range current[id] {
+			if isp.TagImage != "" {
+				keep[isp.TagImage] = true
+			}
+		}
+
+		uploads, err := resolveISPs(db, isps, nil, keep)
+		if err != nil {
+			writeFormError(w, err)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Error beginning transaction: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		// Keep selectisp in step for clients that only read the single value.
+		primary := ""
+		if len(isps) > 0 {
+			primary = isps[0].Provider
+		}
+		res, err := tx.Exec(`UPDATE userform SET selectisp = $1 WHERE id = $2`, primary, id)
+		if err != nil {
+			log.Printf("Error updating userform %d: %v", id, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Data not found", http.StatusNotFound)
+			return
+		}
+
+		unused, err := replaceISPs(tx, id, isps)
+		if err == nil {
+			err = claimUploads(tx, uploads)
+		}
+		if err != nil {
+			log.Printf("Error replacing ISPs of %d: %v", id, err)
+			http.Error(w, "Failed to update ISPs", http.StatusInternalServerError)
+			return
+		}
+
+		if err := recordChange(tx, id, "upsert"); err != nil {
+			log.Printf("Error recording change of %d: %v", id, err)
+			http.Error(w, "Failed to update ISPs", http.StatusInternalServerError)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			log.Printf("Error committing ISPs of %d: %v", id, err)
+			http.Error(w, "Failed to update ISPs", http.StatusInternalServerError)
+			return
+		}
+
+		RemoveObjects(minioClient, bucketName, unused)
+		writeJSON(w, http.StatusOK, isps)
+	}
+}
@@ -0,0 +1,463 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github/rabinam24/userform/models"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ispCodePattern  = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+	ispColorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+)
+
+// ispKey folds an ISP spelling for matching, so "World Link", "worldlink"
+// and "WORLD-LINK" are the same provider.
+func ispKey(value string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(value) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// ispCatalogue indexes catalogue entries by the keys of their code, name
+// and aliases.
+type ispCatalogue map[string]models.ISP
+
+func (c ispCatalogue) match(value string) (models.ISP, bool) {
+	key := ispKey(value)
+	if key == "" {
+		return models.ISP{}, false
+	}
+	isp, ok := c[key]
+	return isp, ok
+}
+
+// add indexes isp and reports a spelling another entry already uses.
+func (c ispCatalogue) add(isp models.ISP) error {
+	for _, value := range append([]string{isp.Code, isp.Name}, isp.Aliases...) {
+		key := ispKey(value)
+		if key == "" {
+			continue
+		}
+		if other, ok := c[key]; ok && other.Code != isp.Code {
+			return fmt.Errorf("%q is already used by ISP %s", value, other.Code)
+		}
+		c[key] = isp
+	}
+	return nil
+}
+
+// listISPs returns the catalogue ordered by name.
+func listISPs(db *sql.DB, activeOnly bool) ([]models.ISP, error) {
+	rows, err := db.Query(`SELECT code, name, color, active, aliases, created_at, updated_at FROM isps WHERE active OR NOT $1 ORDER BY name`, activeOnly)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query ISPs: %w", err)
+	}
+	defer rows.Close()
+
+	isps := []models.ISP{}
+	for rows.Next() {
+		var isp models.ISP
+		var aliases pq.StringArray
+		if err := rows.Scan(&isp.Code, &isp.Name, &isp.Color, &isp.Active, &aliases, &isp.CreatedAt, &isp.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan ISP: %w", err)
+		}
+		isp.Aliases = []string(aliases)
+		isps = append(isps, isp)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over ISPs: %w", err)
+	}
+	return isps, nil
+}
+
+// loadISPCatalogue indexes the whole catalogue, inactive entries included.
+func loadISPCatalogue(db *sql.DB) (ispCatalogue, error) {
+	isps, err := listISPs(db, false)
+	if err != nil {
+		return nil, err
+	}
+	catalogue := make(ispCatalogue)
+	for _, isp := range isps {
+		if err := catalogue.add(isp); err != nil {
+			log.Printf("ISP catalogue conflict: %v", err)
+		}
+	}
+	return catalogue, nil
+}
+
+// decodeISP reads and validates a catalogue entry from the request body.
+func decodeISP(r *http.Request) (models.ISP, error) {
+	isp := models.ISP{Active: true}
+	if err := json.NewDecoder(r.Body).Decode(&isp); err != nil {
+		return isp, &formError{http.StatusBadRequest, "Invalid request payload"}
+	}
+	isp.Code = strings.TrimSpace(isp.Code)
+	isp.Name = strings.TrimSpace(isp.Name)
+	if isp.Color == "" {
+		isp.Color = "#888888"
+	}
+	aliases := []string{}
+	for _, alias := range isp.Aliases {
+		if alias = strings.TrimSpace(alias); alias != "" {
+			aliases = append(aliases, alias)
+		}
+	}
+	isp.Aliases = aliases
+
+	switch {
+	case !ispCodePattern.MatchString(isp.Code):
+		return isp, &formError{http.StatusBadRequest, "Code must be 1-32 lowercase letters, digits, - or _"}
+	case isp.Name == "" || len(isp.Name) > 255:
+		return isp, &formError{http.StatusBadRequest, "Name must be 1-255 characters"}
+	case !ispColorPattern.MatchString(isp.Color):
+		return isp, &formError{http.StatusBadRequest, "Color must look like #RRGGBB"}
+	}
+	return isp, nil
+}
+
+// checkISPSpellings rejects an entry whose code, name or aliases would match
+// another catalogue entry.
+func checkISPSpellings(db *sql.DB, isp models.ISP) error {
+	catalogue, err := loadISPCatalogue(db)
+	if err != nil {
+		return err
+	}
+	for key, other := range catalogue {
+		if other.Code == isp.Code {
+			delete(catalogue, key)
+		}
+	}
+	if err := catalogue.add(isp); err != nil {
+		return &formError{http.StatusConflict, err.Error()}
+	}
+	return nil
+}
+
+// HandleListISPs serves the ISP catalogue for the survey form. Inactive
+// entries are only included with ?all=true.
+func HandleListISPs(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		isps, err := listISPs(db, r.URL.Query().Get("all") != "true")
+		if err != nil {
+			log.Printf("Error listing ISPs: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, isps)
+	}
+}
+
+// HandleCreateISP adds a catalogue entry.
+func HandleCreateISP(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		isp, err := decodeISP(r)
+		if err == nil {
+			err = checkISPSpellings(db, isp)
+		}
+		if err != nil {
+			writeFormError(w, err)
+			return
+		}
+
+		query := `INSERT INTO isps (code, name, color, active, aliases) VALUES ($1, $2, $3, $4, $5) RETURNING created_at, updated_at`
+		err = db.QueryRow(query, isp.Code, isp.Name, isp.Color, isp.Active, pq.Array(isp.Aliases)).Scan(&isp.CreatedAt, &isp.UpdatedAt)
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			http.Error(w, "An ISP with this code or name already exists", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("Error creating ISP %s: %v", isp.Code, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, isp)
+	}
+}
+
+// HandleUpdateISP replaces the name, color, active flag and aliases of a
+// catalogue entry. A new name is carried over to the surveys using it.
+func HandleUpdateISP(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		isp, err := decodeISP(r)
+		if err == nil && isp.Code != r.PathValue("code") {
+			err = &formError{http.StatusBadRequest, "Code cannot be changed"}
+		}
+		if err == nil {
+			err = checkISPSpellings(db, isp)
+		}
+		if err != nil {
+			writeFormError(w, err)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Error beginning transaction: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		var oldName string
+		err = tx.QueryRow(`SELECT name FROM isps WHERE code = $1 FOR UPDATE`, isp.Code).Scan(&oldName)
+		if err == sql.ErrNoRows {
+			http.Error(w, "ISP not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error loading ISP %s: %v", isp.Code, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		query := `UPDATE isps SET name = $2, color = $3, active = $4, aliases = $5, updated_at = CURRENT_TIMESTAMP WHERE code = $1 RETURNING created_at, updated_at`
+		err = tx.QueryRow(query, isp.Code, isp.Name, isp.Color, isp.Active, pq.Array(isp.Aliases)).Scan(&isp.CreatedAt, &isp.UpdatedAt)
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			http.Error(w, "An ISP with this name already exists", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("Error updating ISP %s: %v", isp.Code, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		if oldName != isp.Name {
+			if err := renameISPValue(tx, oldName, isp.Name, isp.Code); err != nil {
+				log.Printf("Error renaming ISP %s: %v", isp.Code, err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			log.Printf("Error committing ISP %s: %v", isp.Code, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, isp)
+	}
+}
+
+// HandleDeleteISP removes a catalogue entry no survey uses. Entries in use
+// can only be deactivated.
+func HandleDeleteISP(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		code := r.PathValue("code")
+
+		var used bool
+		if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM userform_isps WHERE isp_code = $1)`, code).Scan(&used); err != nil {
+			log.Printf("Error checking use of ISP %s: %v", code, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if used {
+			http.Error(w, "ISP is used by surveys; deactivate it instead", http.StatusConflict)
+			return
+		}
+
+		res, err := db.Exec(`DELETE FROM isps WHERE code = $1`, code)
+		if err != nil {
+			log.Printf("Error deleting ISP %s: %v", code, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "ISP not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandleCleanupISPs maps the free-text ISP values stored before the
+// catalogue existed onto catalogue entries. Values are matched on their
+// folded spelling; mappings in the request settle the rest. With dry_run
+// the report is produced without changing anything.
+func HandleCleanupISPs(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req models.ISPCleanupRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		catalogue, err := loadISPCatalogue(db)
+		if err != nil {
+			log.Printf("Error loading ISP catalogue: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		byCode := make(map[string]models.ISP)
+		for _, isp := range catalogue {
+			byCode[isp.Code] = isp
+		}
+		for value, code := range req.Mappings {
+			if _, ok := byCode[code]; !ok {
+				http.Error(w, fmt.Sprintf("Mapping for %q names unknown ISP %s", value, code), http.StatusBadRequest)
+				return
+			}
+		}
+		// Mapped values become aliases, so like the aliases of a created or
+		// updated entry they must not already stand for another entry.
+		if clashes := ispAliasClashes(catalogue, req.Mappings); len(clashes) > 0 {
+			http.Error(w, "Mappings clash with the catalogue: "+strings.Join(clashes, "; "), http.StatusConflict)
+			return
+		}
+
+		values, err := uncataloguedISPValues(db)
+		if err != nil {
+			log.Printf("Error loading ISP values: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		report := models.ISPCleanupReport{DryRun: req.DryRun, Mapped: []models.ISPCleanupValue{}, Unmatched: []models.ISPCleanupValue{}}
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Error beginning transaction: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		for _, v := range values {
+			isp, ok := byCode[req.Mappings[v.Value]]
+			explicit := ok
+			if !ok {
+				isp, ok = catalogue.match(v.Value)
+			}
+			if !ok {
+				report.Unmatched = append(report.Unmatched, v)
+				continue
+			}
+			v.Code = isp.Code
+			report.Mapped = append(report.Mapped, v)
+			if req.DryRun {
+				continue
+			}
+
+			if err := renameISPValue(tx, v.Value, isp.Name, isp.Code); err != nil {
+				log.Printf("Error mapping ISP value %q: %v", v.Value, err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			if explicit {
+				// Remember the spelling so later submissions match directly.
+				_, err := tx.Exec(`UPDATE isps SET aliases = array_append(aliases, $2), updated_at = CURRENT_TIMESTAMP WHERE code = $1 AND NOT $2 = ANY(aliases)`,
+					isp.Code, v.Value)
+				if err != nil {
+					log.Printf("Error adding alias %q to ISP %s: %v", v.Value, isp.Code, err)
+					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			log.Printf("Error committing ISP cleanup: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
+
+// ispAliasClashes lists the mappings whose value would match another entry
+// than its own once added as an alias, in value order.
+func ispAliasClashes(catalogue ispCatalogue, mappings map[string]string) []string {
+	proposed := make(ispCatalogue, len(catalogue))
+	for key, isp := range catalogue {
+		proposed[key] = isp
+	}
+	values := make([]string, 0, len(mappings))
+	for value := range mappings {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+
+	var clashes []string
+	for _, value := range values {
+		if err := proposed.add(models.ISP{Code: mappings[value], Aliases: []string{value}}); err != nil {
+			clashes = append(clashes, err.Error())
+		}
+	}
+	return clashes
+}
+
+// uncataloguedISPValues counts the distinct ISP values of surveys that are
+// not yet linked to a catalogue entry under its current name.
+func uncataloguedISPValues(db *sql.DB) ([]models.ISPCleanupValue, error) {
+	query := `
+	SELECT value, COUNT(DISTINCT id) FROM (
+		SELECT ui.provider AS value, ui.userform_id AS id
+		FROM userform_isps ui LEFT JOIN isps i ON i.code = ui.isp_code
+		WHERE i.code IS NULL OR ui.provider <> i.name
+		UNION ALL
+		SELECT uf.selectisp, uf.id FROM userform uf
+		WHERE COALESCE(uf.selectisp, '') <> '' AND uf.selectisp NOT IN (SELECT name FROM isps)
+	) v
+	GROUP BY value`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query ISP values: %w", err)
+	}
+	defer rows.Close()
+
+	var values []models.ISPCleanupValue
+	for rows.Next() {
+		var v models.ISPCleanupValue
+		if err := rows.Scan(&v.Value, &v.Rows); err != nil {
+			return nil, fmt.Errorf("failed to scan ISP value: %w", err)
+		}
+		values = append(values, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over ISP values: %w", err)
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].Rows > values[j].Rows })
+	return values, nil
+}
+
+// renameISPValue points every survey using the ISP value from at the
+// catalogue entry code with display name to, and logs the changed surveys
+// for sync.
+func renameISPValue(tx *sql.Tx, from, to, code string) error {
+	if err := lockSyncLog(tx); err != nil {
+		return err
+	}
+	query := `
+	WITH attachments AS (
+		UPDATE userform_isps SET provider = $2, isp_code = $3
+		WHERE provider = $1 AND (isp_code IS NULL OR isp_code = $3)
+		RETURNING userform_id
+	), forms AS (
+		UPDATE userform SET selectisp = $2 WHERE selectisp = $1 RETURNING id
+	)
+	INSERT INTO sync_changes (userform_id, op)
+	SELECT DISTINCT id, 'upsert' FROM (
+		SELECT userform_id AS id FROM attachments UNION SELECT id FROM forms
+	) changed`
+	if _, err := tx.Exec(query, from, to, code); err != nil {
+		return fmt.Errorf("failed to rename ISP value %q: %w", from, err)
+	}
+	return nil
+}
@@ -91,6 +91,9 @@ func HandleUserLogin(db *sql.DB, cfg models.Config) http.HandlerFunc {
 			AccessToken:  accessToken,
 			RefreshToken: refreshToken,
 		}
+		if response.AutoEndedTrips, err = takeAutoEndedTrips(db, req.Username); err != nil {
+			log.Printf("Error loading auto-ended trips of %s: %v", req.Username, err)
+		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
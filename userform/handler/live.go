@@ -0,0 +1,223 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github/rabinam24/userform/live"
+	"github/rabinam24/userform/models"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// livePublishTimeout bounds how long a request waits to hand an event
+	// to the broker.
+	livePublishTimeout = 5 * time.Second
+	// liveKeepAlive is how often an idle stream is pinged, so that proxies
+	// keep it open.
+	liveKeepAlive = 25 * time.Second
+)
+
+// liveEvents carries live events; in-process unless SetLiveBroker swaps in
+// a shared backend.
+var liveEvents live.Broker = live.NewMemoryBroker()
+
+// SetLiveBroker makes b carry live events, for replicas to share them. Call
+// it before serving.
+func SetLiveBroker(b live.Broker) {
+	liveEvents = b
+}
+
+// publishLive sends an event about username to the live view. Failures are
+// only logged: the live view is best effort and must not fail the request
+// it reports on.
+func publishLive(db *sql.DB, eventType, username string, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("Error encoding live %s event: %v", eventType, err)
+		return
+	}
+	var team string
+	err = db.QueryRow(`SELECT team FROM surveyor_teams WHERE username = $1`, username).Scan(&team)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error looking up team of %s: %v", username, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), livePublishTimeout)
+	defer cancel()
+	e := live.Event{Type: eventType, Team: team, Username: username, Time: time.Now(), Data: payload}
+	if err := liveEvents.Publish(ctx, e); err != nil {
+		log.Printf("Error publishing live %s event of %s: %v", eventType, username, err)
+	}
+}
+
+// liveTeamFilter reads ?team= (comma separated); events of other teams are
+// left out. No filter passes everything.
+func liveTeamFilter(r *http.Request) func(live.Event) bool {
+	raw := r.URL.Query().Get("team")
+	if raw == "" {
+		return func(live.Event) bool { return true }
+	}
+	teams := make(map[string]bool)
+	for _, team := range strings.Split(raw, ",") {
+		teams[strings.TrimSpace(team)] = true
+	}
+	return func(e live.Event) bool { return teams[e.Team] }
+}
+
+// livePositions returns, as position events, where each surveyor on a trip
+// was last seen, so a new subscriber starts with the current picture.
+func livePositions(db *sql.DB) ([]live.Event, error) {
+	rows, err := db.Query(`SELECT DISTINCT ON (s.id) s.id, s.username, COALESCE(t.team, ''),
+			p.latitude, p.longitude, p.accuracy, p.recorded_at
+		FROM trip_sessions s JOIN trip_points p ON p.trip_id = s.id
+		LEFT JOIN surveyor_teams t ON t.username = s.username
+		WHERE s.ended_at IS NULL
+		ORDER BY s.id, p.recorded_at DESC, p.id DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query live positions: %w", err)
+	}
+	defer rows.Close()
+
+	var events []live.Event
+	for rows.Next() {
+		var e live.Event
+		var p models.LivePosition
+		var accuracy sql.NullFloat64
+		if err := rows.Scan(&p.TripID, &e.Username, &e.Team, &p.Latitude, &p.Longitude, &accuracy, &p.RecordedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan live position: %w", err)
+		}
+		p.RecordedAt = fromStored(p.RecordedAt)
+		if accuracy.Valid {
+			p.Accuracy = &accuracy.Float64
+		}
+		if e.Data, err = json.Marshal(p); err != nil {
+			return nil, fmt.Errorf("failed to encode live position: %w", err)
+		}
+		e.Type, e.Time = live.EventPosition, p.RecordedAt
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over live positions: %w", err)
+	}
+	return events, nil
+}
+
+// streamLive sends the current positions and then every new event passing
+// the ?team= filter to send until ctx is done or send fails. send is
+// called with nil every liveKeepAlive, to ping the client.
+func streamLive(ctx context.Context, db *sql.DB, r *http.Request, send func(*live.Event) error) {
+	// Subscribe first, so nothing published while the snapshot is read is
+	// missed.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	events := liveEvents.Subscribe(ctx)
+	wanted := liveTeamFilter(r)
+
+	snapshot, err := livePositions(db)
+	if err != nil {
+		log.Printf("Error loading live positions: %v", err)
+	}
+	for i := range snapshot {
+		if wanted(snapshot[i]) {
+			if err := send(&snapshot[i]); err != nil {
+				return
+			}
+		}
+	}
+
+	keepAlive := time.NewTicker(liveKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if !wanted(e) {
+				continue
+			}
+			if err := send(&e); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if err := send(nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// HandleLiveEvents streams live events as Server-Sent Events, named by
+// event type. ?team= (comma separated) limits them to those teams.
+func HandleLiveEvents(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		if err := rc.Flush(); err != nil {
+			log.Printf("Error starting live event stream: %v", err)
+			return
+		}
+
+		streamLive(r.Context(), db, r, func(e *live.Event) error {
+			if e == nil {
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return err
+				}
+				return rc.Flush()
+			}
+			payload, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, payload); err != nil {
+				return err
+			}
+			return rc.Flush()
+		})
+	}
+}
+
+// HandleLiveSocket streams live events over a WebSocket, one JSON text
+// frame per event. ?team= (comma separated) limits them to those teams.
+// Anything the client sends is ignored.
+func HandleLiveSocket(db *sql.DB) http.HandlerFunc {
+	server := websocket.Server{
+		// Any origin may watch, as with the rest of the API (see the CORS
+		// options in main).
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			r := ws.Request()
+			ctx, cancel := context.WithCancel(r.Context())
+			defer cancel()
+			go func() {
+				// Reading is how a closed connection is noticed.
+				var discard []byte
+				for websocket.Message.Receive(ws, &discard) == nil {
+				}
+				cancel()
+			}()
+
+			streamLive(ctx, db, r, func(e *live.Event) error {
+				if e == nil {
+					ws.PayloadType = websocket.PingFrame
+					_, err := ws.Write(nil)
+					ws.PayloadType = websocket.TextFrame
+					return err
+				}
+				return websocket.JSON.Send(ws, e)
+			})
+		},
+	}
+	return server.ServeHTTP
+}
@@ -0,0 +1,172 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// StartObjectReconciler runs ReconcileObjects every interval until ctx is done.
+func StartObjectReconciler(ctx context.Context, db *sql.DB, minioClient *minio.Client, bucketName string, interval, grace time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := ReconcileObjects(ctx, db, minioClient, bucketName, grace); err != nil {
+				log.Printf("Error reconciling objects: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// ReconcileObjects removes objects that no userform row refers to and that
+// are older than grace, along with multipart uploads abandoned for longer
+// than grace. The grace period covers submissions still in flight and
+// resumable uploads the client has not referenced yet.
+func ReconcileObjects(ctx context.Context, db *sql.DB, minioClient *minio.Client, bucketName string, grace time.Duration) error {
+	cutoff := time.Now().Add(-grace)
+
+	// List the bucket before loading references, so an object whose row is
+	// committed while we scan is seen as referenced.
+	var candidates []string
+	for object := range minioClient.ListObjects(ctx, bucketName, minio.ListObjectsOptions{Recursive: true}) {
+		if object.Err != nil {
+			return fmt.Errorf("failed to list objects: %w", object.Err)
+		}
+		if object.LastModified.Before(cutoff) {
+			candidates = append(candidates, object.Key)
+		}
+	}
+
+	referenced, err := referencedObjects(db, bucketName)
+	if err != nil {
+		return err
+	}
+
+	var orphans []string
+	for _, name := range candidates {
+		if referenced[name] {
+			continue
+		}
+		if strings.HasPrefix(name, contentPrefix) {
+			// A submission may have just deduplicated onto this image; only
+			// drop it if it still has no references. Provisional references
+			// lapse after the grace period, as their holder is gone.
+			var held bool
+			err := db.QueryRow(`WITH dropped AS (
+					DELETE FROM images WHERE object_name = $1
+					AND ref_count = 0 AND NOT (pending > 0 AND pending_since >= $2) RETURNING 1)
+				SELECT EXISTS (SELECT 1 FROM images WHERE object_name = $1) AND NOT EXISTS (SELECT 1 FROM dropped)`,
+				name, cutoff).Scan(&held)
+			if err != nil {
+				return fmt.Errorf("failed to drop image %s: %w", name, err)
+			}
+			if held {
+				continue
+			}
+		}
+		orphans = append(orphans, name)
+	}
+	if len(orphans) > 0 {
+		log.Printf("Removing %d orphaned objects", len(orphans))
+		RemoveObjects(minioClient, bucketName, orphans)
+		for _, name := range orphans {
+			if _, err := db.Exec(`DELETE FROM uploads WHERE object_name = $1`, name); err != nil {
+				log.Printf("Error deleting upload session for %s: %v", name, err)
+			}
+		}
+	}
+
+	core := minio.Core{Client: minioClient}
+	for upload := range minioClient.ListIncompleteUploads(ctx, bucketName, "", true) {
+		if upload.Err != nil {
+			return fmt.Errorf("failed to list incomplete uploads: %w", upload.Err)
+		}
+		if upload.Initiated.Before(cutoff) {
+			if err := core.AbortMultipartUpload(ctx, bucketName, upload.Key, upload.UploadID); err != nil {
+				log.Printf("Error aborting stale upload %s: %v", upload.Key, err)
+			}
+		}
+	}
+
+	if _, err := db.Exec(`DELETE FROM uploads WHERE completed = FALSE AND created_at < $1`, cutoff); err != nil {
+		return fmt.Errorf("failed to delete stale upload sessions: %w", err)
+	}
+
+	return nil
+}
+
+// referencedObjects returns the names of all objects some userform row uses.
+func referencedObjects(db *sql.DB, bucketName string) (map[string]bool, error) {
+	rows, err := db.Query(`SELECT poleimage, multipleimages FROM userform`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query image references: %w", err)
+	}
+	defer rows.Close()
+
+	referenced := make(map[string]bool)
+	for rows.Next() {
+		var poleImage, multipleImagesJSON sql.NullString
+		if err := rows.Scan(&poleImage, &multipleImagesJSON); err != nil {
+			return nil, fmt.Errorf("failed to scan image references: %w", err)
+		}
+		names, err := imageObjectNames(bucketName, poleImage, multipleImagesJSON)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			referenced[name] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over image references: %w", err)
+	}
+
+	tagRows, err := db.Query(`SELECT tag_image FROM userform_isps WHERE tag_image IS NOT NULL`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query ISP label references: %w", err)
+	}
+	defer tagRows.Close()
+	for tagRows.Next() {
+		var tagImage string
+		if err := tagRows.Scan(&tagImage); err != nil {
+			return nil, fmt.Errorf("failed to scan ISP label reference: %w", err)
+		}
+		referenced[objectNameFromURL(tagImage, bucketName)] = true
+	}
+	if err := tagRows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over ISP label references: %w", err)
+	}
+
+	return referenced, nil
+}
+
+// imageObjectNames lists the objects behind a row's poleimage and
+// multipleimages columns.
+func imageObjectNames(bucketName string, poleImage, multipleImagesJSON sql.NullString) ([]string, error) {
+	var names []string
+	if poleImage.Valid && poleImage.String != "" {
+		names = append(names, objectNameFromURL(poleImage.String, bucketName))
+	}
+	if multipleImagesJSON.Valid && multipleImagesJSON.String != "" {
+		var urls []string
+		if err := json.Unmarshal([]byte(multipleImagesJSON.String), &urls); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal image URLs: %w", err)
+		}
+		for _, u := range urls {
+			names = append(names, objectNameFromURL(u, bucketName))
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"database/sql"
+	"github/rabinam24/userform/geo"
+	"github/rabinam24/userform/models"
+	"github/rabinam24/userform/mvt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// poleMarkerCell is the side of a cluster cell on screen, in pixels of
+	// a 256 pixel tile.
+	poleMarkerCell = 64
+	// maxPoleMarkers is how many single poles a map view gets past
+	// poleClusterMaxZoom; a larger view is still clustered.
+	maxPoleMarkers = 5000
+)
+
+// HandlePoleClusters serves /api/poles/clusters?bbox=&zoom=: the poles in
+// bbox (minLon,minLat,maxLon,maxLat) as a map at that zoom shows them. Up to
+// poleClusterMaxZoom, poles sharing a grid cell of poleMarkerCell pixels
+// become one cluster with a count and a breakdown by status; a pole alone
+// in its cell is listed as a pole. Past it every pole is listed. The grid
+// is fixed to the world, so panning does not move poles between clusters.
+func HandlePoleClusters(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		var problems fieldErrors
+		bbox, ok := parseBBoxParam(query.Get("bbox"))
+		if !ok {
+			problems.add("bbox", "must be minLon,minLat,maxLon,maxLat in degrees")
+		}
+		zoom, err := strconv.Atoi(query.Get("zoom"))
+		if err != nil || zoom < 0 || zoom > maxTileZoom {
+			problems.add("zoom", "must be a whole number between 0 and "+strconv.Itoa(maxTileZoom))
+		}
+		if err := problems.err(); err != nil {
+			writeFormError(w, err)
+			return
+		}
+
+		points, err := polePointsInBBox(db, bbox)
+		if err != nil {
+			log.Printf("Error clustering poles: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		result := models.PoleClusterMap{Zoom: zoom, Clusters: []models.PoleCluster{}, Poles: []models.PoleMarker{}}
+		if zoom > poleClusterMaxZoom && len(points) <= maxPoleMarkers {
+			for _, p := range points {
+				result.Poles = append(result.Poles, poleMarker(p))
+			}
+			writeJSON(w, http.StatusOK, result)
+			return
+		}
+
+		scale := 256 * math.Exp2(float64(zoom)) / poleMarkerCell // cells across the world
+		clusters := clusterPoles(points, func(p polePoint) [2]int64 {
+			return [2]int64{int64(p.mx * scale), int64(p.my * scale)}
+		})
+		for _, c := range clusters {
+			if c.single != nil {
+				result.Poles = append(result.Poles, poleMarker(*c.single))
+				continue
+			}
+			result.Clusters = append(result.Clusters, models.PoleCluster{
+				Latitude:  c.point.Lat,
+				Longitude: c.point.Lon,
+				Count:     c.count,
+				Statuses:  c.statuses,
+				Bounds:    [4]float64{c.bbox.MinLon, c.bbox.MinLat, c.bbox.MaxLon, c.bbox.MaxLat},
+			})
+		}
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+// polePointsInBBox returns the poles whose latest survey lies in bbox,
+// edges included, ordered as the pole index keeps them. With PostGIS the
+// GiST index on userform.geog finds the poles with any survey in the box;
+// a pole whose latest survey has since moved out of it is dropped after.
+func polePointsInBBox(db *sql.DB, bbox geo.BBox) ([]polePoint, error) {
+	if !usePostGIS {
+		idx, err := currentPoleIndex(db)
+		if err != nil {
+			return nil, err
+		}
+		minX, maxY := mvt.Mercator(geo.Point{Lat: bbox.MinLat, Lon: bbox.MinLon})
+		maxX, minY := mvt.Mercator(geo.Point{Lat: bbox.MaxLat, Lon: bbox.MaxLon})
+		return idx.within(minX, math.Nextafter(maxX, 2), minY, math.Nextafter(maxY, 2)), nil
+	}
+
+	// The index keeps its boxes in single precision, so the exact
+	// conditions decide the edges.
+	candidates, err := queryPolePoints(db, `AND COALESCE(uf.pole_id, -uf.id) IN (
+		SELECT COALESCE(pole_id, -id) FROM userform
+		WHERE geog::geometry && ST_MakeEnvelope($3, $1, $4, $2, 4326)
+			AND latitude BETWEEN $1 AND $2 AND longitude BETWEEN $3 AND $4)`,
+		bbox.MinLat, bbox.MaxLat, bbox.MinLon, bbox.MaxLon)
+	if err != nil {
+		return nil, err
+	}
+	var points []polePoint
+	for _, p := range candidates {
+		if bbox.Contains(p.point) {
+			points = append(points, p)
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].mx < points[j].mx })
+	return points, nil
+}
+
+// parseBBoxParam reads a bounding box written minLon,minLat,maxLon,maxLat,
+// the order map libraries give it in. Boxes across the antimeridian are not
+// supported.
+func parseBBoxParam(raw string) (geo.BBox, bool) {
+	parts := strings.Split(raw, ",")
+	if len(parts) != 4 {
+		return geo.BBox{}, false
+	}
+	var v [4]float64
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || math.IsNaN(f) {
+			return geo.BBox{}, false
+		}
+		v[i] = f
+	}
+	b := geo.BBox{MinLon: v[0], MinLat: v[1], MaxLon: v[2], MaxLat: v[3]}
+	if b.MinLon < -180 || b.MaxLon > 180 || b.MinLat < -90 || b.MaxLat > 90 ||
+		b.MinLon > b.MaxLon || b.MinLat > b.MaxLat {
+		return geo.BBox{}, false
+	}
+	return b, true
+}
+
+func poleMarker(p polePoint) models.PoleMarker {
+	m := models.PoleMarker{
+		SurveyID:  p.surveyID,
+		Latitude:  p.point.Lat,
+		Longitude: p.point.Lon,
+		PoleType:  p.poleType,
+		Status:    p.status,
+		ISPs:      []string{},
+	}
+	if p.poleID != 0 {
+		poleID := p.poleID
+		m.PoleID = &poleID
+	}
+	if p.isps != "" {
+		m.ISPs = strings.Split(p.isps, ",")
+	}
+	return m
+}
@@ -0,0 +1,297 @@
+package handler
+
+import (
+	"database/sql"
+	"fmt"
+	"github/rabinam24/userform/geo"
+	"github/rabinam24/userform/mvt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+// polePoint is a pole as the map shows it: where and what its latest
+// survey recorded. Surveys not linked to a pole stand for one each.
+type polePoint struct {
+	surveyID int
+	poleID   int // 0 when the survey has no pole
+	point    geo.Point
+	mx, my   float64 // Web Mercator position, see mvt.Mercator
+	poleType string
+	status   string
+	isps     string // comma separated catalogue names
+}
+
+// poleIndex holds every pole sorted by mx, as of one data version.
+type poleIndex struct {
+	version int64
+	points  []polePoint
+}
+
+// poleIndexCache keeps the latest index; it is rebuilt when the data
+// version moves on.
+var poleIndexCache struct {
+	mu    sync.Mutex
+	index *poleIndex
+}
+
+// currentPoleIndex returns the index for the current data version,
+// building it if needed.
+func currentPoleIndex(db *sql.DB) (*poleIndex, error) {
+	version, err := dataVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	poleIndexCache.mu.Lock()
+	defer poleIndexCache.mu.Unlock()
+	if idx := poleIndexCache.index; idx != nil && idx.version == version {
+		return idx, nil
+	}
+	idx, err := loadPoleIndex(db, version)
+	if err != nil {
+		return nil, err
+	}
+	poleIndexCache.index = idx
+	return idx, nil
+}
+
+func loadPoleIndex(db *sql.DB, version int64) (*poleIndex, error) {
+	points, err := queryPolePoints(db, "")
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].mx < points[j].mx })
+	return &poleIndex{version: version, points: points}, nil
+}
+
+// loadPoleLocations puts the poles in ids into idx, or every pole when ids
+// is nil. Poles in ids that no longer exist are removed.
+func loadPoleLocations(db *sql.DB, idx *geo.SpatialIndex, ids []int64) error {
+	query, args := `SELECT id, latitude, longitude FROM poles`, []interface{}{}
+	if ids != nil {
+		query, args = query+` WHERE id = ANY($1)`, append(args, pq.Array(ids))
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query pole locations: %w", err)
+	}
+	defer rows.Close()
+
+	found := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		var p geo.Point
+		if err := rows.Scan(&id, &p.Lat, &p.Lon); err != nil {
+			return fmt.Errorf("failed to scan pole location: %w", err)
+		}
+		idx.Put(id, p)
+		found[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating over pole locations: %w", err)
+	}
+	for _, id := range ids {
+		if !found[int(id)] {
+			idx.Remove(int(id))
+		}
+	}
+	return nil
+}
+
+// queryPolePoints loads the latest survey of each pole, or of each survey
+// without a pole, among the located surveys matching "AND ..." conditions.
+func queryPolePoints(db *sql.DB, conditions string, args ...interface{}) ([]polePoint, error) {
+	rows, err := db.Query(`SELECT DISTINCT ON (COALESCE(uf.pole_id, -uf.id)) uf.id, COALESCE(uf.pole_id, 0),
+			uf.latitude, uf.longitude, COALESCE(uf.selectpole, ''), COALESCE(uf.selectpolestatus, ''),
+			COALESCE((SELECT string_agg(DISTINCT COALESCE(i.name, ui.provider), ',' ORDER BY COALESCE(i.name, ui.provider))
+				FROM userform_isps ui LEFT JOIN isps i ON i.code = ui.isp_code WHERE ui.userform_id = uf.id),
+				uf.selectisp, '')
+		FROM userform uf WHERE uf.latitude IS NOT NULL AND uf.longitude IS NOT NULL `+conditions+`
+		ORDER BY COALESCE(uf.pole_id, -uf.id), uf.created_at DESC, uf.id DESC`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query poles: %w", err)
+	}
+	defer rows.Close()
+
+	var points []polePoint
+	for rows.Next() {
+		var p polePoint
+		if err := rows.Scan(&p.surveyID, &p.poleID, &p.point.Lat, &p.point.Lon, &p.poleType, &p.status, &p.isps); err != nil {
+			return nil, fmt.Errorf("failed to scan pole: %w", err)
+		}
+		p.mx, p.my = mvt.Mercator(p.point)
+		points = append(points, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over poles: %w", err)
+	}
+	return points, nil
+}
+
+// refreshPoleIndex brings the index and the pole locations up to date with
+// a survey that was just stored or deleted on pole poleID (0 for none),
+// reloading only the poles it touches. Each stays current only if that
+// survey was the sole change since it was built; after any other change
+// the next reader rebuilds it in full.
+func refreshPoleIndex(db *sql.DB, surveyID, poleID int) {
+	version, err := dataVersion(db)
+	if err != nil {
+		log.Printf("Error updating pole index for survey %d: %v", surveyID, err)
+		return
+	}
+	if err := refreshPoleLocations(db, poleID, version); err != nil {
+		log.Printf("Error updating pole locations for survey %d: %v", surveyID, err)
+	}
+
+	poleIndexCache.mu.Lock()
+	defer poleIndexCache.mu.Unlock()
+	idx := poleIndexCache.index
+	if idx == nil {
+		return
+	}
+	next, err := idx.refreshed(db, surveyID, poleID)
+	if err != nil {
+		log.Printf("Error updating pole index for survey %d: %v", surveyID, err)
+		poleIndexCache.index = nil
+		return
+	}
+	if version == idx.version+1 {
+		next.version = version
+	}
+	poleIndexCache.index = next
+}
+
+// refreshed returns a copy of idx with the poles of surveyID, before and
+// after its change, reloaded. Readers may still hold idx, so it is left
+// alone.
+func (idx *poleIndex) refreshed(db *sql.DB, surveyID, poleID int) (*poleIndex, error) {
+	stale := make(map[int]bool)
+	if poleID != 0 {
+		stale[poleID] = true
+	}
+	for _, p := range idx.points {
+		if p.surveyID == surveyID && p.poleID != 0 {
+			stale[p.poleID] = true
+		}
+	}
+	poles := make([]int64, 0, len(stale))
+	for id := range stale {
+		poles = append(poles, int64(id))
+	}
+	fresh, err := queryPolePoints(db, `AND (uf.pole_id = ANY($1) OR (uf.pole_id IS NULL AND uf.id = $2))`, pq.Array(poles), surveyID)
+	if err != nil {
+		return nil, err
+	}
+
+	next := &poleIndex{version: idx.version, points: make([]polePoint, 0, len(idx.points)+len(fresh))}
+	for _, p := range idx.points {
+		if p.surveyID != surveyID && !stale[p.poleID] {
+			next.points = append(next.points, p)
+		}
+	}
+	for _, p := range fresh {
+		i := sort.Search(len(next.points), func(i int) bool { return next.points[i].mx >= p.mx })
+		next.points = append(next.points, polePoint{})
+		copy(next.points[i+1:], next.points[i:])
+		next.points[i] = p
+	}
+	return next, nil
+}
+
+// within returns the poles with mx in [minX, maxX) and my in [minY, maxY).
+func (idx *poleIndex) within(minX, maxX, minY, maxY float64) []polePoint {
+	start := sort.Search(len(idx.points), func(i int) bool { return idx.points[i].mx >= minX })
+	var found []polePoint
+	for _, p := range idx.points[start:] {
+		if p.mx >= maxX {
+			break
+		}
+		if p.my >= minY && p.my < maxY {
+			found = append(found, p)
+		}
+	}
+	return found
+}
+
+// poleCluster is a group of nearby poles. Status, type and ISP are the
+// most common among them; single is set when the group has one pole.
+type poleCluster struct {
+	count    int
+	mx, my   float64
+	point    geo.Point
+	bbox     geo.BBox
+	poleType string
+	status   string
+	isp      string
+	statuses map[string]int
+	single   *polePoint
+}
+
+// clusterPoles groups points by the cell cellOf puts them in, in the order
+// the cells are first met.
+func clusterPoles(points []polePoint, cellOf func(polePoint) [2]int64) []poleCluster {
+	type group struct {
+		members  []int
+		types    map[string]int
+		statuses map[string]int
+		isps     map[string]int
+	}
+	groups := make(map[[2]int64]*group)
+	var order [][2]int64
+	for i, p := range points {
+		cell := cellOf(p)
+		g, ok := groups[cell]
+		if !ok {
+			g = &group{types: map[string]int{}, statuses: map[string]int{}, isps: map[string]int{}}
+			groups[cell] = g
+			order = append(order, cell)
+		}
+		g.members = append(g.members, i)
+		g.types[p.poleType]++
+		g.statuses[p.status]++
+		if p.isps != "" {
+			for _, isp := range strings.Split(p.isps, ",") {
+				g.isps[isp]++
+			}
+		}
+	}
+
+	clusters := make([]poleCluster, 0, len(order))
+	for _, cell := range order {
+		g := groups[cell]
+		c := poleCluster{count: len(g.members), poleType: mostCommon(g.types), status: mostCommon(g.statuses), isp: mostCommon(g.isps), statuses: g.statuses}
+		first := points[g.members[0]].point
+		c.bbox = geo.BBox{MinLat: first.Lat, MinLon: first.Lon, MaxLat: first.Lat, MaxLon: first.Lon}
+		for _, i := range g.members {
+			p := points[i]
+			c.bbox.MinLat, c.bbox.MaxLat = math.Min(c.bbox.MinLat, p.point.Lat), math.Max(c.bbox.MaxLat, p.point.Lat)
+			c.bbox.MinLon, c.bbox.MaxLon = math.Min(c.bbox.MinLon, p.point.Lon), math.Max(c.bbox.MaxLon, p.point.Lon)
+			c.mx += p.mx
+			c.my += p.my
+			c.point.Lat += p.point.Lat
+			c.point.Lon += p.point.Lon
+		}
+		n := float64(c.count)
+		c.mx, c.my, c.point.Lat, c.point.Lon = c.mx/n, c.my/n, c.point.Lat/n, c.point.Lon/n
+		if c.count == 1 {
+			c.single = &points[g.members[0]]
+		}
+		clusters = append(clusters, c)
+	}
+	return clusters
+}
+
+// mostCommon returns the value counted most, the smallest on a tie.
+func mostCommon(counts map[string]int) string {
+	best, bestCount := "", 0
+	for value, n := range counts {
+		if n > bestCount || (n == bestCount && value < best) {
+			best, bestCount = value, n
+		}
+	}
+	return best
+}
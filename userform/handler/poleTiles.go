@@ -0,0 +1,137 @@
+package handler
+
+import (
+	"database/sql"
+	"fmt"
+	"github/rabinam24/userform/mvt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxTileZoom is the deepest zoom tiles are served for.
+	maxTileZoom = 22
+	// poleClusterMaxZoom is the deepest zoom at which poles are clustered.
+	poleClusterMaxZoom = 14
+	// poleClusterCell is the side of a cluster cell, in tile coordinates
+	// (16 pixels of a 256 pixel tile).
+	poleClusterCell = mvt.Extent / 16
+	// poleTileBuffer is how far beyond its edges a tile carries single
+	// poles, in tile coordinates, so that markers on an edge are not cut.
+	poleTileBuffer = 64
+	// tileCacheSize is how many encoded tiles are kept.
+	tileCacheSize = 2048
+)
+
+// HandlePoleTiles serves /tiles/poles/{z}/{x}/{y}.mvt: Mapbox Vector Tiles
+// with one "poles" layer built from the latest survey of each pole. Up to
+// poleClusterMaxZoom, poles sharing a cluster cell become one feature with
+// cluster=true and point_count; status, type and isp are then the most
+// common among them. Single poles carry survey_id, pole_id, status, type
+// and isp (comma separated). Tiles are cached and carry an ETag of the
+// data version, so unchanged tiles are revalidated with a 304.
+func HandlePoleTiles(db *sql.DB) http.HandlerFunc {
+	cache := newVersionedCache[[]byte](tileCacheSize)
+	return func(w http.ResponseWriter, r *http.Request) {
+		rawY, ok := strings.CutSuffix(r.PathValue("y"), ".mvt")
+		z, errZ := strconv.Atoi(r.PathValue("z"))
+		x, errX := strconv.Atoi(r.PathValue("x"))
+		y, errY := strconv.Atoi(rawY)
+		if !ok || errZ != nil || errX != nil || errY != nil || !mvt.ValidTile(z, x, y, maxTileZoom) {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+
+		version, err := dataVersion(db)
+		if err != nil {
+			log.Printf("Error serving tile %d/%d/%d: %v", z, x, y, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		etag := fmt.Sprintf(`"poles-%d"`, version)
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "no-cache")
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		key := fmt.Sprintf("%d/%d/%d", z, x, y)
+		tile, ok := cache.get(key, version)
+		if !ok {
+			idx, err := currentPoleIndex(db)
+			if err != nil {
+				log.Printf("Error serving tile %s: %v", key, err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			tile = poleTile(idx, z, x, y)
+			cache.put(key, version, tile)
+		}
+		w.Header().Set("Content-Type", "application/vnd.mapbox-vector-tile")
+		w.Write(tile)
+	}
+}
+
+// poleTile encodes tile z/x/y of idx. Tiles stay on the in-memory index
+// even with PostGIS: a map view asks for a dozen of them at once, each
+// clustered and cached per data version, and one index shared by all of
+// them is cheaper than a query per tile.
+func poleTile(idx *poleIndex, z, x, y int) []byte {
+	scale := float64(mvt.Extent) * math.Exp2(float64(z)) // tile coordinates across the world
+	toTile := func(mx, my float64) (int, int) {
+		return int(math.Floor(mx*scale)) - x*mvt.Extent, int(math.Floor(my*scale)) - y*mvt.Extent
+	}
+	edge := func(tile int, offset float64) float64 {
+		return (float64(tile*mvt.Extent) + offset) / scale
+	}
+
+	layer := mvt.Layer{Name: "poles"}
+	if z <= poleClusterMaxZoom {
+		// Cells line up with tile edges, so a cluster lies in one tile only.
+		points := idx.within(edge(x, 0), edge(x+1, 0), edge(y, 0), edge(y+1, 0))
+		clusters := clusterPoles(points, func(p polePoint) [2]int64 {
+			return [2]int64{int64(p.mx * scale / poleClusterCell), int64(p.my * scale / poleClusterCell)}
+		})
+		for _, c := range clusters {
+			if c.single != nil {
+				layer.Features = append(layer.Features, poleFeature(*c.single, toTile))
+				continue
+			}
+			tx, ty := toTile(c.mx, c.my)
+			layer.Features = append(layer.Features, mvt.Feature{X: tx, Y: ty, Properties: map[string]interface{}{
+				"cluster":     true,
+				"point_count": c.count,
+				"status":      c.status,
+				"type":        c.poleType,
+				"isp":         c.isp,
+			}})
+		}
+	} else {
+		points := idx.within(edge(x, -poleTileBuffer), edge(x+1, poleTileBuffer), edge(y, -poleTileBuffer), edge(y+1, poleTileBuffer))
+		for _, p := range points {
+			layer.Features = append(layer.Features, poleFeature(p, toTile))
+		}
+	}
+	if len(layer.Features) == 0 {
+		return nil
+	}
+	return mvt.Encode(layer)
+}
+
+func poleFeature(p polePoint, toTile func(mx, my float64) (int, int)) mvt.Feature {
+	tx, ty := toTile(p.mx, p.my)
+	props := map[string]interface{}{
+		"survey_id": p.surveyID,
+		"status":    p.status,
+		"type":      p.poleType,
+		"isp":       p.isps,
+	}
+	if p.poleID != 0 {
+		props["pole_id"] = p.poleID
+	}
+	return mvt.Feature{ID: uint64(p.surveyID), X: tx, Y: ty, Properties: props}
+}
@@ -0,0 +1,278 @@
+package handler
+
+import (
+	"database/sql"
+	"fmt"
+	"github/rabinam24/userform/geo"
+	"github/rabinam24/userform/models"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// metersPerDegree is the length of one degree of latitude.
+const metersPerDegree = 111320.0
+
+// poleColumns selects everything models.Pole holds from poles, aliased as p.
+const poleColumns = `p.id, p.latitude, p.longitude, COALESCE(p.pole_type, ''), COALESCE(p.location, ''),
+	(SELECT uf.selectpolestatus FROM userform uf WHERE uf.pole_id = p.id ORDER BY uf.created_at DESC, uf.id DESC LIMIT 1),
+	(SELECT COUNT(*) FROM userform uf WHERE uf.pole_id = p.id),
+	(SELECT MAX(uf.created_at) FROM userform uf WHERE uf.pole_id = p.id),
+	p.created_at, p.updated_at`
+
+// queryPoles runs "SELECT poleColumns FROM poles p <clauses>" and scans the
+// result.
+func queryPoles(db *sql.DB, clauses string, args ...interface{}) ([]models.Pole, error) {
+	rows, err := db.Query("SELECT "+poleColumns+" FROM poles p "+clauses, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query poles: %w", err)
+	}
+	defer rows.Close()
+
+	poles := []models.Pole{}
+	for rows.Next() {
+		var pole models.Pole
+		var condition sql.NullString
+		var lastInspected sql.NullTime
+		err := rows.Scan(&pole.ID, &pole.Latitude, &pole.Longitude, &pole.PoleType, &pole.Location,
+			&condition, &pole.InspectionCount, &lastInspected, &pole.CreatedAt, &pole.UpdatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan pole: %w", err)
+		}
+		pole.Condition = condition.String
+		if lastInspected.Valid {
+			pole.LastInspectedAt = &lastInspected.Time
+		}
+		poles = append(poles, pole)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over poles: %w", err)
+	}
+	return poles, nil
+}
+
+// nearbyPoles returns the poles within radius metres of a point, nearest
+// first. Candidates come from the PostGIS index when there is one, and from
+// the in-memory pole index otherwise.
+func nearbyPoles(db *sql.DB, lat, lon, radius float64) ([]models.NearbyPole, error) {
+	var poles []models.Pole
+	var err error
+	if usePostGIS {
+		// On the sphere, whose radius PostGIS takes a little larger than
+		// CalculateDistance, so no pole within radius is missed.
+		poles, err = queryPoles(db, `WHERE ST_DWithin(p.geog, ST_MakePoint($2, $1)::geography, $3, false)`, lat, lon, radius)
+	} else {
+		poles, err = indexedNearbyPoles(db, geo.Point{Lat: lat, Lon: lon}, radius)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	nearby := []models.NearbyPole{}
+	for _, pole := range poles {
+		distance := CalculateDistance(lat, lon, pole.Latitude, pole.Longitude) * 1000
+		if distance <= radius {
+			nearby = append(nearby, models.NearbyPole{Pole: pole, DistanceMeters: math.Round(distance*10) / 10})
+		}
+	}
+	sort.Slice(nearby, func(i, j int) bool { return nearby[i].DistanceMeters < nearby[j].DistanceMeters })
+	return nearby, nil
+}
+
+// poleProposal is returned for a submission close to existing poles that
+// asked to confirm its pole and says neither which pole it inspects nor
+// that it is a new one.
+type poleProposal struct {
+	candidates []models.NearbyPole
+}
+
+func (p *poleProposal) Error() string {
+	return fmt.Sprintf("submission is within range of %d existing poles", len(p.candidates))
+}
+
+// matchPole decides which pole a submission belongs to before it is stored.
+// A given pole_id must exist. Without one, a submission near existing poles
+// is attached to the nearest, and the poles it was matched among are
+// returned; with confirm set it gets a poleProposal back instead. With
+// newPole set, or no pole near, InsertData creates a new pole for it.
+func matchPole(db *sql.DB, formData *models.FormData, newPole, confirm bool, radius float64) ([]models.NearbyPole, error) {
+	if formData.PoleID != 0 {
+		var exists bool
+		if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM poles WHERE id = $1)`, formData.PoleID).Scan(&exists); err != nil {
+			return nil, fmt.Errorf("failed to look up pole %d: %w", formData.PoleID, err)
+		}
+		if !exists {
+			var problems fieldErrors
+			problems.add("pole_id", "pole %d does not exist", formData.PoleID)
+			return nil, problems.err()
+		}
+		return nil, nil
+	}
+	if newPole || radius <= 0 {
+		return nil, nil
+	}
+
+	// A retry of a stored submission would find its own pole; let InsertData
+	// report it as the duplicate it is.
+	if formData.ClientID != "" {
+		var stored bool
+		if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM userform WHERE client_id = $1)`, formData.ClientID).Scan(&stored); err != nil {
+			return nil, fmt.Errorf("failed to look up client_id %s: %w", formData.ClientID, err)
+		}
+		if stored {
+			return nil, nil
+		}
+	}
+
+	candidates, err := nearbyPoles(db, formData.Latitude, formData.Longitude, radius)
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+	if confirm {
+		return nil, &poleProposal{candidates}
+	}
+	formData.PoleID = candidates[0].ID
+	return candidates, nil
+}
+
+// attachPole points a new inspection at its pole, creating the pole if the
+// submission did not name one.
+func attachPole(tx *sql.Tx, inspectionID int, formData *models.FormData) error {
+	if formData.PoleID == 0 {
+		query := `INSERT INTO poles (latitude, longitude, pole_type, location) VALUES ($1, $2, $3, $4) RETURNING id`
+		if err := tx.QueryRow(query, formData.Latitude, formData.Longitude, formData.SelectPole, formData.Location).Scan(&formData.PoleID); err != nil {
+			return fmt.Errorf("failed to create pole: %w", err)
+		}
+	} else {
+		res, err := tx.Exec(`UPDATE poles SET pole_type = $2, updated_at = CURRENT_TIMESTAMP WHERE id = $1`, formData.PoleID, formData.SelectPole)
+		if err != nil {
+			return fmt.Errorf("failed to update pole %d: %w", formData.PoleID, err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return fmt.Errorf("pole %d no longer exists", formData.PoleID)
+		}
+	}
+
+	if _, err := tx.Exec(`UPDATE userform SET pole_id = $1 WHERE id = $2`, formData.PoleID, inspectionID); err != nil {
+		return fmt.Errorf("failed to attach inspection %d to pole %d: %w", inspectionID, formData.PoleID, err)
+	}
+	return nil
+}
+
+// dropEmptyPole removes a pole whose last inspection was deleted. Poles with
+// work orders are kept for the tickets' sake.
+func dropEmptyPole(tx *sql.Tx, poleID int) error {
+	_, err := tx.Exec(`DELETE FROM poles WHERE id = $1
+		AND NOT EXISTS (SELECT 1 FROM userform WHERE pole_id = $1)
+		AND NOT EXISTS (SELECT 1 FROM work_orders WHERE pole_id = $1)`, poleID)
+	if err != nil {
+		return fmt.Errorf("failed to drop pole %d: %w", poleID, err)
+	}
+	return nil
+}
+
+// HandleListPoles lists every pole with its latest condition. The
+// province, district, municipality and ward filters match poles with an
+// inspection in that area.
+func HandleListPoles(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		clauses := "ORDER BY p.id"
+		conditions, args := adminAreaConditions(r.URL.Query(), nil)
+		if len(conditions) > 0 {
+			clauses = "WHERE EXISTS (SELECT 1 FROM userform uf WHERE uf.pole_id = p.id AND " +
+				strings.Join(conditions, " AND ") + ") " + clauses
+		}
+		poles, err := queryPoles(db, clauses, args...)
+		if err != nil {
+			log.Printf("Error listing poles: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, poles)
+	}
+}
+
+// HandleNearbyPoles lists the poles near ?latitude=&longitude=, within
+// ?radius= metres or the configured match radius. The survey form uses it
+// to offer attaching a new inspection to a known pole.
+func HandleNearbyPoles(db *sql.DB, defaultRadius float64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		var problems fieldErrors
+		lat := parseCoordinate(query, "latitude", &problems)
+		lon := parseCoordinate(query, "longitude", &problems)
+		validateCoordinates(lat, lon, &problems)
+		radius := defaultRadius
+		if raw := query.Get("radius"); raw != "" {
+			var err error
+			radius, err = strconv.ParseFloat(raw, 64)
+			if err != nil || radius <= 0 || radius > 1000 {
+				problems.add("radius", "must be a number of metres between 0 and 1000")
+			}
+		}
+		if err := problems.err(); err != nil {
+			writeFormError(w, err)
+			return
+		}
+
+		nearby, err := nearbyPoles(db, lat, lon, radius)
+		if err != nil {
+			log.Printf("Error finding poles near %f,%f: %v", lat, lon, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, nearby)
+	}
+}
+
+// HandlePoleDetail serves a pole with its inspections and the condition
+// each one recorded, oldest first.
+func HandlePoleDetail(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+
+		poles, err := queryPoles(db, "WHERE p.id = $1", id)
+		if err != nil {
+			log.Printf("Error loading pole %d: %v", id, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if len(poles) == 0 {
+			http.Error(w, "Pole not found", http.StatusNotFound)
+			return
+		}
+
+		inspections, err := queryFormData(db, "WHERE uf.pole_id = $1 ORDER BY uf.created_at, uf.id", id)
+		if err != nil {
+			log.Printf("Error loading inspections of pole %d: %v", id, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		detail := models.PoleDetail{
+			Pole:             poles[0],
+			Inspections:      []models.FormData{},
+			ConditionHistory: []models.PoleConditionPoint{},
+		}
+		for _, inspection := range inspections {
+			detail.Inspections = append(detail.Inspections, inspection)
+			detail.ConditionHistory = append(detail.ConditionHistory, models.PoleConditionPoint{
+				InspectionID: inspection.ID,
+				Condition:    inspection.SelectPoleStatus,
+				Surveyor:     inspection.Surveyor,
+				InspectedAt:  inspection.CreatedAt,
+			})
+		}
+		writeJSON(w, http.StatusOK, detail)
+	}
+}
@@ -0,0 +1,382 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github/rabinam24/userform/models"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/minio/minio-go/v7"
+)
+
+// Resumable uploads let a client push an image in fixed-size chunks that
+// are staged as parts of a MinIO multipart upload. A dropped connection only
+// costs the chunk in flight: the client asks for the upload status and
+// resends whatever is missing. Once complete, the upload ID can be
+// referenced from /submit-form instead of embedding the image bytes.
+//
+//	POST   /api/uploads                   {"filename": "...", "size": N}
+//	GET    /api/uploads/{id}              status and received chunk numbers
+//	PUT    /api/uploads/{id}/chunks/{n}   body is chunk n (1-based)
+//	POST   /api/uploads/{id}/complete     assemble the object
+//	DELETE /api/uploads/{id}              abandon the upload
+
+// HandleUploadInit starts a new resumable upload.
+func HandleUploadInit(db *sql.DB, minioClient *minio.Client, bucketName string, limits models.UploadConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Filename string `json:"filename"`
+			Size     int64  `json:"size"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if req.Size <= 0 {
+			http.Error(w, "Size must be positive", http.StatusBadRequest)
+			return
+		}
+		if req.Size > limits.MaxImageBytes {
+			http.Error(w, fmt.Sprintf("Image exceeds %d bytes", limits.MaxImageBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		session := models.UploadSession{
+			ID:        uuid.NewString(),
+			Size:      req.Size,
+			ChunkSize: int64(limits.PartSize),
+			CreatedAt: time.Now(),
+		}
+		session.ObjectName = fmt.Sprintf("tmp/%d-upload-%s%s", session.CreatedAt.UnixNano(), session.ID, imageExt(req.Filename))
+		session.TotalChunks = chunkCount(session.Size, session.ChunkSize)
+
+		core := minio.Core{Client: minioClient}
+		uploadID, err := core.NewMultipartUpload(r.Context(), bucketName, session.ObjectName, minio.PutObjectOptions{
+			ContentType: contentTypeFor(session.ObjectName),
+		})
+		if err != nil {
+			log.Printf("Error starting multipart upload: %v", err)
+			http.Error(w, "Failed to start upload", http.StatusInternalServerError)
+			return
+		}
+		session.UploadID = uploadID
+
+		query := `INSERT INTO uploads (id, object_name, upload_id, size, chunk_size, created_at) VALUES ($1, $2, $3, $4, $5, $6)`
+		if _, err := db.Exec(query, session.ID, session.ObjectName, session.UploadID, session.Size, session.ChunkSize, session.CreatedAt); err != nil {
+			log.Printf("Error saving upload session: %v", err)
+			core.AbortMultipartUpload(context.Background(), bucketName, session.ObjectName, uploadID)
+			http.Error(w, "Failed to start upload", http.StatusInternalServerError)
+			return
+		}
+
+		session.Received = []int{}
+		writeJSON(w, http.StatusCreated, session)
+	}
+}
+
+// HandleUploadStatus reports which chunks of an upload have been received.
+func HandleUploadStatus(db *sql.DB, minioClient *minio.Client, bucketName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, err := GetUploadSession(db, r.PathValue("id"))
+		if err != nil {
+			log.Printf("Error loading upload session: %v", err)
+			http.Error(w, "Failed to load upload", http.StatusInternalServerError)
+			return
+		}
+		if session == nil {
+			http.Error(w, "Upload not found", http.StatusNotFound)
+			return
+		}
+
+		session.Received = []int{}
+		if session.Completed {
+			for n := 1; n <= session.TotalChunks; n++ {
+				session.Received = append(session.Received, n)
+			}
+		} else {
+			parts, err := listUploadedParts(r.Context(), minioClient, bucketName, session)
+			if err != nil {
+				log.Printf("Error listing uploaded parts: %v", err)
+				http.Error(w, "Failed to load upload", http.StatusInternalServerError)
+				return
+			}
+			for _, part := range parts {
+				session.Received = append(session.Received, part.PartNumber)
+			}
+		}
+
+		writeJSON(w, http.StatusOK, session)
+	}
+}
+
+// HandleUploadChunk stores one chunk of an upload. Chunks may arrive in any
+// order and resending a chunk simply replaces it.
+func HandleUploadChunk(db *sql.DB, minioClient *minio.Client, bucketName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, err := GetUploadSession(db, r.PathValue("id"))
+		if err != nil {
+			log.Printf("Error loading upload session: %v", err)
+			http.Error(w, "Failed to load upload", http.StatusInternalServerError)
+			return
+		}
+		if session == nil {
+			http.Error(w, "Upload not found", http.StatusNotFound)
+			return
+		}
+		if session.Completed {
+			http.Error(w, "Upload is already complete", http.StatusConflict)
+			return
+		}
+
+		n, err := strconv.Atoi(r.PathValue("n"))
+		if err != nil || n < 1 || n > session.TotalChunks {
+			http.Error(w, fmt.Sprintf("Chunk number must be between 1 and %d", session.TotalChunks), http.StatusBadRequest)
+			return
+		}
+
+		expected := session.ChunkSize
+		if n == session.TotalChunks {
+			expected = session.Size - int64(n-1)*session.ChunkSize
+		}
+		if r.ContentLength != expected {
+			http.Error(w, fmt.Sprintf("Chunk %d must be exactly %d bytes", n, expected), http.StatusBadRequest)
+			return
+		}
+		body := http.MaxBytesReader(w, r.Body, expected)
+
+		core := minio.Core{Client: minioClient}
+		part, err := core.PutObjectPart(r.Context(), bucketName, session.ObjectName, session.UploadID, n, body, expected, minio.PutObjectPartOptions{})
+		if err != nil {
+			log.Printf("Error uploading chunk %d of %s: %v", n, session.ID, err)
+			http.Error(w, "Failed to store chunk", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"chunk": part.PartNumber,
+			"size":  part.Size,
+		})
+	}
+}
+
+// HandleUploadComplete assembles the received chunks into the final object.
+// The stored image is held by a provisional reference until a row using the
+// upload is saved (see claimUploads).
+func HandleUploadComplete(db *sql.DB, minioClient *minio.Client, bucketName string, endpoint string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, err := GetUploadSession(db, r.PathValue("id"))
+		if err != nil {
+			log.Printf("Error loading upload session: %v", err)
+			http.Error(w, "Failed to load upload", http.StatusInternalServerError)
+			return
+		}
+		if session == nil {
+			http.Error(w, "Upload not found", http.StatusNotFound)
+			return
+		}
+		if session.Completed {
+			writeJSON(w, http.StatusOK, session)
+			return
+		}
+
+		parts, err := listUploadedParts(r.Context(), minioClient, bucketName, session)
+		if err != nil {
+			log.Printf("Error listing uploaded parts: %v", err)
+			http.Error(w, "Failed to complete upload", http.StatusInternalServerError)
+			return
+		}
+		if len(parts) != session.TotalChunks {
+			http.Error(w, fmt.Sprintf("Received %d of %d chunks", len(parts), session.TotalChunks), http.StatusConflict)
+			return
+		}
+
+		completeParts := make([]minio.CompletePart, len(parts))
+		for i, part := range parts {
+			completeParts[i] = minio.CompletePart{PartNumber: part.PartNumber, ETag: part.ETag}
+		}
+
+		core := minio.Core{Client: minioClient}
+		if _, err := core.CompleteMultipartUpload(r.Context(), bucketName, session.ObjectName, session.UploadID, completeParts, minio.PutObjectOptions{}); err != nil {
+			log.Printf("Error completing multipart upload %s: %v", session.ID, err)
+			http.Error(w, "Failed to complete upload", http.StatusInternalServerError)
+			return
+		}
+
+		// Move the assembled object to its content-addressed key
+		uploaded, err := HashObject(r.Context(), minioClient, endpoint, bucketName, session.ObjectName)
+		if err != nil {
+			log.Printf("Error hashing upload %s: %v", session.ID, err)
+			http.Error(w, "Failed to complete upload", http.StatusInternalServerError)
+			return
+		}
+		stored, _, err := StoreContentAddressed(r.Context(), db, minioClient, endpoint, bucketName, uploaded)
+		if err != nil {
+			log.Printf("Error storing upload %s: %v", session.ID, err)
+			http.Error(w, "Failed to complete upload", http.StatusInternalServerError)
+			return
+		}
+
+		completedAt := time.Now()
+		session.Completed = true
+		session.CompletedAt = &completedAt
+		session.ObjectName = stored.Name
+		session.URL = stored.URL
+
+		query := `UPDATE uploads SET completed = TRUE, object_name = $1, url = $2, sha256 = $3, completed_at = $4 WHERE id = $5`
+		if _, err := db.Exec(query, session.ObjectName, session.URL, stored.SHA256, completedAt, session.ID); err != nil {
+			log.Printf("Error marking upload %s complete: %v", session.ID, err)
+			http.Error(w, "Failed to complete upload", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, session)
+	}
+}
+
+// HandleUploadAbort discards an unfinished upload and its staged chunks.
+func HandleUploadAbort(db *sql.DB, minioClient *minio.Client, bucketName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, err := GetUploadSession(db, r.PathValue("id"))
+		if err != nil {
+			log.Printf("Error loading upload session: %v", err)
+			http.Error(w, "Failed to load upload", http.StatusInternalServerError)
+			return
+		}
+		if session == nil {
+			http.Error(w, "Upload not found", http.StatusNotFound)
+			return
+		}
+		if session.Completed {
+			http.Error(w, "Upload is already complete", http.StatusConflict)
+			return
+		}
+
+		core := minio.Core{Client: minioClient}
+		if err := core.AbortMultipartUpload(r.Context(), bucketName, session.ObjectName, session.UploadID); err != nil {
+			log.Printf("Error aborting multipart upload %s: %v", session.ID, err)
+		}
+
+		if _, err := db.Exec(`DELETE FROM uploads WHERE id = $1`, session.ID); err != nil {
+			log.Printf("Error deleting upload session %s: %v", session.ID, err)
+			http.Error(w, "Failed to abort upload", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Upload aborted"))
+	}
+}
+
+// GetUploadSession loads an upload session, returning nil if it does not exist.
+func GetUploadSession(db *sql.DB, id string) (*models.UploadSession, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, nil
+	}
+
+	query := `SELECT id, object_name, upload_id, size, chunk_size, completed, url, created_at, completed_at FROM uploads WHERE id = $1`
+	var session models.UploadSession
+	var uploadURL sql.NullString
+	err := db.QueryRow(query, id).Scan(&session.ID, &session.ObjectName, &session.UploadID, &session.Size, &session.ChunkSize,
+		&session.Completed, &uploadURL, &session.CreatedAt, &session.CompletedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to retrieve upload session: %w", err)
+	}
+
+	session.URL = uploadURL.String
+	session.TotalChunks = chunkCount(session.Size, session.ChunkSize)
+	return &session, nil
+}
+
+// resolveUploadReferences attaches previously completed uploads referenced by
+// the poleimage_id and multipleimage_ids form fields to formData, noting
+// them in its UploadIDs for InsertData to claim.
+func resolveUploadReferences(db *sql.DB, formData *models.FormData, fields url.Values) error {
+	resolve := func(id string) (string, error) {
+		session, err := GetUploadSession(db, id)
+		if err != nil {
+			return "", err
+		}
+		if session == nil || !session.Completed {
+			return "", &formError{http.StatusBadRequest, fmt.Sprintf("Upload %s is unknown or incomplete", id)}
+		}
+		formData.UploadIDs = append(formData.UploadIDs, id)
+		return session.URL, nil
+	}
+
+	if id := fields.Get("poleimage_id"); id != "" {
+		if formData.PoleImage != "" {
+			return &formError{http.StatusBadRequest, "Send either poleimage or poleimage_id, not both"}
+		}
+		imageURL, err := resolve(id)
+		if err != nil {
+			return err
+		}
+		formData.PoleImage = imageURL
+	}
+
+	for _, id := range fields["multipleimage_ids"] {
+		imageURL, err := resolve(id)
+		if err != nil {
+			return err
+		}
+		formData.MultipleImages = append(formData.MultipleImages, imageURL)
+	}
+
+	return nil
+}
+
+// claimUploads gives up the provisional references the given completed
+// uploads took on their images, now that rows saved in tx reference those
+// images for real. An upload gives its reference up once, however many
+// rows use it; one never claimed keeps it until the reference lapses.
+func claimUploads(tx *sql.Tx, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := tx.Exec(`WITH claimed AS (
+			UPDATE uploads SET claimed = TRUE WHERE id = ANY($1::uuid[]) AND completed AND NOT claimed RETURNING sha256)
+		UPDATE images i SET pending = GREATEST(i.pending - c.n, 0)
+		FROM (SELECT sha256, COUNT(*) AS n FROM claimed GROUP BY sha256) c
+		WHERE i.sha256 = c.sha256`, pq.Array(ids))
+	if err != nil {
+		return fmt.Errorf("failed to claim uploads: %w", err)
+	}
+	return nil
+}
+
+// listUploadedParts returns the parts staged so far, ordered by part number.
+func listUploadedParts(ctx context.Context, minioClient *minio.Client, bucketName string, session *models.UploadSession) ([]minio.ObjectPart, error) {
+	core := minio.Core{Client: minioClient}
+	var parts []minio.ObjectPart
+	marker := 0
+	for {
+		result, err := core.ListObjectParts(ctx, bucketName, session.ObjectName, session.UploadID, marker, 1000)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list parts: %w", err)
+		}
+		parts = append(parts, result.ObjectParts...)
+		if !result.IsTruncated {
+			break
+		}
+		marker = result.NextPartNumberMarker
+	}
+
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+	return parts, nil
+}
+
+func chunkCount(size, chunkSize int64) int {
+	return int((size + chunkSize - 1) / chunkSize)
+}
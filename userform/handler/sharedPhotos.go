@@ -0,0 +1,54 @@
+package handler
+
+import (
+	"database/sql"
+	"github/rabinam24/userform/models"
+	"log"
+	"net/http"
+
+	"github.com/lib/pq"
+)
+
+// HandleSharedPhotosReport lists images attached to more than one survey.
+// Distinct surveys sharing an identical photo usually means one was
+// copied from the other.
+func HandleSharedPhotosReport(db *sql.DB, bucketName string, endpoint string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := `
+		SELECT ui.sha256, i.object_name, array_agg(DISTINCT ui.userform_id ORDER BY ui.userform_id)
+		FROM userform_images ui
+		JOIN images i ON i.sha256 = ui.sha256
+		GROUP BY ui.sha256, i.object_name
+		HAVING COUNT(DISTINCT ui.userform_id) > 1
+		ORDER BY COUNT(DISTINCT ui.userform_id) DESC, ui.sha256`
+
+		rows, err := db.Query(query)
+		if err != nil {
+			log.Printf("Error querying shared photos: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		report := []models.SharedPhoto{}
+		for rows.Next() {
+			var photo models.SharedPhoto
+			var objectName string
+			if err := rows.Scan(&photo.SHA256, &objectName, pq.Array(&photo.Submissions)); err != nil {
+				log.Printf("Error scanning row: %v", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			photo.URL = objectURL(endpoint, bucketName, objectName)
+			report = append(report, photo)
+		}
+
+		if err := rows.Err(); err != nil {
+			log.Printf("Row iteration error: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, report)
+	}
+}
@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"database/sql"
+	"github/rabinam24/userform/geo"
+	"github/rabinam24/userform/models"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+// usePostGIS is set when userform and poles have their PostGIS geography
+// columns. Distance and box lookups, the duplicate scan included, then go
+// to their GiST indexes; otherwise they are answered in memory (see
+// poleIndex and poleLocationCache). Vector tiles always are (see poleTile).
+var usePostGIS bool
+
+// SetPostGIS tells spatial lookups whether the PostGIS columns can be used.
+// Call it before serving.
+func SetPostGIS(enabled bool) {
+	usePostGIS = enabled
+}
+
+// poleCellDegrees is the cell size of the pole location index.
+const poleCellDegrees = 0.01
+
+// poleLocationCache keeps where the poles table puts each pole, as of one
+// data version, for nearby lookups without PostGIS. It is loaded from the
+// poles table alone and kept apart from poleIndex, so matching a
+// submission to a pole never waits on rebuilding the map's index.
+var poleLocationCache struct {
+	mu      sync.Mutex
+	version int64
+	poles   *geo.SpatialIndex
+}
+
+// currentPoleLocations returns the pole locations for the current data
+// version, reloading them if needed.
+func currentPoleLocations(db *sql.DB) (*geo.SpatialIndex, error) {
+	version, err := dataVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	poleLocationCache.mu.Lock()
+	defer poleLocationCache.mu.Unlock()
+	if poleLocationCache.poles != nil && poleLocationCache.version == version {
+		return poleLocationCache.poles, nil
+	}
+	poles := geo.NewSpatialIndex(poleCellDegrees)
+	if err := loadPoleLocations(db, poles, nil); err != nil {
+		return nil, err
+	}
+	poleLocationCache.version, poleLocationCache.poles = version, poles
+	return poles, nil
+}
+
+// refreshPoleLocations reloads pole poleID after the change that brought
+// the data to version; see refreshPoleIndex.
+func refreshPoleLocations(db *sql.DB, poleID int, version int64) error {
+	poleLocationCache.mu.Lock()
+	defer poleLocationCache.mu.Unlock()
+	if poleLocationCache.poles == nil || version != poleLocationCache.version+1 {
+		return nil
+	}
+	// Readers may still hold the current index, so a copy is changed.
+	poles := poleLocationCache.poles.Clone()
+	if poleID != 0 {
+		if err := loadPoleLocations(db, poles, []int64{int64(poleID)}); err != nil {
+			return err
+		}
+	}
+	poleLocationCache.version, poleLocationCache.poles = version, poles
+	return nil
+}
+
+// indexedNearbyPoles returns the poles the in-memory location index puts
+// within radius metres of p.
+func indexedNearbyPoles(db *sql.DB, p geo.Point, radius float64) ([]models.Pole, error) {
+	poles, err := currentPoleLocations(db)
+	if err != nil {
+		return nil, err
+	}
+	near := poles.Within(p, radius)
+	if len(near) == 0 {
+		return []models.Pole{}, nil
+	}
+	ids := make([]int64, len(near))
+	for i, n := range near {
+		ids[i] = int64(n.ID)
+	}
+	return queryPoles(db, "WHERE p.id = ANY($1)", pq.Array(ids))
+}
@@ -0,0 +1,141 @@
+package handler
+
+import (
+	"database/sql"
+	"fmt"
+	"github/rabinam24/userform/models"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// statsCacheSize is how many filter combinations are kept.
+const statsCacheSize = 64
+
+var statsIntervals = []string{"day", "week", "month"}
+
+// HandleStats serves the dashboard aggregates, computed in SQL over the
+// submissions matching the list filters (see formDataFilters). ?interval=
+// sets the bucket of the submissions timeline: day (default), week or
+// month. Results are cached until the next survey is stored, changed or
+// deleted.
+func HandleStats(db *sql.DB) http.HandlerFunc {
+	cache := newVersionedCache[*models.Stats](statsCacheSize)
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		var problems fieldErrors
+		interval := query.Get("interval")
+		if interval == "" {
+			interval = "day"
+		}
+		if !isOneOf(interval, statsIntervals) {
+			problems.add("interval", "must be one of: %s", strings.Join(statsIntervals, ", "))
+		}
+		clauses, args := formDataFilters(query, &problems)
+		if err := problems.err(); err != nil {
+			writeFormError(w, err)
+			return
+		}
+
+		version, err := dataVersion(db)
+		if err != nil {
+			log.Printf("Error computing stats: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		query.Set("interval", interval)
+		key := query.Encode()
+		if stats, ok := cache.get(key, version); ok {
+			writeJSON(w, http.StatusOK, stats)
+			return
+		}
+
+		stats, err := computeStats(db, clauses, args, interval)
+		if err != nil {
+			log.Printf("Error computing stats: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		cache.put(key, version, stats)
+		writeJSON(w, http.StatusOK, stats)
+	}
+}
+
+// computeStats runs the aggregates over "FROM userform uf <where>".
+func computeStats(db *sql.DB, where string, args []interface{}, interval string) (*models.Stats, error) {
+	stats := &models.Stats{Interval: interval, GeneratedAt: time.Now()}
+	if err := db.QueryRow(`SELECT COUNT(*) FROM userform uf `+where, args...).Scan(&stats.Total); err != nil {
+		return nil, fmt.Errorf("failed to count submissions: %w", err)
+	}
+
+	counts := []struct {
+		dest   *[]models.StatCount
+		column string
+	}{
+		{&stats.ByPoleType, "uf.selectpole"},
+		{&stats.ByPoleStatus, "uf.selectpolestatus"},
+		{&stats.ByPoleLocation, "uf.selectpolelocation"},
+		{&stats.ByAvailableISP, "uf.availableisp"},
+	}
+	for _, c := range counts {
+		query := fmt.Sprintf(`SELECT COALESCE(%s, ''), COUNT(*) FROM userform uf %s GROUP BY 1 ORDER BY 2 DESC, 1`, c.column, where)
+		var err error
+		if *c.dest, err = queryStatCounts(db, query, args); err != nil {
+			return nil, err
+		}
+	}
+
+	// Catalogue names, so that spellings linked to the same ISP add up.
+	ispQuery := `SELECT COALESCE(i.name, ui.provider), COUNT(DISTINCT uf.id) FROM userform uf
+		JOIN userform_isps ui ON ui.userform_id = uf.id
+		LEFT JOIN isps i ON i.code = ui.isp_code ` + where + ` GROUP BY 1 ORDER BY 2 DESC, 1`
+	var err error
+	if stats.ByISP, err = queryStatCounts(db, ispQuery, args); err != nil {
+		return nil, err
+	}
+
+	periodArgs := append(append([]interface{}{}, args...), interval)
+	periodQuery := fmt.Sprintf(`SELECT date_trunc($%d, uf.created_at)::date, COUNT(*) FROM userform uf %s
+		GROUP BY 1 ORDER BY 1`, len(periodArgs), where)
+	rows, err := db.Query(periodQuery, periodArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count submissions per %s: %w", interval, err)
+	}
+	defer rows.Close()
+	stats.Submissions = []models.StatPeriod{}
+	for rows.Next() {
+		var period time.Time
+		var p models.StatPeriod
+		if err := rows.Scan(&period, &p.Count); err != nil {
+			return nil, fmt.Errorf("failed to scan submissions per %s: %w", interval, err)
+		}
+		p.Period = period.Format(dueDateLayout)
+		stats.Submissions = append(stats.Submissions, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over submissions per %s: %w", interval, err)
+	}
+	return stats, nil
+}
+
+func queryStatCounts(db *sql.DB, query string, args []interface{}) ([]models.StatCount, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate submissions: %w", err)
+	}
+	defer rows.Close()
+
+	counts := []models.StatCount{}
+	for rows.Next() {
+		var c models.StatCount
+		if err := rows.Scan(&c.Value, &c.Count); err != nil {
+			return nil, fmt.Errorf("failed to scan aggregate: %w", err)
+		}
+		counts = append(counts, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over aggregate: %w", err)
+	}
+	return counts, nil
+}
@@ -0,0 +1,233 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github/rabinam24/userform/models"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// maxSyncBatch caps the surveys accepted in one batch.
+	maxSyncBatch = 500
+	// maxSyncChanges caps the changes returned in one response; the client
+	// keeps syncing while has_more is set.
+	maxSyncChanges = 1000
+)
+
+// HandleSyncBatch stores a batch of surveys collected offline and returns
+// the server-side changes since the client's last sync token. Surveys are
+// deduplicated on client_id, so resending a batch is harmless.
+func HandleSyncBatch(db *sql.DB, maxRequestBytes int64, poleRadius float64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxRequestBytes)
+
+		var req models.SyncBatchRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Printf("Error decoding sync batch: %v", err)
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if len(req.Surveys) > maxSyncBatch {
+			http.Error(w, fmt.Sprintf("At most %d surveys per batch", maxSyncBatch), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		since := int64(0)
+		if req.SyncToken != "" {
+			var err error
+			since, err = strconv.ParseInt(req.SyncToken, 10, 64)
+			if err != nil || since < 0 {
+				http.Error(w, "Invalid sync token", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// Changes are read after storing the batch, so the client's own
+		// surveys come back to it with their server IDs.
+		response := models.SyncBatchResponse{Results: make([]models.SyncResult, 0, len(req.Surveys))}
+		for _, survey := range req.Surveys {
+			response.Results = append(response.Results, syncSurvey(db, survey, poleRadius))
+		}
+
+		changes, token, err := changesSince(db, since)
+		if err != nil {
+			log.Printf("Error loading changes since %d: %v", since, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		response.Changes = changes
+		response.SyncToken = strconv.FormatInt(token, 10)
+
+		writeJSON(w, http.StatusOK, response)
+	}
+}
+
+// syncSurvey stores one survey of a batch and reports the outcome.
+func syncSurvey(db *sql.DB, survey models.SyncSurvey, poleRadius float64) models.SyncResult {
+	result := models.SyncResult{ClientID: survey.ClientID}
+	if survey.ClientID == "" {
+		result.Status = "rejected"
+		result.Reason = "client_id is required"
+		return result
+	}
+	if len(survey.ClientID) > 64 {
+		result.Status = "rejected"
+		result.Reason = "client_id is too long"
+		return result
+	}
+
+	formData := survey.FormData
+	formData.PoleImage = ""
+	formData.MultipleImages = nil
+
+	if len(formData.ISPs) == 0 && formData.SelectISP != "" {
+		formData.ISPs = []models.ISPAttachment{{Provider: formData.SelectISP}}
+	}
+
+	fields := url.Values{}
+	if survey.PoleImageID != "" {
+		fields.Set("poleimage_id", survey.PoleImageID)
+	}
+	for _, id := range survey.MultipleImageIDs {
+		fields.Add("multipleimage_ids", id)
+	}
+
+	var candidates []models.NearbyPole
+	err := validateFormData(db, &formData, nil)
+	if err == nil {
+		candidates, err = matchPole(db, &formData, survey.NewPole, survey.ConfirmPole, poleRadius)
+	}
+	if err == nil {
+		err = resolveUploadReferences(db, &formData, fields)
+	}
+	if err == nil {
+		var uploads []string
+		uploads, err = resolveISPs(db, formData.ISPs, nil, nil)
+		formData.UploadIDs = append(formData.UploadIDs, uploads...)
+	}
+	if err == nil {
+		result.Warning, err = linkAssignment(db, &formData)
+	}
+	if err == nil {
+		result.ID, err = InsertData(db, formData)
+	}
+
+	var fe *formError
+	var ve *validationError
+	var proposal *poleProposal
+	switch {
+	case err == nil:
+		result.Status = "created"
+		if len(candidates) > 0 {
+			result.PoleID = formData.PoleID
+			result.ProposedPoles = candidates
+		}
+	case errors.Is(err, ErrDuplicateSubmission):
+		result.Status = "duplicate"
+	case errors.As(err, &proposal):
+		result.Status = "pole_proposed"
+		result.Reason = "close to existing poles; resend with pole_id or new_pole"
+		result.ProposedPoles = proposal.candidates
+	case errors.As(err, &ve):
+		result.Status = "rejected"
+		result.Reason = "validation failed"
+		result.Errors = ve.fields
+	case errors.As(err, &fe):
+		result.Status = "rejected"
+		result.Reason = fe.message
+	default:
+		log.Printf("Error syncing survey %s: %v", survey.ClientID, err)
+		result.Status = "rejected"
+		result.Reason = "internal error, retry later"
+	}
+	return result
+}
+
+// recordChange appends a userform change to the sync log. Sequence numbers
+// are handed out when a change is recorded, not when it commits, so writers
+// take turns until they commit: otherwise a client could be given a token
+// past a change still to commit and skip it for good. Call it as late in
+// the transaction as possible.
+func recordChange(tx *sql.Tx, userformID int, op string) error {
+	if err := lockSyncLog(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO sync_changes (userform_id, op) VALUES ($1, $2)`, userformID, op); err != nil {
+		return fmt.Errorf("failed to record %s of %d: %w", op, userformID, err)
+	}
+	return nil
+}
+
+// lockSyncLog makes tx the only writer of the sync log until it ends; see
+// recordChange. Anything writing sync_changes directly takes it first.
+func lockSyncLog(tx *sql.Tx) error {
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('sync_changes'))`); err != nil {
+		return fmt.Errorf("failed to lock the sync log: %w", err)
+	}
+	return nil
+}
+
+// changesSince collects the latest change per row after sequence number
+// since, and returns the sequence number to use as the next sync token.
+func changesSince(db *sql.DB, since int64) (models.SyncChanges, int64, error) {
+	changes := models.SyncChanges{Upserted: []models.FormData{}, Deleted: []int{}}
+
+	rows, err := db.Query(`SELECT seq, userform_id, op FROM sync_changes WHERE seq > $1 ORDER BY seq LIMIT $2`, since, maxSyncChanges+1)
+	if err != nil {
+		return changes, since, fmt.Errorf("failed to query sync changes: %w", err)
+	}
+	defer rows.Close()
+
+	token := since
+	latest := make(map[int]string)
+	var order []int
+	scanned := 0
+	for rows.Next() {
+		if scanned == maxSyncChanges {
+			changes.HasMore = true
+			break
+		}
+		scanned++
+		var seq int64
+		var id int
+		var op string
+		if err := rows.Scan(&seq, &id, &op); err != nil {
+			return changes, since, fmt.Errorf("failed to scan sync change: %w", err)
+		}
+		if _, seen := latest[id]; !seen {
+			order = append(order, id)
+		}
+		latest[id] = op
+		token = seq
+	}
+	if err := rows.Err(); err != nil {
+		return changes, since, fmt.Errorf("error iterating over sync changes: %w", err)
+	}
+
+	var upserted []int64
+	for _, id := range order {
+		if latest[id] == "delete" {
+			changes.Deleted = append(changes.Deleted, id)
+		} else {
+			upserted = append(upserted, int64(id))
+		}
+	}
+
+	if len(upserted) > 0 {
+		data, err := queryFormData(db, "WHERE uf.id = ANY($1) ORDER BY uf.id", pq.Array(upserted))
+		if err != nil {
+			return changes, since, err
+		}
+		changes.Upserted = append(changes.Upserted, data...)
+	}
+
+	return changes, token, nil
+}
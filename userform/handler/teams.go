@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github/rabinam24/userform/models"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// HandleListTeams lists which team each surveyor is in.
+func HandleListTeams(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query(`SELECT username, team FROM surveyor_teams ORDER BY team, username`)
+		if err != nil {
+			log.Printf("Error listing teams: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		teams := []models.SurveyorTeam{}
+		for rows.Next() {
+			var t models.SurveyorTeam
+			if err := rows.Scan(&t.Username, &t.Team); err != nil {
+				log.Printf("Error scanning team: %v", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			teams = append(teams, t)
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("Error iterating over teams: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, teams)
+	}
+}
+
+// HandleSetSurveyorTeam puts the surveyor in the team given as {"team": ...};
+// an empty team takes them out of theirs.
+func HandleSetSurveyorTeam(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var t models.SurveyorTeam
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		t.Username = r.PathValue("username")
+		t.Team = strings.TrimSpace(t.Team)
+		var problems fieldErrors
+		if len(t.Team) > 100 {
+			problems.add("team", "must be at most 100 characters")
+		}
+		if err := problems.err(); err != nil {
+			writeFormError(w, err)
+			return
+		}
+
+		var err error
+		if t.Team == "" {
+			_, err = db.Exec(`DELETE FROM surveyor_teams WHERE username = $1`, t.Username)
+		} else {
+			_, err = db.Exec(`INSERT INTO surveyor_teams (username, team) VALUES ($1, $2)
+				ON CONFLICT (username) DO UPDATE SET team = EXCLUDED.team`, t.Username, t.Team)
+		}
+		if err != nil {
+			log.Printf("Error setting team of %s: %v", t.Username, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, t)
+	}
+}
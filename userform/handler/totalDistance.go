@@ -3,27 +3,27 @@ package handler
 import (
 	"database/sql"
 	"encoding/json"
-	"github/rabinam24/userform/models"
+	"github/rabinam24/userform/track"
 	"log"
 	"math"
 	"net/http"
 	"time"
 )
 
-func HandleTotalDistances(db *sql.DB) http.HandlerFunc {
+// HandleTotalDistances serves the team's distance for each of the last 7
+// days in server time, as the dashboard chart expects. Each user's distance
+// is measured separately along the track cleaned with opts; see
+// userDailyDistances.
+func HandleTotalDistances(db *sql.DB, opts track.Options) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		query := `SELECT id, latitude, longitude, created_at::date AS date
-		          FROM userform
-		          WHERE created_at >= Now() - INTERVAL '7 days'
-		          ORDER BY date`
-
-		rows, err := db.Query(query)
+		now := time.Now()
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+		daily, err := userDailyDistances(db, today.AddDate(0, 0, -6), today.AddDate(0, 0, 1), time.Local, "", opts)
 		if err != nil {
 			log.Printf("Error while querying the data: %v", err)
 			http.Error(w, "Error while querying the data", http.StatusInternalServerError)
 			return
 		}
-		defer rows.Close()
 
 		type DailyDistance struct {
 			Date     string   `json:"date"`
@@ -31,34 +31,16 @@ func HandleTotalDistances(db *sql.DB) http.HandlerFunc {
 		}
 
 		dailyDistances := make(map[string]float64)
-		var previousData *models.GPSData
-
-		for rows.Next() {
-			var gpsData models.GPSData
-			err := rows.Scan(&gpsData.ID, &gpsData.Latitude, &gpsData.Longitude, &gpsData.Date)
-			if err != nil {
-				log.Printf("Error scanning rows: %v", err)
-				http.Error(w, "Error scanning rows", http.StatusInternalServerError)
-				return
-			}
-
-			dateStr := gpsData.Date.Format("2006-01-02")
-			if previousData != nil && previousData.Date.Format("2006-01-02") == dateStr {
-				dailyDistances[dateStr] += CalculateDistance(previousData.Latitude, previousData.Longitude, gpsData.Latitude, gpsData.Longitude)
+		for _, days := range daily {
+			for date, d := range days {
+				dailyDistances[date] += d.cleaned / 1000
 			}
-			previousData = &gpsData
-		}
-
-		if err := rows.Err(); err != nil {
-			log.Printf("Error iterating over rows: %v", err)
-			http.Error(w, "Error iterating over rows", http.StatusInternalServerError)
-			return
 		}
 
 		// Prepare the response for the last 7 days
 		response := make([]DailyDistance, 7)
 		for i := 0; i < 7; i++ {
-			date := time.Now().AddDate(0, 0, -i).Format("2006-01-02")
+			date := today.AddDate(0, 0, -i).Format("2006-01-02")
 			if distance, found := dailyDistances[date]; found {
 				response[6-i] = DailyDistance{Date: date, Distance: &distance}
 			} else {
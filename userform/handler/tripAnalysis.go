@@ -0,0 +1,148 @@
+package handler
+
+import (
+	"database/sql"
+	"fmt"
+	"github/rabinam24/userform/geo"
+	"github/rabinam24/userform/models"
+	"github/rabinam24/userform/track"
+	"math"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// stopSurveyGrace widens a stop in time when matching surveys to it, as a
+// form is often sent just after the crew moved off.
+const stopSurveyGrace = 2 * time.Minute
+
+type tripSurvey struct {
+	id        int
+	point     geo.Point
+	createdAt time.Time
+}
+
+// tripSurveys returns the submissions username made in [from, to).
+func tripSurveys(db *sql.DB, username string, from, to time.Time) ([]tripSurvey, error) {
+	rows, err := db.Query(`SELECT uf.id, uf.latitude, uf.longitude, uf.created_at
+		FROM userform uf LEFT JOIN users u ON u.id = uf.user_id
+		WHERE COALESCE(uf.surveyor, u.username) = $1 AND uf.created_at >= $2 AND uf.created_at < $3
+		AND uf.latitude IS NOT NULL AND uf.longitude IS NOT NULL
+		ORDER BY uf.created_at, uf.id`, username, toStored(from), toStored(to))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query submissions: %w", err)
+	}
+	defer rows.Close()
+
+	var surveys []tripSurvey
+	for rows.Next() {
+		var s tripSurvey
+		if err := rows.Scan(&s.id, &s.point.Lat, &s.point.Lon, &s.createdAt); err != nil {
+			return nil, fmt.Errorf("failed to scan submission: %w", err)
+		}
+		s.createdAt = fromStored(s.createdAt)
+		surveys = append(surveys, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over submissions: %w", err)
+	}
+	return surveys, nil
+}
+
+// stopOptionsParams lets ?stop_minutes= and ?stop_radius= (metres)
+// override the configured stop definition.
+func stopOptionsParams(query url.Values, stops track.StopOptions, problems *fieldErrors) track.StopOptions {
+	if raw := query.Get("stop_minutes"); raw != "" {
+		minutes, err := strconv.ParseFloat(raw, 64)
+		if err != nil || minutes <= 0 || minutes > 24*60 {
+			problems.add("stop_minutes", "must be a number of minutes between 0 and 1440")
+		} else {
+			stops.MinDwell = time.Duration(minutes * float64(time.Minute))
+		}
+	}
+	if raw := query.Get("stop_radius"); raw != "" {
+		radius, err := strconv.ParseFloat(raw, 64)
+		if err != nil || radius <= 0 || radius > 1000 {
+			problems.add("stop_radius", "must be a number of metres between 0 and 1000")
+		} else {
+			stops.Radius = radius
+		}
+	}
+	return stops
+}
+
+func roundMinutes(d time.Duration) float64 {
+	return math.Round(d.Minutes()*10) / 10
+}
+
+// analyzeTrip finds the stops along fixes and matches surveys to them. A
+// survey goes to the nearest stop within twice the stop radius or, failing
+// that, to the stop it was sent during. Time between the first and last fix
+// not spent at a stop counts as moving.
+func analyzeTrip(fixes []track.Fix, surveys []tripSurvey, opts track.Options, stopOpts track.StopOptions) *models.TripAnalysis {
+	analysis := &models.TripAnalysis{
+		StopMinDwellMinutes: stopOpts.MinDwell.Minutes(),
+		StopRadius:          stopOpts.Radius,
+		Stops:               []models.TripStop{},
+	}
+	// Jitter is what a stop is made of, so only outliers are cleaned out.
+	opts.NoiseRadius = 0
+	fixes = track.Clean(fixes, opts)
+	stops := track.DetectStops(fixes, stopOpts)
+
+	matched := make([][]int, len(stops))
+	for _, s := range surveys {
+		best := -1
+		bestDistance := 2 * stopOpts.Radius
+		for i, stop := range stops {
+			if d := geo.DistanceMeters(stop.Point(), s.point); d <= bestDistance {
+				best, bestDistance = i, d
+			}
+		}
+		if best < 0 {
+			for i, stop := range stops {
+				if !s.createdAt.Before(stop.Start.Add(-stopSurveyGrace)) && !s.createdAt.After(stop.End.Add(stopSurveyGrace)) {
+					best = i
+					break
+				}
+			}
+		}
+		if best < 0 {
+			analysis.SurveysElsewhere++
+			continue
+		}
+		matched[best] = append(matched[best], s.id)
+		analysis.SurveysAtStops++
+	}
+
+	var stopped, productive, unproductive time.Duration
+	for i, stop := range stops {
+		stopped += stop.Duration()
+		if len(matched[i]) == 0 {
+			unproductive += stop.Duration()
+			analysis.UnproductiveStops++
+			matched[i] = []int{}
+		} else {
+			productive += stop.Duration()
+		}
+		analysis.Stops = append(analysis.Stops, models.TripStop{
+			Latitude:  stop.Lat,
+			Longitude: stop.Lon,
+			StartedAt: stop.Start,
+			EndedAt:   stop.End,
+			Minutes:   roundMinutes(stop.Duration()),
+			SurveyIDs: matched[i],
+		})
+	}
+	if len(fixes) > 1 {
+		total := fixes[len(fixes)-1].Time.Sub(fixes[0].Time)
+		analysis.MovingMinutes = roundMinutes(total - stopped)
+	}
+	analysis.StoppedMinutes = roundMinutes(stopped)
+	analysis.UnproductiveMinutes = roundMinutes(unproductive)
+	if analysis.SurveysAtStops > 0 {
+		perPole := math.Round(productive.Minutes()/float64(analysis.SurveysAtStops)*10) / 10
+		analysis.AvgMinutesPerPole = &perPole
+	}
+	return analysis
+}
@@ -0,0 +1,179 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github/rabinam24/userform/live"
+	"github/rabinam24/userform/models"
+	"log"
+	"time"
+)
+
+// lastSubmissionSQL is the time of the latest submission by the surveyor in
+// column %[1]s made since %[2]s.
+const lastSubmissionSQL = `(SELECT MAX(uf.created_at) FROM userform uf LEFT JOIN users u ON u.id = uf.user_id
+	WHERE COALESCE(uf.surveyor, u.username) = %[1]s AND uf.created_at >= %[2]s)`
+
+// StartTripCloser ends, every interval, the trips surveyors forgot to end;
+// see closeStaleTrips.
+func StartTripCloser(ctx context.Context, db *sql.DB, inactivity time.Duration, endOfDay bool, interval time.Duration) {
+	if interval <= 0 || (inactivity <= 0 && !endOfDay) {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if closed, err := closeStaleTrips(db, time.Now(), inactivity, endOfDay); err != nil {
+				log.Printf("Error closing stale trips: %v", err)
+			} else if closed > 0 {
+				log.Printf("Closed %d stale trips", closed)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// staleTripReason tells why a trip last active at lastActivity should be
+// ended at now, or "" if it should not.
+func staleTripReason(lastActivity, now time.Time, inactivity time.Duration, endOfDay bool) string {
+	if inactivity > 0 && now.Sub(lastActivity) >= inactivity {
+		return tripEndInactive
+	}
+	if endOfDay {
+		y1, m1, d1 := lastActivity.Date()
+		y2, m2, d2 := now.Date()
+		if y1 != y2 || m1 != m2 || d1 != d2 {
+			return tripEndOfDay
+		}
+	}
+	return ""
+}
+
+// closeStaleTrips ends the open trips with no GPS point or submission for
+// inactivity, or whose last activity was on an earlier day (server time)
+// when endOfDay is set. A trip ends at its last activity, with the reason
+// recorded for the surveyor to be told at their next login. Trips started
+// before trip_sessions existed are only ended in trip. It returns how many
+// trips were ended.
+func closeStaleTrips(db *sql.DB, now time.Time, inactivity time.Duration, endOfDay bool) (int, error) {
+	type staleTrip struct {
+		id           int
+		username     string
+		lastActivity time.Time
+	}
+	rows, err := db.Query(`SELECT s.id, s.username, GREATEST(s.started_at,
+			(SELECT MAX(p.recorded_at) FROM trip_points p WHERE p.trip_id = s.id),
+			` + fmt.Sprintf(lastSubmissionSQL, "s.username", "s.started_at") + `)
+		FROM trip_sessions s WHERE s.ended_at IS NULL
+		UNION ALL
+		SELECT 0, t.username, GREATEST(t.trip_start_time, ` + fmt.Sprintf(lastSubmissionSQL, "t.username", "t.trip_start_time") + `)
+		FROM trip t WHERE t.trip_started AND t.trip_start_time IS NOT NULL
+		AND NOT EXISTS (SELECT 1 FROM trip_sessions s WHERE s.username = t.username AND s.ended_at IS NULL)`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query open trips: %w", err)
+	}
+	defer rows.Close()
+
+	var stale []staleTrip
+	var reasons []string
+	for rows.Next() {
+		var t staleTrip
+		if err := rows.Scan(&t.id, &t.username, &t.lastActivity); err != nil {
+			return 0, fmt.Errorf("failed to scan open trip: %w", err)
+		}
+		t.lastActivity = fromStored(t.lastActivity)
+		if reason := staleTripReason(t.lastActivity, now, inactivity, endOfDay); reason != "" {
+			stale = append(stale, t)
+			reasons = append(reasons, reason)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error iterating over open trips: %w", err)
+	}
+	rows.Close()
+
+	closed := 0
+	for i, t := range stale {
+		ok, err := closeTrip(db, t.id, t.username, t.lastActivity, reasons[i])
+		if err != nil {
+			return closed, err
+		}
+		if ok {
+			closed++
+		}
+	}
+	return closed, nil
+}
+
+// closeTrip ends trip id of username, if it is still open, at endedAt for
+// reason, along with the user's state in trip. An id of 0 ends only the
+// state in trip. The original start time is cleared too, so the next trip
+// counts its elapsed time from its own start rather than from a trip left
+// running days ago. It reports whether anything was ended.
+func closeTrip(db *sql.DB, id int, username string, endedAt time.Time, reason string) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if id != 0 {
+		res, err := tx.Exec(`UPDATE trip_sessions SET ended_at = $2, end_reason = $3 WHERE id = $1 AND ended_at IS NULL`,
+			id, toStored(endedAt), reason)
+		if err != nil {
+			return false, fmt.Errorf("failed to end trip %d: %w", id, err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return false, nil
+		}
+	}
+	res, err := tx.Exec(`UPDATE trip SET trip_started = false, trip_end_time = $2, original_trip_start_time = NULL WHERE username = $1 AND trip_started`,
+		username, toStored(endedAt))
+	if err != nil {
+		return false, fmt.Errorf("failed to end trip state of %s: %w", username, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 && id == 0 {
+		return false, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit end of trip of %s: %w", username, err)
+	}
+
+	log.Printf("Ended trip of %s at %v: %s", username, endedAt, reason)
+	if id != 0 {
+		publishLive(db, live.EventTripEnded, username, models.LiveTrip{TripID: id, At: endedAt})
+	}
+	return true, nil
+}
+
+// takeAutoEndedTrips returns the trips of username that were ended for
+// them and not yet reported, and marks them reported.
+func takeAutoEndedTrips(db *sql.DB, username string) ([]models.AutoEndedTrip, error) {
+	rows, err := db.Query(`UPDATE trip_sessions SET end_notified_at = $2
+		WHERE username = $1 AND end_reason IN ($3, $4) AND end_notified_at IS NULL
+		RETURNING id, started_at, ended_at, end_reason`, username, time.Now(), tripEndInactive, tripEndOfDay)
+	if err != nil {
+		return nil, fmt.Errorf("failed to take auto-ended trips of %s: %w", username, err)
+	}
+	defer rows.Close()
+
+	var trips []models.AutoEndedTrip
+	for rows.Next() {
+		var t models.AutoEndedTrip
+		if err := rows.Scan(&t.TripID, &t.StartedAt, &t.EndedAt, &t.EndReason); err != nil {
+			return nil, fmt.Errorf("failed to scan auto-ended trip: %w", err)
+		}
+		t.StartedAt, t.EndedAt = fromStored(t.StartedAt), fromStored(t.EndedAt)
+		trips = append(trips, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over auto-ended trips: %w", err)
+	}
+	return trips, nil
+}
@@ -0,0 +1,215 @@
+package handler
+
+import (
+	"database/sql"
+	"fmt"
+	"github/rabinam24/userform/track"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxTrackExportDays bounds the range of one user track export.
+const maxTrackExportDays = 31
+
+var trackExportFormats = []string{"gpx", "fit"}
+
+// surveyWaypoints returns the submissions username made in [from, to) as
+// waypoints named by pole type and status.
+func surveyWaypoints(db *sql.DB, username string, from, to time.Time) ([]track.Waypoint, error) {
+	rows, err := db.Query(`SELECT uf.id, uf.latitude, uf.longitude, uf.created_at,
+			COALESCE(uf.selectpole, ''), COALESCE(uf.selectpolestatus, ''), COALESCE(uf.location, ''), uf.pole_id
+		FROM userform uf LEFT JOIN users u ON u.id = uf.user_id
+		WHERE COALESCE(uf.surveyor, u.username) = $1 AND uf.created_at >= $2 AND uf.created_at < $3
+		AND uf.latitude IS NOT NULL AND uf.longitude IS NOT NULL
+		ORDER BY uf.created_at, uf.id`, username, toStored(from), toStored(to))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query submissions: %w", err)
+	}
+	defer rows.Close()
+
+	var waypoints []track.Waypoint
+	for rows.Next() {
+		var id int
+		var poleType, poleStatus, location string
+		var poleID sql.NullInt64
+		var wp track.Waypoint
+		if err := rows.Scan(&id, &wp.Lat, &wp.Lon, &wp.Time, &poleType, &poleStatus, &location, &poleID); err != nil {
+			return nil, fmt.Errorf("failed to scan submission: %w", err)
+		}
+		wp.Time = fromStored(wp.Time)
+		var name []string
+		for _, part := range []string{poleType, poleStatus} {
+			if part = strings.TrimSpace(part); part != "" {
+				name = append(name, part)
+			}
+		}
+		wp.Name = strings.Join(name, " - ")
+		if wp.Name == "" {
+			wp.Name = fmt.Sprintf("Survey %d", id)
+		}
+		wp.Description = fmt.Sprintf("Survey %d", id)
+		if poleID.Valid {
+			wp.Description += fmt.Sprintf(", pole %d", poleID.Int64)
+		}
+		if location != "" {
+			wp.Description += ", " + location
+		}
+		wp.Type = "pole"
+		waypoints = append(waypoints, wp)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over submissions: %w", err)
+	}
+	return waypoints, nil
+}
+
+// cleanedParam reads ?cleaned=, which exports the cleaned track instead of
+// every recorded fix.
+func cleanedParam(r *http.Request, problems *fieldErrors) bool {
+	raw := r.URL.Query().Get("cleaned")
+	if raw == "" {
+		return false
+	}
+	cleaned, err := strconv.ParseBool(raw)
+	if err != nil {
+		problems.add("cleaned", "must be true or false")
+	}
+	return cleaned
+}
+
+// writeTrackExport sends tracks as a GPX or FIT download named filename.
+// FIT carries no waypoints.
+func writeTrackExport(w http.ResponseWriter, format, filename, name string, tracks []track.Track, waypoints []track.Waypoint) {
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename + "." + format}))
+	var err error
+	if format == "fit" {
+		w.Header().Set("Content-Type", "application/vnd.ant.fit")
+		err = track.WriteFIT(w, tracks)
+	} else {
+		w.Header().Set("Content-Type", "application/gpx+xml")
+		err = track.WriteGPX(w, name, tracks, waypoints)
+	}
+	if err != nil {
+		log.Printf("Error writing %s export %s: %v", format, filename, err)
+	}
+}
+
+// exportTrip serves /api/trips/{id}.gpx and .fit: the trip's breadcrumbs
+// as a track, and, in GPX, the poles submitted during the trip as
+// waypoints. ?cleaned=true exports the cleaned track.
+func exportTrip(w http.ResponseWriter, r *http.Request, db *sql.DB, opts track.Options, id int, format string) {
+	var problems fieldErrors
+	cleaned := cleanedParam(r, &problems)
+	if err := problems.err(); err != nil {
+		writeFormError(w, err)
+		return
+	}
+
+	trips, fixes, err := loadTrips(db, "WHERE s.id = $1", id)
+	if err != nil {
+		log.Printf("Error loading trip %d: %v", id, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if len(trips) == 0 {
+		http.Error(w, "Trip not found", http.StatusNotFound)
+		return
+	}
+	trip := trips[0]
+	end := time.Now()
+	if trip.EndedAt != nil {
+		end = *trip.EndedAt
+	}
+	waypoints, err := surveyWaypoints(db, trip.Username, trip.StartedAt, end.Add(time.Second))
+	if err != nil {
+		log.Printf("Error loading poles of trip %d: %v", id, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	points := fixes[trip.ID]
+	if cleaned {
+		points = track.Clean(points, opts)
+	}
+	name := fmt.Sprintf("Trip %d by %s, %s", trip.ID, trip.Username, trip.StartedAt.Format(time.DateOnly))
+	writeTrackExport(w, format, fmt.Sprintf("trip-%d", trip.ID), name, []track.Track{{Name: name, Fixes: points}}, waypoints)
+}
+
+// HandleUserTrackExport serves /api/users/{username}/track.gpx and .fit:
+// every trip the user started between ?from= and ?to= (YYYY-MM-DD,
+// inclusive, server time, default today) as one track each, and, in GPX,
+// every pole they submitted in that range as a waypoint. ?cleaned=true
+// exports the cleaned tracks.
+func HandleUserTrackExport(db *sql.DB, opts track.Options) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := r.PathValue("username")
+		format := strings.TrimPrefix(path.Ext(r.URL.Path), ".")
+		if !isOneOf(format, trackExportFormats) {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+
+		query := r.URL.Query()
+		var problems fieldErrors
+		cleaned := cleanedParam(r, &problems)
+		now := time.Now()
+		from := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+		to := from
+		for _, bound := range []struct {
+			name string
+			dest *time.Time
+		}{{"from", &from}, {"to", &to}} {
+			if raw := query.Get(bound.name); raw != "" {
+				day, err := time.ParseInLocation(dueDateLayout, raw, time.Local)
+				if err != nil {
+					problems.add(bound.name, "must be a date like 2006-01-02")
+					continue
+				}
+				*bound.dest = day
+			}
+		}
+		if !problems.has("from") && !problems.has("to") {
+			if to.Before(from) {
+				problems.add("to", "must not be before from")
+			} else if to.Sub(from) > maxTrackExportDays*24*time.Hour {
+				problems.add("from", "range must not exceed %d days", maxTrackExportDays)
+			}
+		}
+		if err := problems.err(); err != nil {
+			writeFormError(w, err)
+			return
+		}
+		end := to.AddDate(0, 0, 1)
+
+		trips, fixes, err := loadTrips(db, "WHERE s.username = $1 AND s.started_at >= $2 AND s.started_at < $3 ORDER BY s.started_at, s.id",
+			username, toStored(from), toStored(end))
+		if err != nil {
+			log.Printf("Error loading trips of %s: %v", username, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		waypoints, err := surveyWaypoints(db, username, from, end)
+		if err != nil {
+			log.Printf("Error loading poles of %s: %v", username, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		tracks := make([]track.Track, len(trips))
+		for i, trip := range trips {
+			points := fixes[trip.ID]
+			if cleaned {
+				points = track.Clean(points, opts)
+			}
+			tracks[i] = track.Track{Name: fmt.Sprintf("Trip %d, %s", trip.ID, trip.StartedAt.Format(time.DateTime)), Fixes: points}
+		}
+		name := fmt.Sprintf("%s, %s to %s", username, from.Format(dueDateLayout), to.Format(dueDateLayout))
+		filename := fmt.Sprintf("%s-%s-%s", username, from.Format(dueDateLayout), to.Format(dueDateLayout))
+		writeTrackExport(w, format, filename, name, tracks, waypoints)
+	}
+}
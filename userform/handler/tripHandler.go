@@ -8,7 +8,6 @@ import (
 	"io"
 	"log"
 	"net/http"
-	"sync"
 	"time"
 )
 
@@ -104,6 +103,12 @@ func HandleStartTrip(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		if err := startTripSession(db, username, tripStartTime); err != nil {
+			log.Printf("Error recording trip of %s: %v", username, err)
+			http.Error(w, "Failed to record trip", http.StatusInternalServerError)
+			return
+		}
+
 		log.Printf("Trip started successfully for username %s at %v", username, tripStartTime)
 
 		w.WriteHeader(http.StatusOK)
@@ -163,20 +168,17 @@ func HandleEndTrip(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		activeTripsMutex.Lock()
-		delete(activeTrips, username)
-		activeTripsMutex.Unlock()
+		if err := endTripSession(db, username, tripEndTime, tripEndManual); err != nil {
+			log.Printf("Error recording end of trip of %s: %v", username, err)
+			http.Error(w, "Failed to record trip", http.StatusInternalServerError)
+			return
+		}
 
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("Trip ended successfully"))
 	}
 }
 
-var (
-	activeTripsMutex sync.Mutex
-	activeTrips      = make(map[string]*time.Time)
-)
-
 func HandleGetTripState(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
@@ -207,6 +209,12 @@ func HandleGetTripState(db *sql.DB) http.HandlerFunc {
 			elapsedTime = time.Since(*existingTrip.OriginalTripStartTime).Milliseconds()
 		}
 
+		// An auto-ended trip has no original start time left.
+		originalTripStartTime := existingTrip.TripStartTime
+		if existingTrip.OriginalTripStartTime != nil {
+			originalTripStartTime = existingTrip.OriginalTripStartTime
+		}
+
 		response := struct {
 			TripStarted           bool      `json:"tripStarted"`
 			TripStartTime         time.Time `json:"tripStartTime"`
@@ -215,7 +223,7 @@ func HandleGetTripState(db *sql.DB) http.HandlerFunc {
 		}{
 			TripStarted:           existingTrip.TripStarted,
 			TripStartTime:         *existingTrip.TripStartTime,
-			OriginalTripStartTime: *existingTrip.OriginalTripStartTime,
+			OriginalTripStartTime: *originalTripStartTime,
 			ElapsedTime:           elapsedTime,
 		}
 
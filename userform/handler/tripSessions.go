@@ -0,0 +1,177 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github/rabinam24/userform/live"
+	"github/rabinam24/userform/models"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxTripPointsPerRequest bounds one breadcrumb upload.
+const maxTripPointsPerRequest = 5000
+
+// Why a trip ended.
+const (
+	tripEndManual   = "manual"     // the surveyor ended it
+	tripEndReplaced = "replaced"   // the surveyor started another one
+	tripEndInactive = "inactive"   // closed after no activity for a while
+	tripEndOfDay    = "end_of_day" // closed once its day was over
+)
+
+// startTripSession opens a new trip for username, linked to their active
+// assignment. A trip left open, say by a client that never ended it, is
+// closed first.
+func startTripSession(db *sql.DB, username string, startedAt time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var leftOpen sql.NullInt64
+	err = tx.QueryRow(`UPDATE trip_sessions SET ended_at = $2, end_reason = $3 WHERE username = $1 AND ended_at IS NULL RETURNING id`,
+		username, startedAt, tripEndReplaced).Scan(&leftOpen)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to close open trip of %s: %w", username, err)
+	}
+	query := `INSERT INTO trip_sessions (username, assignment_id, started_at)
+		VALUES ($1, (SELECT a.id FROM assignments a JOIN assignment_surveyors s ON s.assignment_id = a.id
+			WHERE s.username = $1 AND a.status = 'active' ` + activeAssignmentOrder + ` LIMIT 1), $2)
+		RETURNING id`
+	var tripID int
+	if err := tx.QueryRow(query, username, startedAt).Scan(&tripID); err != nil {
+		return fmt.Errorf("failed to start trip of %s: %w", username, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit trip of %s: %w", username, err)
+	}
+	if leftOpen.Valid {
+		publishLive(db, live.EventTripEnded, username, models.LiveTrip{TripID: int(leftOpen.Int64), At: startedAt})
+	}
+	publishLive(db, live.EventTripStarted, username, models.LiveTrip{TripID: tripID, At: startedAt})
+	return nil
+}
+
+// endTripSession closes the open trip of username, if any, for reason.
+func endTripSession(db *sql.DB, username string, endedAt time.Time, reason string) error {
+	rows, err := db.Query(`UPDATE trip_sessions SET ended_at = $2, end_reason = $3 WHERE username = $1 AND ended_at IS NULL RETURNING id`,
+		username, endedAt, reason)
+	if err != nil {
+		return fmt.Errorf("failed to end trip of %s: %w", username, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tripID int
+		if err := rows.Scan(&tripID); err != nil {
+			return fmt.Errorf("failed to scan ended trip of %s: %w", username, err)
+		}
+		publishLive(db, live.EventTripEnded, username, models.LiveTrip{TripID: tripID, At: endedAt})
+	}
+	return rows.Err()
+}
+
+// HandleTripPoints records GPS breadcrumbs for the user's trip in progress.
+func HandleTripPoints(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req models.TripPointsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		var problems fieldErrors
+		req.Username = strings.TrimSpace(req.Username)
+		if req.Username == "" {
+			problems.add("username", "is required")
+		}
+		if len(req.Points) == 0 || len(req.Points) > maxTripPointsPerRequest {
+			problems.add("points", "must hold 1-%d points", maxTripPointsPerRequest)
+		}
+		for i, p := range req.Points {
+			field := fmt.Sprintf("points[%d]", i)
+			switch {
+			case math.IsNaN(p.Latitude) || p.Latitude < -90 || p.Latitude > 90:
+				problems.add(field+".latitude", "must be between -90 and 90")
+			case math.IsNaN(p.Longitude) || p.Longitude < -180 || p.Longitude > 180:
+				problems.add(field+".longitude", "must be between -180 and 180")
+			case p.Latitude == 0 && p.Longitude == 0:
+				problems.add(field, "has no GPS fix")
+			case p.RecordedAt.IsZero():
+				problems.add(field+".recorded_at", "is required")
+			}
+		}
+		if err := problems.err(); err != nil {
+			writeFormError(w, err)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Error beginning transaction: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		var tripID int
+		err = tx.QueryRow(`SELECT id FROM trip_sessions WHERE username = $1 AND ended_at IS NULL`, req.Username).Scan(&tripID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "No trip in progress", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("Error looking up trip of %s: %v", req.Username, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		stmt, err := tx.Prepare(`INSERT INTO trip_points (trip_id, latitude, longitude, accuracy, recorded_at) VALUES ($1, $2, $3, $4, $5)`)
+		if err != nil {
+			log.Printf("Error preparing trip point insert: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer stmt.Close()
+		for _, p := range req.Points {
+			var accuracy sql.NullFloat64
+			if p.Accuracy != nil {
+				accuracy = sql.NullFloat64{Float64: *p.Accuracy, Valid: true}
+			}
+			if _, err := stmt.Exec(tripID, p.Latitude, p.Longitude, accuracy, p.RecordedAt.Local()); err != nil {
+				log.Printf("Error recording trip point of trip %d: %v", tripID, err)
+				http.Error(w, "Failed to record trip points", http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("Error committing trip points of trip %d: %v", tripID, err)
+			http.Error(w, "Failed to record trip points", http.StatusInternalServerError)
+			return
+		}
+
+		latest := req.Points[0]
+		for _, p := range req.Points[1:] {
+			if p.RecordedAt.After(latest.RecordedAt) {
+				latest = p
+			}
+		}
+		publishLive(db, live.EventPosition, req.Username, models.LivePosition{
+			TripID:     tripID,
+			Latitude:   latest.Latitude,
+			Longitude:  latest.Longitude,
+			Accuracy:   latest.Accuracy,
+			RecordedAt: latest.RecordedAt,
+		})
+
+		writeJSON(w, http.StatusOK, struct {
+			TripID   int `json:"trip_id"`
+			Recorded int `json:"recorded"`
+		}{tripID, len(req.Points)})
+	}
+}
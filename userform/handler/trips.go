@@ -0,0 +1,226 @@
+package handler
+
+import (
+	"database/sql"
+	"fmt"
+	"github/rabinam24/userform/models"
+	"github/rabinam24/userform/track"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// maxTripsListed bounds one trip listing.
+const maxTripsListed = 500
+
+// distance is a length in metres, measured along the fixes as recorded and
+// along the cleaned track.
+type distance struct {
+	raw     float64
+	cleaned float64
+}
+
+func (d *distance) add(other distance) {
+	d.raw += other.raw
+	d.cleaned += other.cleaned
+}
+
+// measureTrack measures fixes raw and cleaned with opts.
+func measureTrack(fixes []track.Fix, opts track.Options) distance {
+	return distance{raw: track.Distance(fixes), cleaned: track.Distance(track.Clean(fixes, opts))}
+}
+
+// tripFixes loads the breadcrumbs of the given trips, in time order.
+func tripFixes(db *sql.DB, ids []int) (map[int][]track.Fix, error) {
+	rows, err := db.Query(`SELECT trip_id, recorded_at, latitude, longitude, COALESCE(accuracy, 0)
+		FROM trip_points WHERE trip_id = ANY($1) ORDER BY trip_id, recorded_at, id`, pq.Array(ids))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query trip points: %w", err)
+	}
+	defer rows.Close()
+
+	fixes := make(map[int][]track.Fix)
+	for rows.Next() {
+		var tripID int
+		var f track.Fix
+		if err := rows.Scan(&tripID, &f.Time, &f.Lat, &f.Lon, &f.Accuracy); err != nil {
+			return nil, fmt.Errorf("failed to scan trip point: %w", err)
+		}
+		f.Time = fromStored(f.Time)
+		fixes[tripID] = append(fixes[tripID], f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over trip points: %w", err)
+	}
+	return fixes, nil
+}
+
+// loadTrips loads the trips matching clauses, unmeasured, and their
+// breadcrumbs.
+func loadTrips(db *sql.DB, clauses string, args ...interface{}) ([]models.Trip, map[int][]track.Fix, error) {
+	rows, err := db.Query(`SELECT s.id, s.username, s.assignment_id, s.started_at, s.ended_at, COALESCE(s.end_reason, '')
+		FROM trip_sessions s `+clauses, args...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query trips: %w", err)
+	}
+	defer rows.Close()
+
+	trips := []models.Trip{}
+	var ids []int
+	for rows.Next() {
+		var t models.Trip
+		var assignmentID sql.NullInt64
+		var endedAt sql.NullTime
+		if err := rows.Scan(&t.ID, &t.Username, &assignmentID, &t.StartedAt, &endedAt, &t.EndReason); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan trip: %w", err)
+		}
+		t.StartedAt = fromStored(t.StartedAt)
+		if assignmentID.Valid {
+			id := int(assignmentID.Int64)
+			t.AssignmentID = &id
+		}
+		if endedAt.Valid {
+			ended := fromStored(endedAt.Time)
+			t.EndedAt = &ended
+		}
+		trips = append(trips, t)
+		ids = append(ids, t.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("error iterating over trips: %w", err)
+	}
+	if len(trips) == 0 {
+		return trips, nil, nil
+	}
+	fixes, err := tripFixes(db, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	return trips, fixes, nil
+}
+
+// queryTrips loads the trips matching clauses and measures them.
+func queryTrips(db *sql.DB, opts track.Options, clauses string, args ...interface{}) ([]models.Trip, error) {
+	trips, fixes, err := loadTrips(db, clauses, args...)
+	if err != nil {
+		return nil, err
+	}
+	for i := range trips {
+		measureTrip(&trips[i], fixes[trips[i].ID], opts)
+	}
+	return trips, nil
+}
+
+// measureTrip fills in the point counts and distances of trip.
+func measureTrip(trip *models.Trip, points []track.Fix, opts track.Options) {
+	cleaned := track.Clean(points, opts)
+	trip.Points = len(points)
+	trip.CleanedPoints = len(cleaned)
+	trip.Km = roundKm(track.Distance(cleaned))
+	trip.RawKm = roundKm(track.Distance(points))
+}
+
+// HandleListTrips lists trips, newest first, with their raw and cleaned
+// distance. Filters: username, and from and to (YYYY-MM-DD, inclusive, on
+// the start of the trip).
+func HandleListTrips(db *sql.DB, opts track.Options) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		var problems fieldErrors
+		var conditions []string
+		var args []interface{}
+		if username := query.Get("username"); username != "" {
+			args = append(args, username)
+			conditions = append(conditions, fmt.Sprintf("s.username = $%d", len(args)))
+		}
+		for _, bound := range []struct {
+			name string
+			cond string
+		}{{"from", "s.started_at >= $%d::date"}, {"to", "s.started_at < $%d::date + 1"}} {
+			raw := query.Get(bound.name)
+			if raw == "" {
+				continue
+			}
+			if _, err := time.Parse(dueDateLayout, raw); err != nil {
+				problems.add(bound.name, "must be a date like 2006-01-02")
+				continue
+			}
+			args = append(args, raw)
+			conditions = append(conditions, fmt.Sprintf(bound.cond, len(args)))
+		}
+		if err := problems.err(); err != nil {
+			writeFormError(w, err)
+			return
+		}
+		clauses := ""
+		if len(conditions) > 0 {
+			clauses = "WHERE " + strings.Join(conditions, " AND ")
+		}
+
+		trips, err := queryTrips(db, opts, clauses+fmt.Sprintf(" ORDER BY s.started_at DESC, s.id DESC LIMIT %d", maxTripsListed), args...)
+		if err != nil {
+			log.Printf("Error listing trips: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, trips)
+	}
+}
+
+// HandleTrip serves one trip with its raw and cleaned distance and its
+// stops (see analyzeTrip), or, as /api/trips/{id}.gpx or .fit, exports it
+// (see exportTrip). ?stop_minutes= and ?stop_radius= override stopOpts.
+func HandleTrip(db *sql.DB, opts track.Options, stopOpts track.StopOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rawID, format, export := strings.Cut(r.PathValue("id"), ".")
+		id, err := strconv.Atoi(rawID)
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		if export {
+			if !isOneOf(format, trackExportFormats) {
+				http.Error(w, "Not Found", http.StatusNotFound)
+				return
+			}
+			exportTrip(w, r, db, opts, id, format)
+			return
+		}
+
+		var problems fieldErrors
+		stopOpts := stopOptionsParams(r.URL.Query(), stopOpts, &problems)
+		if err := problems.err(); err != nil {
+			writeFormError(w, err)
+			return
+		}
+		trips, fixes, err := loadTrips(db, "WHERE s.id = $1", id)
+		if err != nil {
+			log.Printf("Error loading trip %d: %v", id, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if len(trips) == 0 {
+			http.Error(w, "Trip not found", http.StatusNotFound)
+			return
+		}
+		trip := trips[0]
+		measureTrip(&trip, fixes[trip.ID], opts)
+
+		end := time.Now()
+		if trip.EndedAt != nil {
+			end = *trip.EndedAt
+		}
+		surveys, err := tripSurveys(db, trip.Username, trip.StartedAt, end.Add(time.Second))
+		if err != nil {
+			log.Printf("Error loading surveys of trip %d: %v", id, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		trip.Analysis = analyzeTrip(fixes[trip.ID], surveys, opts, stopOpts)
+		writeJSON(w, http.StatusOK, trip)
+	}
+}
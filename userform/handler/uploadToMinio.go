@@ -3,53 +3,159 @@ package handler
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"strings"
 
 	"github.com/minio/minio-go/v7"
 )
 
-// UploadToMinIO uploads images to the specified MinIO bucket and returns their URLs.
-func UploadToMinIO(minioClient *minio.Client, endpoint, bucketName string, objectNames []string, imageDatas [][]byte) ([]string, error) {
-	var imageURLs []string
+// ErrImageTooLarge is returned by StreamToMinIO when the source holds more
+// than the allowed number of bytes.
+var ErrImageTooLarge = errors.New("image exceeds the maximum allowed size")
 
-	ctx := context.Background()
+// StoredObject describes an object that was streamed into the bucket.
+type StoredObject struct {
+	Name   string
+	URL    string
+	SHA256 string
+	Size   int64
+}
 
-	// Ensure the bucket exists
+// EnsureBucket creates the bucket if it does not exist yet.
+func EnsureBucket(ctx context.Context, minioClient *minio.Client, bucketName string) error {
 	exists, err := minioClient.BucketExists(ctx, bucketName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to check if bucket exists: %w", err)
+		return fmt.Errorf("failed to check if bucket exists: %w", err)
 	}
 	if !exists {
 		err = minioClient.MakeBucket(ctx, bucketName, minio.MakeBucketOptions{})
 		if err != nil {
-			return nil, fmt.Errorf("failed to create bucket: %w", err)
+			return fmt.Errorf("failed to create bucket: %w", err)
 		}
 	}
+	return nil
+}
+
+// UploadToMinIO uploads images to the specified MinIO bucket and returns their URLs.
+func UploadToMinIO(minioClient *minio.Client, endpoint, bucketName string, objectNames []string, imageDatas [][]byte) ([]string, error) {
+	var imageURLs []string
+
+	ctx := context.Background()
+
+	// Ensure the bucket exists
+	if err := EnsureBucket(ctx, minioClient, bucketName); err != nil {
+		return nil, err
+	}
 
 	for i, data := range imageDatas {
 		reader := bytes.NewReader(data)
 		objectName := objectNames[i]
 
-		// Determine content type based on the file extension
-		contentType := "application/octet-stream" // Default content type
-		if strings.HasSuffix(objectName, ".jpg") || strings.HasSuffix(objectName, ".jpeg") {
-			contentType = "image/jpeg"
-		} else if strings.HasSuffix(objectName, ".png") {
-			contentType = "image/png"
-		}
-
 		_, err := minioClient.PutObject(ctx, bucketName, objectName, reader, int64(len(data)), minio.PutObjectOptions{
-			ContentType: contentType,
+			ContentType: contentTypeFor(objectName),
 		})
 		if err != nil {
 			return nil, fmt.Errorf("failed to upload object %s: %w", objectName, err)
 		}
 
-		// Construct the URL
-		imageURL := fmt.Sprintf("http://%s/%s/%s", endpoint, bucketName, objectName)
-		imageURLs = append(imageURLs, imageURL)
+		imageURLs = append(imageURLs, objectURL(endpoint, bucketName, objectName))
 	}
 
 	return imageURLs, nil
 }
+
+// StreamToMinIO copies src into the bucket without holding the whole object
+// in memory. At most partSize bytes are buffered at a time, and the SHA-256
+// of the content is computed on the way through. If src yields more than
+// maxBytes the upload is aborted and ErrImageTooLarge is returned.
+func StreamToMinIO(ctx context.Context, minioClient *minio.Client, endpoint, bucketName, objectName string, src io.Reader, maxBytes int64, partSize uint64) (*StoredObject, error) {
+	hasher := sha256.New()
+	limited := &limitedReader{r: io.TeeReader(src, hasher), remaining: maxBytes}
+
+	info, err := minioClient.PutObject(ctx, bucketName, objectName, limited, -1, minio.PutObjectOptions{
+		ContentType: contentTypeFor(objectName),
+		PartSize:    partSize,
+	})
+	if limited.exceeded {
+		// PutObject aborts the multipart upload when the reader fails, but a
+		// source that ends exactly on the limit may still have been stored.
+		minioClient.RemoveObject(ctx, bucketName, objectName, minio.RemoveObjectOptions{})
+		return nil, ErrImageTooLarge
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload object %s: %w", objectName, err)
+	}
+
+	return &StoredObject{
+		Name:   objectName,
+		URL:    objectURL(endpoint, bucketName, objectName),
+		SHA256: hex.EncodeToString(hasher.Sum(nil)),
+		Size:   info.Size,
+	}, nil
+}
+
+// limitedReader behaves like io.LimitReader but fails loudly instead of
+// silently truncating once the limit is passed.
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+	exceeded  bool
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		l.exceeded = true
+		return 0, ErrImageTooLarge
+	}
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		l.exceeded = true
+		return n, ErrImageTooLarge
+	}
+	return n, err
+}
+
+// contentTypeFor determines the content type based on the file extension.
+func contentTypeFor(objectName string) string {
+	if strings.HasSuffix(objectName, ".jpg") || strings.HasSuffix(objectName, ".jpeg") {
+		return "image/jpeg"
+	} else if strings.HasSuffix(objectName, ".png") {
+		return "image/png"
+	}
+	return "application/octet-stream"
+}
+
+func objectURL(endpoint, bucketName, objectName string) string {
+	return fmt.Sprintf("http://%s/%s/%s", endpoint, bucketName, objectName)
+}
+
+// RemoveObjects deletes the named objects from the bucket, logging failures.
+func RemoveObjects(minioClient *minio.Client, bucketName string, objectNames []string) {
+	for _, objectName := range objectNames {
+		err := minioClient.RemoveObject(context.Background(), bucketName, objectName, minio.RemoveObjectOptions{})
+		if err != nil {
+			log.Printf("Error removing object %s: %v", objectName, err)
+			continue
+		}
+		log.Println("Removed object:", objectName)
+	}
+}
+
+// objectNameFromURL recovers the object name from a URL built by objectURL.
+func objectNameFromURL(imageURL, bucketName string) string {
+	marker := "/" + bucketName + "/"
+	idx := strings.Index(imageURL, marker)
+	if idx < 0 {
+		return ""
+	}
+	return imageURL[idx+len(marker):]
+}
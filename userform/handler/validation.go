@@ -0,0 +1,193 @@
+package handler
+
+import (
+	"database/sql"
+	"fmt"
+	"github/rabinam24/userform/models"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Enumerated pole attributes and the form fields holding them.
+var attributeKinds = []struct {
+	Kind  string
+	Field string
+}{
+	{"pole_type", "selectpole"},
+	{"pole_condition", "selectpolestatus"},
+	{"pole_placement", "selectpolelocation"},
+}
+
+// maxTextBytes matches the VARCHAR(255) columns of userform.
+const maxTextBytes = 255
+
+// fieldErrors collects the validation problems of a request.
+type fieldErrors []models.FieldError
+
+func (fe *fieldErrors) add(field, format string, args ...interface{}) {
+	*fe = append(*fe, models.FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (fe fieldErrors) has(field string) bool {
+	for _, e := range fe {
+		if e.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// err returns the collected problems as a validationError, or nil.
+func (fe fieldErrors) err() error {
+	if len(fe) == 0 {
+		return nil
+	}
+	return &validationError{fe}
+}
+
+// validationError is answered with 422 and the per-field problems.
+type validationError struct {
+	fields fieldErrors
+}
+
+func (e *validationError) Error() string {
+	msgs := make([]string, len(e.fields))
+	for i, f := range e.fields {
+		msgs[i] = f.Field + ": " + f.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// parseCoordinate reads a numeric form field, noting a problem instead of
+// silently turning bad input into zero.
+func parseCoordinate(fields url.Values, name string, problems *fieldErrors) float64 {
+	raw := strings.TrimSpace(fields.Get(name))
+	if raw == "" {
+		return 0
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		problems.add(name, "must be a number")
+		return 0
+	}
+	return value
+}
+
+// loadAttributeOptions returns the options of every enumerated attribute,
+// in display order.
+func loadAttributeOptions(db *sql.DB) (map[string][]models.AttributeOption, error) {
+	rows, err := db.Query(`SELECT kind, value, active, raises_work_order FROM attribute_options ORDER BY kind, position, value`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query attribute options: %w", err)
+	}
+	defer rows.Close()
+
+	options := make(map[string][]models.AttributeOption)
+	for _, k := range attributeKinds {
+		options[k.Kind] = []models.AttributeOption{}
+	}
+	for rows.Next() {
+		var kind string
+		var option models.AttributeOption
+		if err := rows.Scan(&kind, &option.Value, &option.Active, &option.RaisesWorkOrder); err != nil {
+			return nil, fmt.Errorf("failed to scan attribute option: %w", err)
+		}
+		options[kind] = append(options[kind], option)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over attribute options: %w", err)
+	}
+	return options, nil
+}
+
+// validateFormData checks a survey before it is stored and normalises its
+// enumerated attributes to their canonical spelling. problems carries what
+// was already found while parsing the request.
+func validateFormData(db *sql.DB, formData *models.FormData, problems fieldErrors) error {
+	formData.Location = strings.TrimSpace(formData.Location)
+	if len(formData.Location) > maxTextBytes {
+		problems.add("location", "must be at most %d bytes", maxTextBytes)
+	}
+	formData.Surveyor = strings.TrimSpace(formData.Surveyor)
+	if len(formData.Surveyor) > 50 {
+		problems.add("username", "must be at most 50 bytes")
+	}
+	if len(formData.AvailableISP) > maxTextBytes {
+		problems.add("availableisp", "must be at most %d bytes", maxTextBytes)
+	}
+
+	validateCoordinates(formData.Latitude, formData.Longitude, &problems)
+
+	options, err := loadAttributeOptions(db)
+	if err != nil {
+		return err
+	}
+	for _, k := range attributeKinds {
+		value := attributeValue(formData, k.Field)
+		*value = strings.TrimSpace(*value)
+		if *value == "" {
+			problems.add(k.Field, "is required")
+			continue
+		}
+		canonical, ok := matchAttributeOption(options[k.Kind], *value)
+		if !ok {
+			problems.add(k.Field, "must be one of: %s", strings.Join(activeOptionValues(options[k.Kind]), ", "))
+			continue
+		}
+		*value = canonical
+	}
+
+	return problems.err()
+}
+
+// validateCoordinates checks a latitude/longitude pair. (0,0) is treated as
+// a missing GPS fix; no pole is surveyed in the Gulf of Guinea.
+func validateCoordinates(lat, lon float64, problems *fieldErrors) {
+	if !problems.has("latitude") {
+		if math.IsNaN(lat) || lat < -90 || lat > 90 {
+			problems.add("latitude", "must be between -90 and 90")
+		}
+	}
+	if !problems.has("longitude") {
+		if math.IsNaN(lon) || lon < -180 || lon > 180 {
+			problems.add("longitude", "must be between -180 and 180")
+		}
+	}
+	if lat == 0 && lon == 0 && !problems.has("latitude") && !problems.has("longitude") {
+		problems.add("latitude", "is required")
+		problems.add("longitude", "is required")
+	}
+}
+
+func attributeValue(formData *models.FormData, field string) *string {
+	switch field {
+	case "selectpole":
+		return &formData.SelectPole
+	case "selectpolestatus":
+		return &formData.SelectPoleStatus
+	default:
+		return &formData.SelectPoleLocation
+	}
+}
+
+// matchAttributeOption finds value among the active options, ignoring case.
+func matchAttributeOption(options []models.AttributeOption, value string) (string, bool) {
+	for _, option := range options {
+		if option.Active && strings.EqualFold(option.Value, value) {
+			return option.Value, true
+		}
+	}
+	return "", false
+}
+
+func activeOptionValues(options []models.AttributeOption) []string {
+	var values []string
+	for _, option := range options {
+		if option.Active {
+			values = append(values, option.Value)
+		}
+	}
+	return values
+}
@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// dataVersion returns the latest sequence number of the sync log, which
+// moves with every survey stored, changed or deleted. recordChange makes
+// changes commit in sequence order, so no change below it can still
+// appear.
+func dataVersion(db *sql.DB) (int64, error) {
+	var version int64
+	if err := db.QueryRow(`SELECT COALESCE(MAX(seq), 0) FROM sync_changes`).Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to read data version: %w", err)
+	}
+	return version, nil
+}
+
+// versionedCache keeps computed results until the surveys change: an entry
+// is only served for the data version it was computed at. Beyond size
+// entries, the least recently used one goes first.
+type versionedCache[T any] struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*versionedCacheEntry[T]
+}
+
+type versionedCacheEntry[T any] struct {
+	version int64
+	value   T
+	usedAt  time.Time
+}
+
+func newVersionedCache[T any](size int) *versionedCache[T] {
+	return &versionedCache[T]{size: size, entries: make(map[string]*versionedCacheEntry[T])}
+}
+
+// get returns the value stored under key if it was computed at version.
+func (c *versionedCache[T]) get(key string, version int64) (T, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || entry.version != version {
+		var zero T
+		return zero, false
+	}
+	entry.usedAt = time.Now()
+	return entry.value, true
+}
+
+func (c *versionedCache[T]) put(key string, version int64, value T) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+		var oldest string
+		for k, entry := range c.entries {
+			if oldest == "" || entry.usedAt.Before(c.entries[oldest].usedAt) {
+				oldest = k
+			}
+		}
+		delete(c.entries, oldest)
+	}
+	c.entries[key] = &versionedCacheEntry[T]{version: version, value: value, usedAt: time.Now()}
+}
@@ -0,0 +1,533 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github/rabinam24/userform/models"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// workOrderTransitions lists the statuses a work order may move to from
+// each status. Verified is final.
+var workOrderTransitions = map[string][]string{
+	"open":        {"assigned", "in_progress", "resolved"},
+	"assigned":    {"open", "in_progress", "resolved"},
+	"in_progress": {"assigned", "resolved"},
+	"resolved":    {"in_progress", "verified"},
+	"verified":    {},
+}
+
+var workOrderPriorities = []string{"low", "normal", "high", "urgent"}
+
+const dueDateLayout = "2006-01-02"
+
+func isOneOf(value string, allowed []string) bool {
+	for _, a := range allowed {
+		if value == a {
+			return true
+		}
+	}
+	return false
+}
+
+// workOrderColumns selects everything models.WorkOrder holds apart from
+// comments and photos, aliased as wo.
+const workOrderColumns = `wo.id, wo.pole_id, wo.inspection_id, wo.title, wo.description, wo.source, wo.status,
+	wo.priority, wo.assignee, wo.due_date, wo.created_by, wo.created_at, wo.updated_at, wo.resolved_at, wo.verified_at`
+
+// queryWorkOrders runs "SELECT workOrderColumns FROM work_orders wo
+// <clauses>" and scans the result.
+func queryWorkOrders(db *sql.DB, clauses string, args ...interface{}) ([]models.WorkOrder, error) {
+	rows, err := db.Query("SELECT "+workOrderColumns+" FROM work_orders wo "+clauses, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query work orders: %w", err)
+	}
+	defer rows.Close()
+
+	orders := []models.WorkOrder{}
+	for rows.Next() {
+		var wo models.WorkOrder
+		var inspectionID sql.NullInt64
+		var dueDate, resolvedAt, verifiedAt sql.NullTime
+		err := rows.Scan(&wo.ID, &wo.PoleID, &inspectionID, &wo.Title, &wo.Description, &wo.Source, &wo.Status,
+			&wo.Priority, &wo.Assignee, &dueDate, &wo.CreatedBy, &wo.CreatedAt, &wo.UpdatedAt, &resolvedAt, &verifiedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan work order: %w", err)
+		}
+		if inspectionID.Valid {
+			id := int(inspectionID.Int64)
+			wo.InspectionID = &id
+		}
+		if dueDate.Valid {
+			wo.DueDate = dueDate.Time.Format(dueDateLayout)
+		}
+		if resolvedAt.Valid {
+			wo.ResolvedAt = &resolvedAt.Time
+		}
+		if verifiedAt.Valid {
+			wo.VerifiedAt = &verifiedAt.Time
+		}
+		orders = append(orders, wo)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over work orders: %w", err)
+	}
+	return orders, nil
+}
+
+// openAutoWorkOrder opens a work order for the pole of an inspection whose
+// condition is configured to raise one, unless the pole already has an
+// automatic ticket open.
+func openAutoWorkOrder(tx *sql.Tx, inspectionID int, formData models.FormData) error {
+	var raises bool
+	err := tx.QueryRow(`SELECT raises_work_order FROM attribute_options WHERE kind = 'pole_condition' AND value = $1`,
+		formData.SelectPoleStatus).Scan(&raises)
+	if err == sql.ErrNoRows || (err == nil && !raises) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to look up condition %q: %w", formData.SelectPoleStatus, err)
+	}
+
+	query := `INSERT INTO work_orders (pole_id, inspection_id, title, description, source, priority, created_by)
+		VALUES ($1, $2, $3, $4, 'auto', 'high', $5)
+		ON CONFLICT (pole_id) WHERE source = 'auto' AND status NOT IN ('resolved', 'verified') DO NOTHING`
+	title := fmt.Sprintf("Pole %d reported %s", formData.PoleID, strings.ToLower(formData.SelectPoleStatus))
+	if _, err := tx.Exec(query, formData.PoleID, inspectionID, title, formData.Description, formData.Surveyor); err != nil {
+		return fmt.Errorf("failed to open work order for pole %d: %w", formData.PoleID, err)
+	}
+	return nil
+}
+
+// validateWorkOrderFields checks the editable fields of a work order.
+func validateWorkOrderFields(wo *models.WorkOrder, problems *fieldErrors) {
+	wo.Title = strings.TrimSpace(wo.Title)
+	if wo.Title == "" || len(wo.Title) > maxTextBytes {
+		problems.add("title", "must be 1-%d bytes", maxTextBytes)
+	}
+	if !isOneOf(wo.Priority, workOrderPriorities) {
+		problems.add("priority", "must be one of: %s", strings.Join(workOrderPriorities, ", "))
+	}
+	wo.Assignee = strings.TrimSpace(wo.Assignee)
+	if len(wo.Assignee) > 50 {
+		problems.add("assignee", "must be at most 50 bytes")
+	}
+	if wo.DueDate != "" {
+		if _, err := time.Parse(dueDateLayout, wo.DueDate); err != nil {
+			problems.add("due_date", "must be a date like 2006-01-02")
+		}
+	}
+}
+
+func nullDate(date string) sql.NullString {
+	return sql.NullString{String: date, Valid: date != ""}
+}
+
+// HandleListWorkOrders lists work orders, newest first. Filters: status
+// (comma separated), assignee, priority, source, pole_id and overdue=true.
+func HandleListWorkOrders(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		var conditions []string
+		var args []interface{}
+		var problems fieldErrors
+		where := func(condition string, arg interface{}) {
+			args = append(args, arg)
+			conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+		}
+
+		if raw := query.Get("status"); raw != "" {
+			statuses := strings.Split(raw, ",")
+			for _, status := range statuses {
+				if _, ok := workOrderTransitions[status]; !ok {
+					problems.add("status", "unknown status %q", status)
+				}
+			}
+			where("wo.status = ANY(string_to_array($%d, ','))", raw)
+		}
+		if assignee := query.Get("assignee"); assignee != "" {
+			where("wo.assignee = $%d", assignee)
+		}
+		if priority := query.Get("priority"); priority != "" {
+			where("wo.priority = $%d", priority)
+		}
+		if source := query.Get("source"); source != "" {
+			where("wo.source = $%d", source)
+		}
+		if raw := query.Get("pole_id"); raw != "" {
+			poleID, err := strconv.Atoi(raw)
+			if err != nil {
+				problems.add("pole_id", "must be a pole ID")
+			}
+			where("wo.pole_id = $%d", poleID)
+		}
+		if query.Get("overdue") == "true" {
+			conditions = append(conditions, "wo.due_date < CURRENT_DATE AND wo.status NOT IN ('resolved', 'verified')")
+		}
+		if err := problems.err(); err != nil {
+			writeFormError(w, err)
+			return
+		}
+
+		clauses := ""
+		if len(conditions) > 0 {
+			clauses = "WHERE " + strings.Join(conditions, " AND ")
+		}
+		orders, err := queryWorkOrders(db, clauses+" ORDER BY wo.id DESC", args...)
+		if err != nil {
+			log.Printf("Error listing work orders: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, orders)
+	}
+}
+
+// HandleCreateWorkOrder opens a work order for any pole by hand.
+func HandleCreateWorkOrder(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		wo := models.WorkOrder{Priority: "normal"}
+		if err := json.NewDecoder(r.Body).Decode(&wo); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		var problems fieldErrors
+		validateWorkOrderFields(&wo, &problems)
+		var exists bool
+		if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM poles WHERE id = $1)`, wo.PoleID).Scan(&exists); err != nil {
+			log.Printf("Error looking up pole %d: %v", wo.PoleID, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			problems.add("pole_id", "pole %d does not exist", wo.PoleID)
+		}
+		if err := problems.err(); err != nil {
+			writeFormError(w, err)
+			return
+		}
+
+		wo.Source = "manual"
+		wo.Status = "open"
+		if wo.Assignee != "" {
+			wo.Status = "assigned"
+		}
+		query := `INSERT INTO work_orders (pole_id, title, description, source, status, priority, assignee, due_date, created_by)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`
+		err := db.QueryRow(query, wo.PoleID, wo.Title, wo.Description, wo.Source, wo.Status, wo.Priority, wo.Assignee,
+			nullDate(wo.DueDate), wo.CreatedBy).Scan(&wo.ID)
+		if err != nil {
+			log.Printf("Error creating work order: %v", err)
+			http.Error(w, "Failed to create work order", http.StatusInternalServerError)
+			return
+		}
+
+		orders, err := queryWorkOrders(db, "WHERE wo.id = $1", wo.ID)
+		if err != nil || len(orders) == 0 {
+			log.Printf("Error loading work order %d: %v", wo.ID, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, orders[0])
+	}
+}
+
+// HandleWorkOrder serves a work order with its comments and photos.
+func HandleWorkOrder(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		wo, err := loadWorkOrderDetail(db, id)
+		if err != nil {
+			log.Printf("Error loading work order %d: %v", id, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if wo == nil {
+			http.Error(w, "Work order not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, wo)
+	}
+}
+
+// loadWorkOrderDetail returns a work order with its comments and photos, or
+// nil if it does not exist.
+func loadWorkOrderDetail(db *sql.DB, id int) (*models.WorkOrder, error) {
+	orders, err := queryWorkOrders(db, "WHERE wo.id = $1", id)
+	if err != nil || len(orders) == 0 {
+		return nil, err
+	}
+	wo := orders[0]
+	wo.Comments = []models.WorkOrderComment{}
+	wo.Photos = []models.WorkOrderPhoto{}
+
+	rows, err := db.Query(`SELECT id, author, body, created_at FROM work_order_comments WHERE work_order_id = $1 ORDER BY id`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query comments: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c models.WorkOrderComment
+		if err := rows.Scan(&c.ID, &c.Author, &c.Body, &c.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan comment: %w", err)
+		}
+		wo.Comments = append(wo.Comments, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over comments: %w", err)
+	}
+
+	photoRows, err := db.Query(`SELECT id, kind, url, uploaded_by, created_at FROM work_order_photos WHERE work_order_id = $1 ORDER BY id`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query photos: %w", err)
+	}
+	defer photoRows.Close()
+	for photoRows.Next() {
+		var p models.WorkOrderPhoto
+		if err := photoRows.Scan(&p.ID, &p.Kind, &p.URL, &p.UploadedBy, &p.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan photo: %w", err)
+		}
+		wo.Photos = append(wo.Photos, p)
+	}
+	if err := photoRows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over photos: %w", err)
+	}
+	return &wo, nil
+}
+
+// HandleUpdateWorkOrder changes the fields given in the request. Status
+// changes must follow workOrderTransitions; assigning an open ticket moves
+// it to assigned.
+func HandleUpdateWorkOrder(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		var update models.WorkOrderUpdate
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Error beginning transaction: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		var wo models.WorkOrder
+		var dueDate sql.NullTime
+		err = tx.QueryRow(`SELECT title, description, status, priority, assignee, due_date FROM work_orders WHERE id = $1 FOR UPDATE`, id).
+			Scan(&wo.Title, &wo.Description, &wo.Status, &wo.Priority, &wo.Assignee, &dueDate)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Work order not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error loading work order %d: %v", id, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if dueDate.Valid {
+			wo.DueDate = dueDate.Time.Format(dueDateLayout)
+		}
+		current := wo.Status
+
+		if update.Title != nil {
+			wo.Title = *update.Title
+		}
+		if update.Description != nil {
+			wo.Description = *update.Description
+		}
+		if update.Priority != nil {
+			wo.Priority = *update.Priority
+		}
+		if update.Assignee != nil {
+			wo.Assignee = *update.Assignee
+		}
+		if update.DueDate != nil {
+			wo.DueDate = *update.DueDate
+		}
+		var problems fieldErrors
+		validateWorkOrderFields(&wo, &problems)
+
+		switch {
+		case update.Status != nil:
+			wo.Status = *update.Status
+		case current == "open" && wo.Assignee != "":
+			wo.Status = "assigned"
+		}
+		if wo.Status != current {
+			if !isOneOf(wo.Status, workOrderTransitions[current]) {
+				problems.add("status", "cannot move from %s to %s", current, wo.Status)
+			} else if wo.Status == "assigned" && wo.Assignee == "" {
+				problems.add("assignee", "is required to assign the work order")
+			}
+		}
+		if err := problems.err(); err != nil {
+			writeFormError(w, err)
+			return
+		}
+
+		query := `UPDATE work_orders SET title = $2, description = $3, status = $4, priority = $5, assignee = $6, due_date = $7,
+			updated_at = CURRENT_TIMESTAMP,
+			resolved_at = CASE WHEN $4 = 'resolved' AND status <> 'resolved' THEN CURRENT_TIMESTAMP WHEN $4 IN ('resolved', 'verified') THEN resolved_at END,
+			verified_at = CASE WHEN $4 = 'verified' THEN CURRENT_TIMESTAMP END
+			WHERE id = $1`
+		if _, err := tx.Exec(query, id, wo.Title, wo.Description, wo.Status, wo.Priority, wo.Assignee, nullDate(wo.DueDate)); err != nil {
+			log.Printf("Error updating work order %d: %v", id, err)
+			http.Error(w, "Failed to update work order", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("Error committing work order %d: %v", id, err)
+			http.Error(w, "Failed to update work order", http.StatusInternalServerError)
+			return
+		}
+
+		detail, err := loadWorkOrderDetail(db, id)
+		if err != nil || detail == nil {
+			log.Printf("Error loading work order %d: %v", id, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, detail)
+	}
+}
+
+// HandleAddWorkOrderComment appends a comment to a work order.
+func HandleAddWorkOrderComment(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		var comment models.WorkOrderComment
+		if err := json.NewDecoder(r.Body).Decode(&comment); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		var problems fieldErrors
+		if comment.Body = strings.TrimSpace(comment.Body); comment.Body == "" {
+			problems.add("body", "is required")
+		}
+		if len(comment.Author) > 50 {
+			problems.add("author", "must be at most 50 bytes")
+		}
+		if err := problems.err(); err != nil {
+			writeFormError(w, err)
+			return
+		}
+
+		query := `INSERT INTO work_order_comments (work_order_id, author, body)
+			SELECT id, $2, $3 FROM work_orders WHERE id = $1 RETURNING id, created_at`
+		err = db.QueryRow(query, id, comment.Author, comment.Body).Scan(&comment.ID, &comment.CreatedAt)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Work order not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error adding comment to work order %d: %v", id, err)
+			http.Error(w, "Failed to add comment", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, comment)
+	}
+}
+
+// HandleAddWorkOrderPhoto attaches a completed resumable upload to a work
+// order as a before or after photo. The photo holds a reference on the
+// stored image like a survey does.
+func HandleAddWorkOrderPhoto(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		var req models.NewWorkOrderPhoto
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		var problems fieldErrors
+		if req.Kind != "before" && req.Kind != "after" {
+			problems.add("kind", "must be before or after")
+		}
+		session, err := GetUploadSession(db, req.UploadID)
+		if err != nil {
+			log.Printf("Error loading upload %s: %v", req.UploadID, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		sum := ""
+		if session == nil || !session.Completed {
+			problems.add("upload_id", "upload is unknown or incomplete")
+		} else if sum = contentHashFromURL(session.URL); sum == "" {
+			problems.add("upload_id", "upload has no stored image")
+		}
+		if err := problems.err(); err != nil {
+			writeFormError(w, err)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Error beginning transaction: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		res, err := tx.Exec(`UPDATE images SET ref_count = ref_count + 1 WHERE sha256 = $1`, sum)
+		if err != nil {
+			log.Printf("Error referencing image %s: %v", sum, err)
+			http.Error(w, "Failed to add photo", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Uploaded image is no longer stored", http.StatusConflict)
+			return
+		}
+
+		photo := models.WorkOrderPhoto{Kind: req.Kind, URL: session.URL, UploadedBy: req.UploadedBy}
+		query := `INSERT INTO work_order_photos (work_order_id, kind, sha256, url, uploaded_by)
+			SELECT id, $2, $3, $4, $5 FROM work_orders WHERE id = $1 RETURNING id, created_at`
+		err = tx.QueryRow(query, id, photo.Kind, sum, photo.URL, photo.UploadedBy).Scan(&photo.ID, &photo.CreatedAt)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Work order not found", http.StatusNotFound)
+			return
+		}
+		if err == nil {
+			err = claimUploads(tx, []string{req.UploadID})
+		}
+		if err != nil {
+			log.Printf("Error adding photo to work order %d: %v", id, err)
+			http.Error(w, "Failed to add photo", http.StatusInternalServerError)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			log.Printf("Error committing photo of work order %d: %v", id, err)
+			http.Error(w, "Failed to add photo", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, photo)
+	}
+}
@@ -0,0 +1,41 @@
+// Package live fans out what crews in the field are doing, as it happens,
+// to whoever is watching: positions from devices on a trip, trips starting
+// and ending, and new submissions.
+package live
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// Event types.
+const (
+	EventPosition    = "position"
+	EventTripStarted = "trip_started"
+	EventTripEnded   = "trip_ended"
+	EventSubmission  = "submission"
+)
+
+// Event is one thing that happened. Team is the surveyor's team, empty if
+// they have none; Data depends on Type.
+type Event struct {
+	Type     string          `json:"type"`
+	Team     string          `json:"team,omitempty"`
+	Username string          `json:"username"`
+	Time     time.Time       `json:"time"`
+	Data     json.RawMessage `json:"data,omitempty"`
+}
+
+// Broker carries events between the replica they happen on and the
+// replicas with subscribers.
+type Broker interface {
+	Publish(ctx context.Context, e Event) error
+	// Subscribe delivers the events published from now on until ctx is
+	// done, then closes the channel. A subscriber that falls behind misses
+	// events rather than holding up publishers.
+	Subscribe(ctx context.Context) <-chan Event
+}
+
+// subscriberBuffer is how many events a subscriber may fall behind by.
+const subscriberBuffer = 64
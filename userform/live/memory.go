@@ -0,0 +1,44 @@
+package live
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryBroker delivers events within this process only. It serves a
+// single replica, and tests.
+type MemoryBroker struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{subs: make(map[chan Event]struct{})}
+}
+
+func (b *MemoryBroker) Publish(ctx context.Context, e Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Subscribe(ctx context.Context) <-chan Event {
+	ch := make(chan Event, subscriberBuffer)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		delete(b.subs, ch)
+		b.mu.Unlock()
+		close(ch)
+	}()
+	return ch
+}
@@ -0,0 +1,81 @@
+package live
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// maxNotifyPayload is the largest payload Postgres accepts in a NOTIFY.
+const maxNotifyPayload = 7999
+
+// PostgresBroker shares events between replicas through Postgres
+// LISTEN/NOTIFY on one channel. Each replica listens once and fans the
+// events out to its own subscribers.
+type PostgresBroker struct {
+	db       *sql.DB
+	channel  string
+	listener *pq.Listener
+	local    *MemoryBroker
+}
+
+// NewPostgresBroker listens on channel over a connection of its own to
+// dsn, reconnecting as needed; events are sent through db.
+func NewPostgresBroker(db *sql.DB, dsn, channel string) (*PostgresBroker, error) {
+	listener := pq.NewListener(dsn, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Live events listener: %v", err)
+		}
+	})
+	if err := listener.Listen(channel); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to listen on %s: %w", channel, err)
+	}
+	b := &PostgresBroker{db: db, channel: channel, listener: listener, local: NewMemoryBroker()}
+	go b.relay()
+	return b, nil
+}
+
+// relay hands notifications to the local subscribers. Events sent while
+// the listener was reconnecting are lost.
+func (b *PostgresBroker) relay() {
+	for n := range b.listener.Notify {
+		if n == nil {
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal([]byte(n.Extra), &e); err != nil {
+			log.Printf("Live events listener: ignoring malformed event: %v", err)
+			continue
+		}
+		b.local.Publish(context.Background(), e)
+	}
+}
+
+func (b *PostgresBroker) Publish(ctx context.Context, e Event) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+	if len(payload) > maxNotifyPayload {
+		return fmt.Errorf("event of %d bytes is too large to send", len(payload))
+	}
+	if _, err := b.db.ExecContext(ctx, `SELECT pg_notify($1, $2)`, b.channel, string(payload)); err != nil {
+		return fmt.Errorf("failed to send event: %w", err)
+	}
+	return nil
+}
+
+func (b *PostgresBroker) Subscribe(ctx context.Context) <-chan Event {
+	return b.local.Subscribe(ctx)
+}
+
+// Close stops listening.
+func (b *PostgresBroker) Close() error {
+	return b.listener.Close()
+}
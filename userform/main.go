@@ -6,6 +6,7 @@ import (
 	"github/rabinam24/userform/dbconfig"
 	"github/rabinam24/userform/models"
 	"github/rabinam24/userform/routes"
+	"github/rabinam24/userform/track"
 	"log"
 	"net/http"
 	"os"
@@ -20,9 +21,35 @@ func main() {
 	// Configuration for database connection
 	var cfg models.Config
 	flag.StringVar(&cfg.Db.Dsn, "dsn", "", "Postgres connection string")
+	flag.BoolVar(&cfg.Db.PostGIS, "postgis", true, "Use PostGIS geography columns and indexes for spatial lookups when the extension is available")
 	flag.StringVar(&cfg.Jwt.SecretKey, "jwt-secret", "your-secret-key", "JWT Secret Key")
 	flag.DurationVar(&cfg.Jwt.AccessTokenTTL, "access-token-ttl", 15*time.Minute, "Access Token TTL")
 	flag.DurationVar(&cfg.Jwt.RefreshTokenTTL, "refresh-token-ttl", 7*24*time.Hour, "Refresh Token TTL")
+	flag.Int64Var(&cfg.Upload.MaxRequestBytes, "upload-max-request-bytes", 200<<20, "Maximum size of a form submission body")
+	flag.Int64Var(&cfg.Upload.MaxImageBytes, "upload-max-image-bytes", 25<<20, "Maximum size of a single uploaded image")
+	flag.IntVar(&cfg.Upload.MaxImages, "upload-max-images", 20, "Maximum number of images per form submission")
+	flag.Uint64Var(&cfg.Upload.PartSize, "upload-part-size", 5<<20, "Object store multipart part size")
+	flag.DurationVar(&cfg.Upload.OrphanGracePeriod, "orphan-grace-period", 72*time.Hour, "Age after which unreferenced objects are removed")
+	flag.DurationVar(&cfg.Upload.ReconcileInterval, "orphan-reconcile-interval", time.Hour, "How often the bucket is scanned for unreferenced objects")
+	flag.DurationVar(&cfg.Idempotency.Window, "idempotency-window", 24*time.Hour, "How long Idempotency-Key responses are replayed")
+	flag.DurationVar(&cfg.Idempotency.Wait, "idempotency-wait", 30*time.Second, "How long a retry waits for an in-flight attempt")
+	flag.Float64Var(&cfg.Poles.MatchRadius, "pole-match-radius", 5, "Distance in metres within which a submission is proposed to join an existing pole")
+	flag.Float64Var(&cfg.Duplicates.Radius, "duplicate-radius", 15, "Distance in metres within which surveys are checked for being duplicates")
+	flag.DurationVar(&cfg.Duplicates.ScanInterval, "duplicate-scan-interval", 24*time.Hour, "How often duplicate survey candidates are rebuilt (0 disables)")
+	flag.StringVar(&cfg.Admin.Token, "admin-token", os.Getenv("ADMIN_TOKEN"), "Bearer token for the admin endpoints")
+	flag.StringVar(&cfg.AdminAreas.File, "admin-areas-file", os.Getenv("ADMIN_AREAS_FILE"), "GeoJSON file of administrative boundaries to load at startup")
+	flag.DurationVar(&cfg.Trips.InactivityTimeout, "trip-inactivity-timeout", 2*time.Hour, "End trips with no GPS points or submissions for this long (0 disables)")
+	flag.BoolVar(&cfg.Trips.EndOfDay, "trip-end-of-day", true, "End trips left running once their day is over")
+	flag.DurationVar(&cfg.Trips.CloseInterval, "trip-close-interval", 5*time.Minute, "How often open trips are checked for ending")
+	flag.StringVar(&cfg.Live.Backend, "live-backend", "memory", "Where live events are published: memory (single replica) or postgres (LISTEN/NOTIFY, shared by replicas)")
+	defaultTrack := track.DefaultOptions()
+	flag.Float64Var(&cfg.Track.MaxAccuracy, "track-max-accuracy", defaultTrack.MaxAccuracy, "GPS fixes reporting a worse accuracy in metres are ignored (0 keeps all)")
+	flag.Float64Var(&cfg.Track.MaxSpeed, "track-max-speed", defaultTrack.MaxSpeed, "GPS fixes only reachable faster than this many metres per second are ignored (0 keeps all)")
+	flag.Float64Var(&cfg.Track.NoiseRadius, "track-noise-radius", defaultTrack.NoiseRadius, "Moves shorter than this many metres are treated as GPS jitter (0 keeps all)")
+	flag.BoolVar(&cfg.Track.Smooth, "track-smooth", defaultTrack.Smooth, "Smooth GPS tracks with a Kalman filter")
+	defaultStops := track.DefaultStopOptions()
+	flag.DurationVar(&cfg.Stops.MinDwell, "stop-min-dwell", defaultStops.MinDwell, "How long a trip must stay in one place to count as a stop")
+	flag.Float64Var(&cfg.Stops.Radius, "stop-radius", defaultStops.Radius, "Distance in metres a trip may wander during a stop")
 	flag.Parse()
 
 	if cfg.Db.Dsn == "" {
@@ -42,14 +69,18 @@ func main() {
 	}
 	defer db.Close()
 
+	if err := dbconfig.Migrate(db); err != nil {
+		log.Fatal("Error migrating the database:", err)
+	}
+
 	// Set up routes
-	mux := routes.SetupRoutes(db)
+	mux := routes.SetupRoutes(db, cfg)
 
 	// Set up CORS options with * to allow all origins
 	corsOptions := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"}, // Allows all origins
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Authorization", "Content-Type"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Authorization", "Content-Type", "Idempotency-Key"},
 		AllowCredentials: false,
 	})
 
@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+// AdminAreaTags names the administrative areas a point lies in. Levels the
+// loaded boundaries do not cover are left empty.
+type AdminAreaTags struct {
+	Province     string `json:"province,omitempty"`
+	District     string `json:"district,omitempty"`
+	Municipality string `json:"municipality,omitempty"`
+	Ward         string `json:"ward,omitempty"`
+}
+
+// AdminArea is one loaded boundary polygon. A ward polygon usually knows
+// every level above it; a province polygon only its province.
+type AdminArea struct {
+	ID int `json:"id"`
+	AdminAreaTags
+	Source    string    `json:"source"` // sha256 of the file it came from
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AdminAreaImport reports what a boundary upload did.
+type AdminAreaImport struct {
+	Areas    int `json:"areas"`
+	Skipped  int `json:"skipped"` // features without a polygon or an area name
+	Retagged int `json:"retagged"`
+}
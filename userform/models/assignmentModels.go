@@ -0,0 +1,107 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Assignment is an area a supervisor gives to surveyors to cover by a due
+// date. Area is a GeoJSON Polygon or MultiPolygon (a Feature or
+// FeatureCollection wrapping them is accepted); Routes optionally holds the
+// LineStrings of the streets to walk.
+type Assignment struct {
+	ID        int             `json:"id"`
+	Name      string          `json:"name"`
+	Area      json.RawMessage `json:"area"`
+	Routes    json.RawMessage `json:"routes,omitempty"`
+	Surveyors []string        `json:"surveyors"`
+	DueDate   string          `json:"due_date,omitempty"` // YYYY-MM-DD
+	Status    string          `json:"status"`
+	CreatedBy string          `json:"created_by"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// AssignmentUpdate changes the fields that are set.
+type AssignmentUpdate struct {
+	Name      *string         `json:"name"`
+	Area      json.RawMessage `json:"area"`
+	Routes    json.RawMessage `json:"routes"`
+	Surveyors *[]string       `json:"surveyors"`
+	DueDate   *string         `json:"due_date"`
+	Status    *string         `json:"status"`
+}
+
+// AssignmentProgress measures how far the surveyors of an assignment got.
+// StreetCoveragePercent is the share of the planned routes' length passing
+// within reach of a recorded pole or trip position; it is null when the
+// assignment has no routes.
+type AssignmentProgress struct {
+	AssignmentID           int      `json:"assignment_id"`
+	Submissions            int      `json:"submissions"`
+	PolesRecorded          int      `json:"poles_recorded"`
+	OutsideAreaSubmissions int      `json:"outside_area_submissions"`
+	KmTravelled            float64  `json:"km_travelled"`
+	KmTravelledRaw         float64  `json:"km_travelled_raw"`
+	StreetLengthKm         float64  `json:"street_length_km"`
+	StreetCoveragePercent  *float64 `json:"street_coverage_percent"`
+}
+
+// TripPoint is one GPS breadcrumb recorded during a trip.
+type TripPoint struct {
+	Latitude   float64   `json:"latitude"`
+	Longitude  float64   `json:"longitude"`
+	Accuracy   *float64  `json:"accuracy,omitempty"` // metres
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+// TripPointsRequest is the body of POST /api/trips/points.
+type TripPointsRequest struct {
+	Username string      `json:"username"`
+	Points   []TripPoint `json:"points"`
+}
+
+// Trip is one recorded trip. Km is measured along the GPS track once poor
+// fixes, speed jumps and stationary jitter are cleaned out; RawKm along
+// every fix as recorded.
+type Trip struct {
+	ID            int        `json:"id"`
+	Username      string     `json:"username"`
+	AssignmentID  *int       `json:"assignment_id"`
+	StartedAt     time.Time  `json:"started_at"`
+	EndedAt       *time.Time `json:"ended_at"`
+	EndReason     string     `json:"end_reason,omitempty"` // manual, replaced, inactive or end_of_day
+	Points        int        `json:"points"`
+	CleanedPoints int        `json:"cleaned_points"`
+	Km            float64    `json:"km"`
+	RawKm         float64    `json:"raw_km"`
+
+	Analysis *TripAnalysis `json:"analysis,omitempty"` // trip detail only
+}
+
+// TripStop is a place the crew dwelt at during a trip, with the surveys
+// submitted there.
+type TripStop struct {
+	Latitude  float64   `json:"latitude"`
+	Longitude float64   `json:"longitude"`
+	StartedAt time.Time `json:"started_at"`
+	EndedAt   time.Time `json:"ended_at"`
+	Minutes   float64   `json:"minutes"`
+	SurveyIDs []int     `json:"survey_ids"`
+}
+
+// TripAnalysis splits a trip into stops and moving time. A stop without
+// surveys is unproductive; AvgMinutesPerPole spreads the time at the other
+// stops over their surveys and is null when there are none.
+type TripAnalysis struct {
+	StopMinDwellMinutes float64    `json:"stop_min_dwell_minutes"`
+	StopRadius          float64    `json:"stop_radius"` // metres
+	MovingMinutes       float64    `json:"moving_minutes"`
+	StoppedMinutes      float64    `json:"stopped_minutes"`
+	AvgMinutesPerPole   *float64   `json:"avg_minutes_per_pole"`
+	UnproductiveStops   int        `json:"unproductive_stops"`
+	UnproductiveMinutes float64    `json:"unproductive_minutes"`
+	SurveysAtStops      int        `json:"surveys_at_stops"`
+	SurveysElsewhere    int        `json:"surveys_elsewhere"`
+	Stops               []TripStop `json:"stops"`
+}
@@ -0,0 +1,29 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// CoverageGapRequest is the body of POST /api/coverage/gaps. The boundary is
+// either given as GeoJSON or taken from an assignment's area.
+type CoverageGapRequest struct {
+	Boundary     json.RawMessage `json:"boundary"`
+	AssignmentID int             `json:"assignment_id"`
+	CellSize     float64         `json:"cell_size"` // metres
+	MinPoles     int             `json:"min_poles"` // cells with fewer are gaps
+}
+
+// CoverageGaps is a GeoJSON FeatureCollection of the cells of a boundary
+// with fewer than MinPoles surveyed poles. Each feature's properties hold
+// its row, col, poles and status (empty or under_surveyed).
+type CoverageGaps struct {
+	Type       string           `json:"type"` // FeatureCollection
+	Features   []GeoJSONFeature `json:"features"`
+	CellSize   float64          `json:"cell_size"`
+	MinPoles   int              `json:"min_poles"`
+	TotalCells int              `json:"total_cells"`
+	EmptyCells int              `json:"empty_cells"`
+	GapCells   int              `json:"gap_cells"`
+	ComputedAt time.Time        `json:"computed_at"`
+}
@@ -1,14 +1,60 @@
 package models
 
-import "time"
+import (
+	"github/rabinam24/userform/track"
+	"time"
+)
 
 type Config struct {
 	Db struct {
-		Dsn string
+		Dsn     string
+		PostGIS bool // use PostGIS for spatial lookups when the server offers it
 	}
 	Jwt struct {
 		SecretKey       string
 		AccessTokenTTL  time.Duration
 		RefreshTokenTTL time.Duration
 	}
+	Upload      UploadConfig
+	Idempotency struct {
+		Window time.Duration
+		Wait   time.Duration
+	}
+	Poles struct {
+		MatchRadius float64 // metres within which a submission is proposed to join a pole
+	}
+	Duplicates struct {
+		Radius       float64       // metres within which surveys may describe the same pole
+		ScanInterval time.Duration // how often candidate groups are rebuilt; 0 disables
+	}
+	Admin struct {
+		Token string // bearer token for /api/admin; admin routes are off when empty
+	}
+	AdminAreas struct {
+		File string // GeoJSON boundaries loaded at startup, if set
+	}
+	Trips struct {
+		InactivityTimeout time.Duration // open trips with no activity for this long are ended; 0 disables
+		EndOfDay          bool          // end open trips once the day of their last activity is over
+		CloseInterval     time.Duration // how often open trips are checked
+	}
+	Live struct {
+		Backend string // "memory" for a single replica, "postgres" to share events between replicas
+	}
+	Track track.Options     // how GPS breadcrumbs are cleaned before distances are measured
+	Stops track.StopOptions // what counts as a stop on a trip
+}
+
+// UploadConfig bounds how much data a single form submission may stream
+// into the object store.
+type UploadConfig struct {
+	MaxRequestBytes int64  // whole multipart body, all parts included
+	MaxImageBytes   int64  // any single image part
+	MaxImages       int    // number of image parts per submission
+	PartSize        uint64 // object store multipart part size, the per-upload buffer
+
+	// Objects no row refers to are removed once they are older than
+	// OrphanGracePeriod; the bucket is scanned every ReconcileInterval.
+	OrphanGracePeriod time.Duration
+	ReconcileInterval time.Duration
 }
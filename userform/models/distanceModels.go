@@ -0,0 +1,31 @@
+package models
+
+// DistanceBucket is the distance covered in a day, week or month, named by
+// its first day. Km is measured along the cleaned GPS track, RawKm along
+// every fix as recorded.
+type DistanceBucket struct {
+	Period string  `json:"period"` // YYYY-MM-DD
+	Km     float64 `json:"km"`
+	RawKm  float64 `json:"raw_km"`
+}
+
+// UserDistance is the distance one surveyor covered.
+type UserDistance struct {
+	Username   string           `json:"username"`
+	TotalKm    float64          `json:"total_km"`
+	RawTotalKm float64          `json:"raw_total_km"`
+	Buckets    []DistanceBucket `json:"buckets"`
+}
+
+// DistanceReport is the reply to /api/reports/distance. Team sums every
+// user per bucket.
+type DistanceReport struct {
+	From        string           `json:"from"`
+	To          string           `json:"to"`
+	Granularity string           `json:"granularity"`
+	TimeZone    string           `json:"tz"`
+	TotalKm     float64          `json:"total_km"`
+	RawTotalKm  float64          `json:"raw_total_km"`
+	Team        []DistanceBucket `json:"team"`
+	Users       []UserDistance   `json:"users"`
+}
@@ -0,0 +1,46 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// DuplicateGroup is a set of surveys the duplicate scan believes describe
+// the same pole. Status is pending, merged or dismissed.
+type DuplicateGroup struct {
+	ID         int        `json:"id"`
+	Status     string     `json:"status"`
+	Score      float64    `json:"score"`
+	Members    []FormData `json:"members"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+// MergeRequest picks the survey whose pole a duplicate group is merged
+// into. DuplicateIDs are the members the reviewer found to be the primary
+// submitted again; they are folded into it and deleted. Every other member
+// is kept as an inspection of the merged pole.
+type MergeRequest struct {
+	PrimaryID    int    `json:"primary_id"`
+	DuplicateIDs []int  `json:"duplicate_ids"`
+	MergedBy     string `json:"merged_by"`
+}
+
+// MergeRecord is the audit trail of one merge. MergedIDs are the surveys
+// deleted as duplicates; Snapshot holds every member as it was before the
+// merge.
+type MergeRecord struct {
+	ID        int             `json:"id"`
+	GroupID   int             `json:"group_id"`
+	PrimaryID int             `json:"primary_id"`
+	MergedIDs []int           `json:"merged_ids"`
+	MergedBy  string          `json:"merged_by"`
+	Snapshot  json.RawMessage `json:"snapshot"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// DuplicateScanResult reports a run of the duplicate scan.
+type DuplicateScanResult struct {
+	Surveys int `json:"surveys"`
+	Groups  int `json:"groups"`
+}
@@ -3,19 +3,44 @@ package models
 import "time"
 
 type FormData struct {
-	ID                 int       `json:"id"`
-	Location           string    `json:"location"`
-	Latitude           float64   `json:"latitude"`
-	Longitude          float64   `json:"longitude"`
-	SelectPole         string    `json:"selectpole"`
-	SelectPoleStatus   string    `json:"selectpolestatus"`
-	SelectPoleLocation string    `json:"selectpolelocation"`
-	Description        string    `json:"description"`
-	PoleImage          string    `json:"poleimage_url"`
-	AvailableISP       string    `json:"availableisp"`
-	SelectISP          string    `json:"selectisp"`
-	MultipleImages     []string  `json:"multipleimages_urls"`
-	CreatedAt          time.Time `json:"created_at"`
+	ID                 int             `json:"id"`
+	Location           string          `json:"location"`
+	Latitude           float64         `json:"latitude"`
+	Longitude          float64         `json:"longitude"`
+	SelectPole         string          `json:"selectpole"`
+	SelectPoleStatus   string          `json:"selectpolestatus"`
+	SelectPoleLocation string          `json:"selectpolelocation"`
+	Description        string          `json:"description"`
+	PoleImage          string          `json:"poleimage_url"`
+	AvailableISP       string          `json:"availableisp"`
+	SelectISP          string          `json:"selectisp"`
+	MultipleImages     []string        `json:"multipleimages_urls"`
+	ISPs               []ISPAttachment `json:"isps"`
+	ClientID           string          `json:"client_id,omitempty"`
+	PoleID             int             `json:"pole_id,omitempty"`
+	Surveyor           string          `json:"username,omitempty"`
+	AssignmentID       int             `json:"assignment_id,omitempty"`
+	OutsideAssignment  bool            `json:"outside_assignment,omitempty"`
+	CreatedAt          time.Time       `json:"created_at"`
+	AdminAreaTags
+
+	// Only used on input: the resumable uploads the images came from.
+	UploadIDs []string `json:"-"`
+}
+
+// ISPAttachment is one provider's cables on a pole.
+type ISPAttachment struct {
+	ID         int    `json:"id,omitempty"`
+	Provider   string `json:"provider"`
+	ISPCode    string `json:"isp_code,omitempty"`
+	CableCount int    `json:"cable_count"`
+	CableType  string `json:"cable_type"`
+	TagImage   string `json:"tag_image_url,omitempty"`
+
+	// Only used on input: the label photo is either a completed resumable
+	// upload or a file part of the same multipart request.
+	TagImageID   string `json:"tag_image_id,omitempty"`
+	TagImagePart string `json:"tag_image_part,omitempty"`
 }
 
 type GPSData struct {
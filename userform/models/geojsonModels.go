@@ -0,0 +1,14 @@
+package models
+
+// GeoJSONGeometry is a GeoJSON geometry as served to the map.
+type GeoJSONGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+// GeoJSONFeature is a GeoJSON feature as served to the map.
+type GeoJSONFeature struct {
+	Type       string                 `json:"type"` // Feature
+	Geometry   GeoJSONGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
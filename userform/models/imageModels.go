@@ -0,0 +1,8 @@
+package models
+
+// SharedPhoto is one image that appears in more than one survey.
+type SharedPhoto struct {
+	SHA256      string  `json:"sha256"`
+	URL         string  `json:"url"`
+	Submissions []int64 `json:"submission_ids"`
+}
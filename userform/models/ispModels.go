@@ -0,0 +1,36 @@
+package models
+
+import "time"
+
+// ISP is a catalogue entry for an internet service provider. Code is the
+// stable identifier; Aliases are extra spellings accepted on submission.
+type ISP struct {
+	Code      string    `json:"code"`
+	Name      string    `json:"name"`
+	Color     string    `json:"color"`
+	Active    bool      `json:"active"`
+	Aliases   []string  `json:"aliases"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ISPCleanupRequest asks for free-text ISP values to be mapped onto the
+// catalogue. Mappings forces raw values onto a code; they are saved as
+// aliases unless DryRun is set.
+type ISPCleanupRequest struct {
+	DryRun   bool              `json:"dry_run"`
+	Mappings map[string]string `json:"mappings"`
+}
+
+// ISPCleanupValue is one distinct stored value and the entry it maps to.
+type ISPCleanupValue struct {
+	Value string `json:"value"`
+	Code  string `json:"code,omitempty"`
+	Rows  int    `json:"rows"`
+}
+
+type ISPCleanupReport struct {
+	DryRun    bool              `json:"dry_run"`
+	Mapped    []ISPCleanupValue `json:"mapped"`
+	Unmatched []ISPCleanupValue `json:"unmatched"`
+}
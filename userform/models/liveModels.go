@@ -0,0 +1,35 @@
+package models
+
+import "time"
+
+// SurveyorTeam puts a surveyor in a team, which supervisors filter the
+// live view by.
+type SurveyorTeam struct {
+	Username string `json:"username"`
+	Team     string `json:"team"`
+}
+
+// LivePosition is the data of a live position event: where a surveyor on
+// a trip was last seen.
+type LivePosition struct {
+	TripID     int       `json:"trip_id"`
+	Latitude   float64   `json:"latitude"`
+	Longitude  float64   `json:"longitude"`
+	Accuracy   *float64  `json:"accuracy,omitempty"` // metres
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+// LiveTrip is the data of a live trip start or end event.
+type LiveTrip struct {
+	TripID int       `json:"trip_id"`
+	At     time.Time `json:"at"`
+}
+
+// LiveSubmission is the data of a live submission event.
+type LiveSubmission struct {
+	ID               int     `json:"id"`
+	Latitude         float64 `json:"latitude"`
+	Longitude        float64 `json:"longitude"`
+	SelectPole       string  `json:"selectpole"`
+	SelectPoleStatus string  `json:"selectpolestatus"`
+}
@@ -0,0 +1,87 @@
+package models
+
+import "time"
+
+// Pole is a physical pole. Every survey of it is an inspection, stored as
+// a userform row pointing at the pole.
+type Pole struct {
+	ID              int        `json:"id"`
+	Latitude        float64    `json:"latitude"`
+	Longitude       float64    `json:"longitude"`
+	PoleType        string     `json:"pole_type"`
+	Location        string     `json:"location"`
+	Condition       string     `json:"condition"` // as of the latest inspection
+	InspectionCount int        `json:"inspection_count"`
+	LastInspectedAt *time.Time `json:"last_inspected_at,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
+
+// NearbyPole is a pole close to a given point.
+type NearbyPole struct {
+	Pole
+	DistanceMeters float64 `json:"distance_meters"`
+}
+
+// PoleConditionPoint is the condition recorded by one inspection.
+type PoleConditionPoint struct {
+	InspectionID int       `json:"inspection_id"`
+	Condition    string    `json:"condition"`
+	Surveyor     string    `json:"username,omitempty"`
+	InspectedAt  time.Time `json:"inspected_at"`
+}
+
+// PoleDetail is a pole with its inspections, oldest first.
+type PoleDetail struct {
+	Pole
+	Inspections      []FormData           `json:"inspections"`
+	ConditionHistory []PoleConditionPoint `json:"condition_history"`
+}
+
+// PoleProposal answers a submission close to existing poles that asked to
+// confirm its pole (confirm_pole): resubmit with pole_id set to attach it,
+// or with new_pole set to record a new pole.
+type PoleProposal struct {
+	Error      string       `json:"error"`
+	Candidates []NearbyPole `json:"candidates"`
+}
+
+// PoleMatch answers a submission stored as an inspection of the nearest of
+// the poles close to it. Candidates are all of them, nearest first, in case
+// the surveyor meant another.
+type PoleMatch struct {
+	Message    string       `json:"message"`
+	PoleID     int          `json:"pole_id"`
+	Candidates []NearbyPole `json:"candidates"`
+}
+
+// PoleClusterMap is what a map view shows at one zoom: clusters of nearby
+// poles, and the poles standing alone.
+type PoleClusterMap struct {
+	Zoom     int           `json:"zoom"`
+	Clusters []PoleCluster `json:"clusters"`
+	Poles    []PoleMarker  `json:"poles"`
+}
+
+// PoleCluster is a group of nearby poles, placed at their centre. Bounds
+// are the corners of the group as [minLon, minLat, maxLon, maxLat], for
+// zooming in on it.
+type PoleCluster struct {
+	Latitude  float64        `json:"latitude"`
+	Longitude float64        `json:"longitude"`
+	Count     int            `json:"count"`
+	Statuses  map[string]int `json:"statuses"`
+	Bounds    [4]float64     `json:"bounds"`
+}
+
+// PoleMarker is a pole as of its latest survey. Surveys not linked to a
+// pole stand for one each, without a pole ID.
+type PoleMarker struct {
+	SurveyID  int      `json:"survey_id"`
+	PoleID    *int     `json:"pole_id,omitempty"`
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	PoleType  string   `json:"pole_type"`
+	Status    string   `json:"status"`
+	ISPs      []string `json:"isps"`
+}
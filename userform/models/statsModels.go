@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+// StatCount is how many submissions share a value.
+type StatCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// StatPeriod is how many submissions fall in a day, week or month, named
+// by its first day.
+type StatPeriod struct {
+	Period string `json:"period"` // YYYY-MM-DD
+	Count  int    `json:"count"`
+}
+
+// Stats is the dashboard summary of the submissions matching a filter.
+// Submissions with several ISPs count once for each in ByISP.
+type Stats struct {
+	Total          int          `json:"total"`
+	ByPoleType     []StatCount  `json:"by_pole_type"`
+	ByPoleStatus   []StatCount  `json:"by_pole_status"`
+	ByPoleLocation []StatCount  `json:"by_pole_location"`
+	ByISP          []StatCount  `json:"by_isp"`
+	ByAvailableISP []StatCount  `json:"by_available_isp"`
+	Interval       string       `json:"interval"` // day, week or month
+	Submissions    []StatPeriod `json:"submissions"`
+	GeneratedAt    time.Time    `json:"generated_at"`
+}
@@ -0,0 +1,47 @@
+package models
+
+// SyncSurvey is one survey collected offline. Images are referenced by the
+// IDs of completed resumable uploads rather than embedded.
+type SyncSurvey struct {
+	FormData
+	PoleImageID      string   `json:"poleimage_id"`
+	MultipleImageIDs []string `json:"multipleimage_ids"`
+	NewPole          bool     `json:"new_pole"`
+	ConfirmPole      bool     `json:"confirm_pole"`
+}
+
+// SyncBatchRequest is the body of POST /api/sync/batch.
+type SyncBatchRequest struct {
+	SyncToken string       `json:"sync_token"`
+	Surveys   []SyncSurvey `json:"surveys"`
+}
+
+// SyncResult reports what happened to one survey of a batch.
+type SyncResult struct {
+	ClientID string       `json:"client_id"`
+	Status   string       `json:"status"` // created, duplicate, pole_proposed or rejected
+	ID       int          `json:"id,omitempty"`
+	Reason   string       `json:"reason,omitempty"`
+	Errors   []FieldError `json:"errors,omitempty"`
+	Warning  string       `json:"warning,omitempty"`
+	PoleID   int          `json:"pole_id,omitempty"`
+
+	// ProposedPoles are the poles near the survey: the ones to choose from
+	// when it is pole_proposed, or those it was matched among when it was
+	// attached to the nearest.
+	ProposedPoles []NearbyPole `json:"proposed_poles,omitempty"`
+}
+
+// SyncChanges lists server-side changes since the client's sync token.
+type SyncChanges struct {
+	Upserted []FormData `json:"upserted"`
+	Deleted  []int      `json:"deleted"`
+	HasMore  bool       `json:"has_more"`
+}
+
+// SyncBatchResponse is the reply to POST /api/sync/batch.
+type SyncBatchResponse struct {
+	Results   []SyncResult `json:"results"`
+	Changes   SyncChanges  `json:"changes"`
+	SyncToken string       `json:"sync_token"`
+}
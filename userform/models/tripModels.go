@@ -9,3 +9,12 @@ type StartEnd struct {
 	TripEndTime           *time.Time `json:"tripEndTime"`
 	OriginalTripStartTime *time.Time `json:"originalTripStartTime"`
 }
+
+// AutoEndedTrip tells a surveyor that a trip they left running was ended
+// for them, at its last activity.
+type AutoEndedTrip struct {
+	TripID    int       `json:"trip_id"`
+	StartedAt time.Time `json:"started_at"`
+	EndedAt   time.Time `json:"ended_at"`
+	EndReason string    `json:"end_reason"` // inactive or end_of_day
+}
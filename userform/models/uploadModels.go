@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// UploadSession tracks a resumable image upload that is staged in the
+// object store as a multipart upload until all chunks have arrived.
+type UploadSession struct {
+	ID          string     `json:"id"`
+	ObjectName  string     `json:"-"`
+	UploadID    string     `json:"-"`
+	Size        int64      `json:"size"`
+	ChunkSize   int64      `json:"chunk_size"`
+	TotalChunks int        `json:"total_chunks"`
+	Received    []int      `json:"received_chunks"`
+	Completed   bool       `json:"completed"`
+	URL         string     `json:"url,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
@@ -18,6 +18,9 @@ type PasswordChanger struct {
 type AuthResponse struct {
 	AccessToken  string `json:"access_token"`
 	RefreshToken string `json:"refresh_token"`
+
+	// Trips ended for the user since they last logged in.
+	AutoEndedTrips []AutoEndedTrip `json:"auto_ended_trips,omitempty"`
 }
 
 type TokenClaims struct {
@@ -0,0 +1,24 @@
+package models
+
+// FieldError is a problem with one field of a request.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrorResponse is the 422 body listing every invalid field.
+type ValidationErrorResponse struct {
+	Error  string       `json:"error"`
+	Fields []FieldError `json:"fields"`
+}
+
+// AttributeOption is one allowed value of an enumerated pole attribute.
+// Inactive values are kept for existing surveys but no longer accepted.
+type AttributeOption struct {
+	Value  string `json:"value"`
+	Active bool   `json:"active"`
+
+	// RaisesWorkOrder opens a maintenance work order for the pole when an
+	// inspection records this condition.
+	RaisesWorkOrder bool `json:"raises_work_order,omitempty"`
+}
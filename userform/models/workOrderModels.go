@@ -0,0 +1,58 @@
+package models
+
+import "time"
+
+// WorkOrder is a maintenance ticket for a pole. Source is auto for tickets
+// opened by a bad-condition inspection and manual otherwise.
+type WorkOrder struct {
+	ID           int                `json:"id"`
+	PoleID       int                `json:"pole_id"`
+	InspectionID *int               `json:"inspection_id,omitempty"`
+	Title        string             `json:"title"`
+	Description  string             `json:"description"`
+	Source       string             `json:"source"`
+	Status       string             `json:"status"`
+	Priority     string             `json:"priority"`
+	Assignee     string             `json:"assignee"`
+	DueDate      string             `json:"due_date,omitempty"` // YYYY-MM-DD
+	CreatedBy    string             `json:"created_by"`
+	CreatedAt    time.Time          `json:"created_at"`
+	UpdatedAt    time.Time          `json:"updated_at"`
+	ResolvedAt   *time.Time         `json:"resolved_at,omitempty"`
+	VerifiedAt   *time.Time         `json:"verified_at,omitempty"`
+	Comments     []WorkOrderComment `json:"comments,omitempty"`
+	Photos       []WorkOrderPhoto   `json:"photos,omitempty"`
+}
+
+// WorkOrderUpdate changes the fields that are set.
+type WorkOrderUpdate struct {
+	Title       *string `json:"title"`
+	Description *string `json:"description"`
+	Status      *string `json:"status"`
+	Priority    *string `json:"priority"`
+	Assignee    *string `json:"assignee"`
+	DueDate     *string `json:"due_date"`
+}
+
+type WorkOrderComment struct {
+	ID        int       `json:"id"`
+	Author    string    `json:"author"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WorkOrderPhoto is a before or after photo of the work.
+type WorkOrderPhoto struct {
+	ID         int       `json:"id"`
+	Kind       string    `json:"kind"`
+	URL        string    `json:"url"`
+	UploadedBy string    `json:"uploaded_by"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// NewWorkOrderPhoto attaches a completed resumable upload to a work order.
+type NewWorkOrderPhoto struct {
+	UploadID   string `json:"upload_id"`
+	Kind       string `json:"kind"`
+	UploadedBy string `json:"uploaded_by"`
+}
@@ -0,0 +1,176 @@
+// Package mvt encodes point layers as Mapbox Vector Tiles (version 2.1)
+// and places points on the Web Mercator tile grid.
+package mvt
+
+import (
+	"math"
+	"sort"
+
+	"github/rabinam24/userform/geo"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Extent is the size of a tile in tile coordinates.
+const Extent = 4096
+
+// maxLatitude is where Web Mercator stops.
+const maxLatitude = 85.05112878
+
+// Feature is one point of a layer, in tile coordinates. Properties hold
+// strings, ints, float64s or bools; other values are skipped.
+type Feature struct {
+	ID         uint64
+	X, Y       int
+	Properties map[string]interface{}
+}
+
+// Layer is a named set of point features.
+type Layer struct {
+	Name     string
+	Features []Feature
+}
+
+// Mercator returns where p lies on the Web Mercator square, both
+// coordinates in [0, 1] from the top left.
+func Mercator(p geo.Point) (x, y float64) {
+	lat := math.Max(-maxLatitude, math.Min(maxLatitude, p.Lat))
+	sin := math.Sin(lat * math.Pi / 180)
+	x = (p.Lon + 180) / 360
+	y = 0.5 - math.Log((1+sin)/(1-sin))/(4*math.Pi)
+	return x, y
+}
+
+// ValidTile reports whether z/x/y names a tile, for zooms up to maxZoom.
+func ValidTile(z, x, y, maxZoom int) bool {
+	if z < 0 || z > maxZoom {
+		return false
+	}
+	n := 1 << z
+	return x >= 0 && x < n && y >= 0 && y < n
+}
+
+// Encode encodes layers as a vector tile.
+func Encode(layers ...Layer) []byte {
+	var tile []byte
+	for _, l := range layers {
+		tile = protowire.AppendTag(tile, 3, protowire.BytesType)
+		tile = protowire.AppendBytes(tile, encodeLayer(l))
+	}
+	return tile
+}
+
+func encodeLayer(l Layer) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 15, protowire.VarintType)
+	b = protowire.AppendVarint(b, 2)
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, l.Name)
+
+	keys := make(map[string]uint64)
+	var keyOrder []string
+	values := make(map[interface{}]uint64)
+	var valueOrder [][]byte
+	for _, f := range l.Features {
+		names := make([]string, 0, len(f.Properties))
+		for name := range f.Properties {
+			names = append(names, name)
+		}
+		// Sorted, so that a tile encodes the same way every time.
+		sort.Strings(names)
+
+		var tags []byte
+		for _, name := range names {
+			value := f.Properties[name]
+			encoded := encodeValue(value)
+			if encoded == nil {
+				continue
+			}
+			key, ok := keys[name]
+			if !ok {
+				key = uint64(len(keyOrder))
+				keys[name] = key
+				keyOrder = append(keyOrder, name)
+			}
+			valueKey := struct {
+				kind  string
+				value interface{}
+			}{kindOf(value), value}
+			index, ok := values[valueKey]
+			if !ok {
+				index = uint64(len(valueOrder))
+				values[valueKey] = index
+				valueOrder = append(valueOrder, encoded)
+			}
+			tags = protowire.AppendVarint(tags, key)
+			tags = protowire.AppendVarint(tags, index)
+		}
+
+		var feature []byte
+		if f.ID != 0 {
+			feature = protowire.AppendTag(feature, 1, protowire.VarintType)
+			feature = protowire.AppendVarint(feature, f.ID)
+		}
+		if len(tags) > 0 {
+			feature = protowire.AppendTag(feature, 2, protowire.BytesType)
+			feature = protowire.AppendBytes(feature, tags)
+		}
+		feature = protowire.AppendTag(feature, 3, protowire.VarintType)
+		feature = protowire.AppendVarint(feature, 1) // POINT
+		var geometry []byte
+		geometry = protowire.AppendVarint(geometry, 1|1<<3) // MoveTo, one point
+		geometry = protowire.AppendVarint(geometry, protowire.EncodeZigZag(int64(f.X)))
+		geometry = protowire.AppendVarint(geometry, protowire.EncodeZigZag(int64(f.Y)))
+		feature = protowire.AppendTag(feature, 4, protowire.BytesType)
+		feature = protowire.AppendBytes(feature, geometry)
+
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, feature)
+	}
+	for _, key := range keyOrder {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendString(b, key)
+	}
+	for _, value := range valueOrder {
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		b = protowire.AppendBytes(b, value)
+	}
+	b = protowire.AppendTag(b, 5, protowire.VarintType)
+	b = protowire.AppendVarint(b, Extent)
+	return b
+}
+
+func kindOf(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case int:
+		return "int"
+	case float64:
+		return "double"
+	case bool:
+		return "bool"
+	default:
+		return ""
+	}
+}
+
+// encodeValue encodes a Value message, or returns nil for unsupported
+// types.
+func encodeValue(v interface{}) []byte {
+	var b []byte
+	switch v := v.(type) {
+	case string:
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, v)
+	case float64:
+		b = protowire.AppendTag(b, 3, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(v))
+	case int:
+		b = protowire.AppendTag(b, 6, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeZigZag(int64(v)))
+	case bool:
+		b = protowire.AppendTag(b, 7, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(v))
+	}
+	return b
+}
@@ -0,0 +1,134 @@
+package mvt
+
+import (
+	"math"
+	"testing"
+
+	"github/rabinam24/userform/geo"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestMercator(t *testing.T) {
+	tests := []struct {
+		name string
+		p    geo.Point
+		x, y float64
+	}{
+		{"origin", geo.Point{Lat: 0, Lon: 0}, 0.5, 0.5},
+		{"top left", geo.Point{Lat: maxLatitude, Lon: -180}, 0, 0},
+		{"bottom right", geo.Point{Lat: -maxLatitude, Lon: 180}, 1, 1},
+		{"clamped past the pole", geo.Point{Lat: 89.9, Lon: 0}, 0.5, 0},
+		{"Kathmandu", geo.Point{Lat: 27.7172, Lon: 85.324}, 0.737011, 0.419816},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x, y := Mercator(tt.p)
+			if math.Abs(x-tt.x) > 1e-6 || math.Abs(y-tt.y) > 1e-6 {
+				t.Errorf("Mercator(%v) = %v, %v, want %v, %v", tt.p, x, y, tt.x, tt.y)
+			}
+		})
+	}
+}
+
+func TestValidTile(t *testing.T) {
+	tests := []struct {
+		z, x, y int
+		want    bool
+	}{
+		{0, 0, 0, true},
+		{0, 1, 0, false},
+		{3, 7, 7, true},
+		{3, 8, 0, false},
+		{3, 0, -1, false},
+		{-1, 0, 0, false},
+		{21, 0, 0, false},
+	}
+	for _, tt := range tests {
+		if got := ValidTile(tt.z, tt.x, tt.y, 20); got != tt.want {
+			t.Errorf("ValidTile(%d, %d, %d, 20) = %v, want %v", tt.z, tt.x, tt.y, got, tt.want)
+		}
+	}
+}
+
+// bytesFields returns the length-delimited fields of a message by number,
+// failing the test on anything malformed.
+func bytesFields(t *testing.T, b []byte) map[protowire.Number][][]byte {
+	t.Helper()
+	fields := make(map[protowire.Number][][]byte)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("malformed tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		if typ == protowire.BytesType {
+			v, m := protowire.ConsumeBytes(b)
+			if m < 0 {
+				t.Fatalf("malformed field %d: %v", num, protowire.ParseError(m))
+			}
+			fields[num] = append(fields[num], v)
+			n = m
+		} else {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				t.Fatalf("malformed field %d: %v", num, protowire.ParseError(n))
+			}
+		}
+		b = b[n:]
+	}
+	return fields
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		name     string
+		features []Feature
+		keys     int
+		values   int
+	}{
+		{"empty layer", nil, 0, 0},
+		{
+			name: "shared keys and values",
+			features: []Feature{
+				{X: 1, Y: 2, Properties: map[string]interface{}{"status": "ok", "count": 3}},
+				{X: 4095, Y: 0, Properties: map[string]interface{}{"status": "ok", "count": 4}},
+			},
+			keys:   2,
+			values: 3,
+		},
+		{
+			name: "same value of different types",
+			features: []Feature{
+				{Properties: map[string]interface{}{"a": 1, "b": 1.0, "c": true}},
+			},
+			keys:   3,
+			values: 3,
+		},
+		{
+			name: "unsupported values skipped",
+			features: []Feature{
+				{ID: 7, Properties: map[string]interface{}{"list": []string{"x"}, "name": "pole"}},
+			},
+			keys:   1,
+			values: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tile := bytesFields(t, Encode(Layer{Name: "poles", Features: tt.features}))
+			if len(tile[3]) != 1 {
+				t.Fatalf("tile has %d layers, want 1", len(tile[3]))
+			}
+			layer := bytesFields(t, tile[3][0])
+			if len(layer[1]) != 1 || string(layer[1][0]) != "poles" {
+				t.Errorf("layer name = %q, want poles", layer[1])
+			}
+			if len(layer[2]) != len(tt.features) {
+				t.Errorf("layer has %d features, want %d", len(layer[2]), len(tt.features))
+			}
+			if len(layer[3]) != tt.keys || len(layer[4]) != tt.values {
+				t.Errorf("layer has %d keys and %d values, want %d and %d", len(layer[3]), len(layer[4]), tt.keys, tt.values)
+			}
+		})
+	}
+}
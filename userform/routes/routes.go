@@ -1,8 +1,11 @@
 package routes
 
 import (
+	"context"
 	"database/sql"
+	"github/rabinam24/userform/dbconfig"
 	"github/rabinam24/userform/handler"
+	"github/rabinam24/userform/live"
 	"github/rabinam24/userform/models"
 	"log"
 	"net/http"
@@ -12,7 +15,7 @@ import (
 	"github.com/minio/minio-go/v7/pkg/credentials"
 )
 
-func SetupRoutes(db *sql.DB) http.Handler {
+func SetupRoutes(db *sql.DB, cfg models.Config) http.Handler {
 	mux := http.NewServeMux()
 
 	endpoint := os.Getenv("MINIO_ENDPOINT")
@@ -33,15 +36,96 @@ func SetupRoutes(db *sql.DB) http.Handler {
 		log.Fatalln("Failed to initialize MinIO client:", err)
 	}
 
-	var cfg models.Config
-
 	bucketName := "location-tracker"
-	mux.HandleFunc("/submit-form", handler.HandleFormData(db, minioClient, bucketName, endpoint))
+	if err := handler.EnsureBucket(context.Background(), minioClient, bucketName); err != nil {
+		log.Fatalln("Failed to prepare MinIO bucket:", err)
+	}
+	handler.StartObjectReconciler(context.Background(), db, minioClient, bucketName, cfg.Upload.ReconcileInterval, cfg.Upload.OrphanGracePeriod)
+	handler.StartImageBackfill(context.Background(), db, minioClient, endpoint, bucketName)
+	if err := handler.LoadAdminAreas(db, cfg.AdminAreas.File); err != nil {
+		log.Fatalln("Failed to load admin areas:", err)
+	}
+	if cfg.Db.PostGIS {
+		enabled, err := dbconfig.MigratePostGIS(db)
+		if err != nil {
+			log.Printf("Failed to set up PostGIS, using the in-memory spatial index: %v", err)
+		} else if !enabled {
+			log.Println("PostGIS is not available, using the in-memory spatial index")
+		}
+		handler.SetPostGIS(enabled)
+	}
+	switch cfg.Live.Backend {
+	case "memory":
+	case "postgres":
+		broker, err := live.NewPostgresBroker(db, cfg.Db.Dsn, "live_events")
+		if err != nil {
+			log.Fatalln("Failed to start live events:", err)
+		}
+		handler.SetLiveBroker(broker)
+	default:
+		log.Fatalf("Unknown live backend %q", cfg.Live.Backend)
+	}
+	handler.StartDuplicateScanner(context.Background(), db, cfg.Duplicates.Radius, cfg.Duplicates.ScanInterval)
+	handler.StartTripCloser(context.Background(), db, cfg.Trips.InactivityTimeout, cfg.Trips.EndOfDay, cfg.Trips.CloseInterval)
+
+	mux.HandleFunc("/submit-form", handler.WithIdempotency(db, cfg.Idempotency.Window, cfg.Idempotency.Wait,
+		handler.HandleFormData(db, minioClient, bucketName, endpoint, cfg.Upload, cfg.Poles.MatchRadius)))
+
+	mux.HandleFunc("POST /api/uploads", handler.HandleUploadInit(db, minioClient, bucketName, cfg.Upload))
+	mux.HandleFunc("GET /api/uploads/{id}", handler.HandleUploadStatus(db, minioClient, bucketName))
+	mux.HandleFunc("PUT /api/uploads/{id}/chunks/{n}", handler.HandleUploadChunk(db, minioClient, bucketName))
+	mux.HandleFunc("POST /api/uploads/{id}/complete", handler.HandleUploadComplete(db, minioClient, bucketName, endpoint))
+	mux.HandleFunc("DELETE /api/uploads/{id}", handler.HandleUploadAbort(db, minioClient, bucketName))
 
 	mux.HandleFunc("/user-data", handler.HandleUserData(db))
 	mux.HandleFunc("/user-datas", handler.HandleUserDataParticular(db))
 
-	mux.HandleFunc("/api/data/{id}", handler.HandleDeleteData(db))
+	mux.HandleFunc("POST /api/sync/batch", handler.HandleSyncBatch(db, cfg.Upload.MaxRequestBytes, cfg.Poles.MatchRadius))
+	mux.HandleFunc("GET /api/stats", handler.HandleStats(db))
+	mux.HandleFunc("GET /api/reports/distance", handler.HandleDistanceReport(db, cfg.Track))
+	mux.HandleFunc("GET /api/reports/shared-photos", handler.HandleSharedPhotosReport(db, bucketName, endpoint))
+
+	mux.HandleFunc("GET /api/poles", handler.HandleListPoles(db))
+	mux.HandleFunc("GET /tiles/poles/{z}/{x}/{y}", handler.HandlePoleTiles(db))
+	mux.HandleFunc("GET /api/poles/clusters", handler.HandlePoleClusters(db))
+	mux.HandleFunc("GET /api/poles/nearby", handler.HandleNearbyPoles(db, cfg.Poles.MatchRadius))
+	mux.HandleFunc("GET /api/poles/{id}", handler.HandlePoleDetail(db))
+
+	mux.HandleFunc("POST /api/admin/duplicates/scan", handler.WithAdminToken(cfg.Admin.Token, handler.HandleScanDuplicates(db, cfg.Duplicates.Radius)))
+	mux.HandleFunc("GET /api/admin/duplicates", handler.WithAdminToken(cfg.Admin.Token, handler.HandleListDuplicateGroups(db)))
+	mux.HandleFunc("GET /api/admin/duplicates/{id}", handler.WithAdminToken(cfg.Admin.Token, handler.HandleDuplicateGroup(db)))
+	mux.HandleFunc("POST /api/admin/duplicates/{id}/merge", handler.WithAdminToken(cfg.Admin.Token, handler.HandleMergeDuplicateGroup(db, minioClient, bucketName)))
+	mux.HandleFunc("POST /api/admin/duplicates/{id}/dismiss", handler.WithAdminToken(cfg.Admin.Token, handler.HandleDismissDuplicateGroup(db)))
+	mux.HandleFunc("GET /api/admin/merges", handler.WithAdminToken(cfg.Admin.Token, handler.HandleListMerges(db)))
+
+	mux.HandleFunc("GET /api/workorders", handler.HandleListWorkOrders(db))
+	mux.HandleFunc("POST /api/workorders", handler.HandleCreateWorkOrder(db))
+	mux.HandleFunc("GET /api/workorders/{id}", handler.HandleWorkOrder(db))
+	mux.HandleFunc("PATCH /api/workorders/{id}", handler.HandleUpdateWorkOrder(db))
+	mux.HandleFunc("POST /api/workorders/{id}/comments", handler.HandleAddWorkOrderComment(db))
+	mux.HandleFunc("POST /api/workorders/{id}/photos", handler.HandleAddWorkOrderPhoto(db))
+
+	mux.HandleFunc("GET /api/assignments", handler.HandleListAssignments(db))
+	mux.HandleFunc("POST /api/assignments", handler.HandleCreateAssignment(db))
+	mux.HandleFunc("GET /api/assignments/{id}", handler.HandleAssignment(db))
+	mux.HandleFunc("PATCH /api/assignments/{id}", handler.HandleUpdateAssignment(db))
+	mux.HandleFunc("GET /api/assignments/{id}/progress", handler.HandleAssignmentProgress(db, cfg.Track))
+
+	mux.HandleFunc("POST /api/coverage/gaps", handler.HandleCoverageGaps(db))
+
+	mux.HandleFunc("GET /api/areas", handler.HandleListAdminAreas(db))
+	mux.HandleFunc("POST /api/admin/areas", handler.WithAdminToken(cfg.Admin.Token, handler.HandleImportAdminAreas(db)))
+
+	mux.HandleFunc("GET /api/attributes", handler.HandleListAttributeOptions(db))
+	mux.HandleFunc("PUT /api/admin/attributes/{kind}", handler.WithAdminToken(cfg.Admin.Token, handler.HandleReplaceAttributeOptions(db)))
+	mux.HandleFunc("GET /api/isps", handler.HandleListISPs(db))
+	mux.HandleFunc("POST /api/admin/isps", handler.WithAdminToken(cfg.Admin.Token, handler.HandleCreateISP(db)))
+	mux.HandleFunc("PUT /api/admin/isps/{code}", handler.WithAdminToken(cfg.Admin.Token, handler.HandleUpdateISP(db)))
+	mux.HandleFunc("DELETE /api/admin/isps/{code}", handler.WithAdminToken(cfg.Admin.Token, handler.HandleDeleteISP(db)))
+	mux.HandleFunc("POST /api/admin/isps/cleanup", handler.WithAdminToken(cfg.Admin.Token, handler.HandleCleanupISPs(db)))
+
+	mux.HandleFunc("PUT /api/data/{id}/isps", handler.HandleUpdateISPs(db, minioClient, bucketName))
+	mux.HandleFunc("/api/data/{id}", handler.HandleDeleteData(db, minioClient, bucketName))
 	mux.HandleFunc("/save-user", handler.SaveUser(db))
 
 	mux.HandleFunc("/api/gps-data", handler.HandlegetGpsData(db))
@@ -49,11 +133,25 @@ func SetupRoutes(db *sql.DB) http.Handler {
 	mux.HandleFunc("/start_trip", handler.HandleStartTrip(db))
 	mux.HandleFunc("/end_trip", handler.HandleEndTrip(db))
 	mux.HandleFunc("/get_trip_state", handler.HandleGetTripState(db))
-	mux.HandleFunc("/total-distances", handler.HandleTotalDistances(db))
+	mux.HandleFunc("GET /api/trips", handler.HandleListTrips(db, cfg.Track))
+	mux.HandleFunc("GET /api/trips/{id}", handler.HandleTrip(db, cfg.Track, cfg.Stops))
+	mux.HandleFunc("POST /api/trips/points", handler.HandleTripPoints(db))
+	mux.HandleFunc("GET /api/users/{username}/track.gpx", handler.HandleUserTrackExport(db, cfg.Track))
+	mux.HandleFunc("GET /api/users/{username}/track.fit", handler.HandleUserTrackExport(db, cfg.Track))
+	mux.HandleFunc("GET /api/live/events", handler.HandleLiveEvents(db))
+	mux.HandleFunc("GET /api/live/ws", handler.HandleLiveSocket(db))
+	mux.HandleFunc("GET /api/teams", handler.HandleListTeams(db))
+	mux.HandleFunc("PUT /api/admin/surveyors/{username}/team", handler.WithAdminToken(cfg.Admin.Token, handler.HandleSetSurveyorTeam(db)))
+	mux.HandleFunc("/total-distances", handler.HandleTotalDistances(db, cfg.Track))
 	mux.HandleFunc("/sign-up", handler.HandleUserSignup(db))
-	mux.HandleFunc("/login", handler.HandleUserLogin(db, cfg))
-	mux.HandleFunc("/refresh-token", handler.HandleRefreshToken(cfg))
-	mux.HandleFunc("/password-changer", handler.HandlePasswordChanger(db, cfg))
+	// The auth handlers have always been given an empty config, so tokens
+	// are signed with an empty key and zero TTLs. Switching them to the
+	// -jwt-* flags invalidates every token issued so far and is left to a
+	// change of its own.
+	var authCfg models.Config
+	mux.HandleFunc("/login", handler.HandleUserLogin(db, authCfg))
+	mux.HandleFunc("/refresh-token", handler.HandleRefreshToken(authCfg))
+	mux.HandleFunc("/password-changer", handler.HandlePasswordChanger(db, authCfg))
 	mux.HandleFunc("/logins", handler.Login)
 	mux.HandleFunc("/calling", handler.HandleCallback)
 	mux.HandleFunc("/logout", handler.Logout)
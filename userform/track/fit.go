@@ -0,0 +1,173 @@
+package track
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"time"
+)
+
+// FIT is Garmin's binary activity format. WriteFIT emits the smallest
+// activity file fleet tools accept: a file_id, then per track a start
+// event, its records, a stop event, a lap and a session, and finally the
+// activity. FIT has no place for free-standing waypoints, so poles are only
+// exported as GPX.
+
+// fitEpoch is the zero of FIT timestamps.
+var fitEpoch = time.Date(1989, time.December, 31, 0, 0, 0, 0, time.UTC)
+
+const (
+	fitProfileVersion = 2132
+
+	fitEnum   = 0x00
+	fitUint16 = 0x84
+	fitSint32 = 0x85
+	fitUint32 = 0x86
+
+	fitManufacturerDevelopment = 255
+	fitFileActivity            = 4
+	fitEventTimer              = 0
+	fitEventSession            = 8
+	fitEventLap                = 9
+	fitEventActivity           = 26
+	fitEventTypeStart          = 0
+	fitEventTypeStop           = 1
+	fitEventTypeStopAll        = 4
+)
+
+// fitMessage describes one kind of FIT message: its global number and the
+// (field number, base type) pairs of the fields written for it.
+type fitMessage struct {
+	local  byte
+	global uint16
+	fields [][2]byte
+}
+
+var (
+	fitFileID   = fitMessage{0, 0, [][2]byte{{0, fitEnum}, {1, fitUint16}, {4, fitUint32}}}
+	fitRecord   = fitMessage{1, 20, [][2]byte{{253, fitUint32}, {0, fitSint32}, {1, fitSint32}}}
+	fitEvent    = fitMessage{2, 21, [][2]byte{{253, fitUint32}, {0, fitEnum}, {1, fitEnum}}}
+	fitLap      = fitMessage{3, 19, [][2]byte{{253, fitUint32}, {2, fitUint32}, {7, fitUint32}, {8, fitUint32}, {9, fitUint32}, {0, fitEnum}, {1, fitEnum}}}
+	fitSession  = fitMessage{4, 18, [][2]byte{{253, fitUint32}, {2, fitUint32}, {7, fitUint32}, {8, fitUint32}, {9, fitUint32}, {5, fitEnum}, {0, fitEnum}, {1, fitEnum}, {25, fitUint16}, {26, fitUint16}}}
+	fitActivity = fitMessage{5, 34, [][2]byte{{253, fitUint32}, {0, fitUint32}, {1, fitUint16}, {2, fitEnum}, {3, fitEnum}, {4, fitEnum}}}
+)
+
+func fitSize(baseType byte) byte {
+	switch baseType {
+	case fitUint16:
+		return 2
+	case fitSint32, fitUint32:
+		return 4
+	default:
+		return 1
+	}
+}
+
+// fitWriter buffers the data records of a FIT file.
+type fitWriter struct {
+	buf     bytes.Buffer
+	defined map[byte]bool
+}
+
+// write appends one message, preceded by its definition the first time.
+// values are given in field order and truncated to each field's size.
+func (fw *fitWriter) write(m fitMessage, values ...uint32) {
+	if !fw.defined[m.local] {
+		fw.buf.WriteByte(0x40 | m.local)
+		fw.buf.WriteByte(0) // reserved
+		fw.buf.WriteByte(0) // little endian
+		binary.Write(&fw.buf, binary.LittleEndian, m.global)
+		fw.buf.WriteByte(byte(len(m.fields)))
+		for _, f := range m.fields {
+			fw.buf.Write([]byte{f[0], fitSize(f[1]), f[1]})
+		}
+		fw.defined[m.local] = true
+	}
+	fw.buf.WriteByte(m.local)
+	for i, f := range m.fields {
+		switch fitSize(f[1]) {
+		case 1:
+			fw.buf.WriteByte(byte(values[i]))
+		case 2:
+			binary.Write(&fw.buf, binary.LittleEndian, uint16(values[i]))
+		default:
+			binary.Write(&fw.buf, binary.LittleEndian, values[i])
+		}
+	}
+}
+
+func fitTime(t time.Time) uint32 {
+	return uint32(t.Sub(fitEpoch) / time.Second)
+}
+
+// fitSemicircles converts degrees to the FIT position unit.
+func fitSemicircles(deg float64) uint32 {
+	return uint32(int32(math.Round(deg * (1 << 31) / 180)))
+}
+
+// WriteFIT writes tracks as a FIT activity, one session per track with at
+// least one fix.
+func WriteFIT(w io.Writer, tracks []Track) error {
+	fw := &fitWriter{defined: make(map[byte]bool)}
+	now := time.Now()
+	fw.write(fitFileID, fitFileActivity, fitManufacturerDevelopment, fitTime(now))
+
+	sessions := 0
+	var timer time.Duration
+	last := now
+	for _, t := range tracks {
+		if len(t.Fixes) == 0 {
+			continue
+		}
+		start, end := t.Fixes[0].Time, t.Fixes[len(t.Fixes)-1].Time
+		elapsed := uint32(end.Sub(start) / time.Millisecond)
+		meters := uint32(math.Round(Distance(t.Fixes) * 100))
+
+		fw.write(fitEvent, fitTime(start), fitEventTimer, fitEventTypeStart)
+		for _, f := range t.Fixes {
+			fw.write(fitRecord, fitTime(f.Time), fitSemicircles(f.Lat), fitSemicircles(f.Lon))
+		}
+		fw.write(fitEvent, fitTime(end), fitEventTimer, fitEventTypeStopAll)
+		fw.write(fitLap, fitTime(end), fitTime(start), elapsed, elapsed, meters, fitEventLap, fitEventTypeStop)
+		fw.write(fitSession, fitTime(end), fitTime(start), elapsed, elapsed, meters, 0, fitEventSession, fitEventTypeStop, uint32(sessions), 1)
+		sessions++
+		timer += end.Sub(start)
+		last = end
+	}
+	fw.write(fitActivity, fitTime(last), uint32(timer/time.Millisecond), uint32(sessions), 0, fitEventActivity, fitEventTypeStop)
+
+	header := make([]byte, 14)
+	header[0] = 14
+	header[1] = 0x20 // protocol 2.0
+	binary.LittleEndian.PutUint16(header[2:], fitProfileVersion)
+	binary.LittleEndian.PutUint32(header[4:], uint32(fw.buf.Len()))
+	copy(header[8:], ".FIT")
+	binary.LittleEndian.PutUint16(header[12:], fitCRC(0, header[:12]))
+
+	crc := fitCRC(fitCRC(0, header), fw.buf.Bytes())
+	binary.Write(&fw.buf, binary.LittleEndian, crc)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := fw.buf.WriteTo(w)
+	return err
+}
+
+var fitCRCTable = [16]uint16{
+	0x0000, 0xCC01, 0xD801, 0x1400, 0xF001, 0x3C00, 0x2800, 0xE401,
+	0xA001, 0x6C00, 0x7800, 0xB401, 0x5000, 0x9C01, 0x8801, 0x4400,
+}
+
+// fitCRC continues the FIT checksum crc over data.
+func fitCRC(crc uint16, data []byte) uint16 {
+	for _, b := range data {
+		tmp := fitCRCTable[crc&0xF]
+		crc = (crc >> 4) & 0x0FFF
+		crc = crc ^ tmp ^ fitCRCTable[b&0xF]
+		tmp = fitCRCTable[crc&0xF]
+		crc = (crc >> 4) & 0x0FFF
+		crc = crc ^ tmp ^ fitCRCTable[(b>>4)&0xF]
+	}
+	return crc
+}
@@ -0,0 +1,93 @@
+package track
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Track is one named run of fixes, such as a trip.
+type Track struct {
+	Name  string
+	Fixes []Fix
+}
+
+// Waypoint is a named position exported alongside tracks.
+type Waypoint struct {
+	Lat         float64
+	Lon         float64
+	Time        time.Time
+	Name        string
+	Description string
+	Type        string
+}
+
+type gpxFile struct {
+	XMLName   xml.Name      `xml:"http://www.topografix.com/GPX/1/1 gpx"`
+	Version   string        `xml:"version,attr"`
+	Creator   string        `xml:"creator,attr"`
+	Metadata  gpxMetadata   `xml:"metadata"`
+	Waypoints []gpxWaypoint `xml:"wpt"`
+	Tracks    []gpxTrack    `xml:"trk"`
+}
+
+type gpxMetadata struct {
+	Name string    `xml:"name,omitempty"`
+	Time time.Time `xml:"time"`
+}
+
+type gpxWaypoint struct {
+	Lat         float64    `xml:"lat,attr"`
+	Lon         float64    `xml:"lon,attr"`
+	Time        *time.Time `xml:"time,omitempty"`
+	Name        string     `xml:"name,omitempty"`
+	Description string     `xml:"desc,omitempty"`
+	Type        string     `xml:"type,omitempty"`
+}
+
+type gpxTrack struct {
+	Name     string          `xml:"name,omitempty"`
+	Segments []gpxTrackPoint `xml:"trkseg>trkpt"`
+}
+
+type gpxTrackPoint struct {
+	Lat  float64   `xml:"lat,attr"`
+	Lon  float64   `xml:"lon,attr"`
+	Time time.Time `xml:"time"`
+}
+
+// WriteGPX writes tracks and waypoints as a GPX 1.1 document, one trk of a
+// single segment per track.
+func WriteGPX(w io.Writer, name string, tracks []Track, waypoints []Waypoint) error {
+	doc := gpxFile{
+		Version:  "1.1",
+		Creator:  "userform",
+		Metadata: gpxMetadata{Name: name, Time: time.Now().UTC()},
+	}
+	for _, wp := range waypoints {
+		out := gpxWaypoint{Lat: wp.Lat, Lon: wp.Lon, Name: wp.Name, Description: wp.Description, Type: wp.Type}
+		if !wp.Time.IsZero() {
+			t := wp.Time.UTC()
+			out.Time = &t
+		}
+		doc.Waypoints = append(doc.Waypoints, out)
+	}
+	for _, t := range tracks {
+		out := gpxTrack{Name: t.Name, Segments: make([]gpxTrackPoint, len(t.Fixes))}
+		for i, f := range t.Fixes {
+			out.Segments[i] = gpxTrackPoint{Lat: f.Lat, Lon: f.Lon, Time: f.Time.UTC()}
+		}
+		doc.Tracks = append(doc.Tracks, out)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return fmt.Errorf("failed to encode GPX: %w", err)
+	}
+	return nil
+}
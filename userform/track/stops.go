@@ -0,0 +1,66 @@
+package track
+
+import (
+	"time"
+
+	"github/rabinam24/userform/geo"
+)
+
+// StopOptions defines a stop: the track stays within Radius metres of
+// where it halted for at least MinDwell.
+type StopOptions struct {
+	MinDwell time.Duration
+	Radius   float64
+}
+
+// DefaultStopOptions suit a crew halting at a pole.
+func DefaultStopOptions() StopOptions {
+	return StopOptions{MinDwell: 3 * time.Minute, Radius: 30}
+}
+
+// Stop is a place the track dwelt at, from the first to the last fix
+// within reach of it. Lat and Lon are the mean of those fixes.
+type Stop struct {
+	Lat   float64
+	Lon   float64
+	Start time.Time
+	End   time.Time
+}
+
+// Duration is how long the stop lasted.
+func (s Stop) Duration() time.Duration {
+	return s.End.Sub(s.Start)
+}
+
+// Point is where the stop was.
+func (s Stop) Point() geo.Point {
+	return geo.Point{Lat: s.Lat, Lon: s.Lon}
+}
+
+// DetectStops finds the stops along fixes, in time order. Fixes should be
+// free of outliers (see Clean) but keep their stationary jitter, as that is
+// what a stop is made of.
+func DetectStops(fixes []Fix, opts StopOptions) []Stop {
+	var stops []Stop
+	for i := 0; i < len(fixes); {
+		anchor := fixes[i].point()
+		j := i + 1
+		for j < len(fixes) && geo.DistanceMeters(anchor, fixes[j].point()) <= opts.Radius {
+			j++
+		}
+		if fixes[j-1].Time.Sub(fixes[i].Time) < opts.MinDwell {
+			i++
+			continue
+		}
+		stop := Stop{Start: fixes[i].Time, End: fixes[j-1].Time}
+		for _, f := range fixes[i:j] {
+			stop.Lat += f.Lat
+			stop.Lon += f.Lon
+		}
+		stop.Lat /= float64(j - i)
+		stop.Lon /= float64(j - i)
+		stops = append(stops, stop)
+		i = j
+	}
+	return stops
+}
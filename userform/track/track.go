@@ -0,0 +1,171 @@
+// Package track cleans GPS breadcrumbs before distances are measured along
+// them. Phone fixes come with spikes of hundreds of metres and a steady
+// wobble while standing still; chained as they are, both inflate the
+// distance travelled.
+package track
+
+import (
+	"math"
+	"time"
+
+	"github/rabinam24/userform/geo"
+)
+
+// Fix is one GPS position. Accuracy is the reported horizontal accuracy in
+// metres, 0 when unknown.
+type Fix struct {
+	Lat      float64
+	Lon      float64
+	Accuracy float64
+	Time     time.Time
+}
+
+func (f Fix) point() geo.Point {
+	return geo.Point{Lat: f.Lat, Lon: f.Lon}
+}
+
+// Options tunes Clean. Zero values switch the corresponding step off.
+type Options struct {
+	MaxAccuracy float64 // metres; fixes reporting a worse accuracy are dropped
+	MaxSpeed    float64 // metres per second; fixes only reachable faster are dropped
+	NoiseRadius float64 // metres; smaller moves from the last kept fix are jitter
+	Smooth      bool    // run a Kalman filter over the remaining fixes
+}
+
+// DefaultOptions suit crews on foot, bikes and in cars.
+func DefaultOptions() Options {
+	return Options{MaxAccuracy: 50, MaxSpeed: 40, NoiseRadius: 10}
+}
+
+const (
+	// teleportRecovery is how many consecutive fixes rejected for speed,
+	// consistent among themselves, mean the track really moved, for example
+	// after the first fix of a trip was the outlier.
+	teleportRecovery = 3
+	// assumedAccuracy stands in for fixes that report none.
+	assumedAccuracy = 15.0
+	// kalmanSpeed is the process noise of the filter, in metres per second.
+	kalmanSpeed = 3.0
+)
+
+// Clean returns the fixes worth measuring, in order: fixes with poor
+// accuracy go first, then impossible-speed jumps, then (optionally) the
+// rest is smoothed, and finally stationary jitter is collapsed onto the
+// fix it wobbles around. fixes must be in time order.
+func Clean(fixes []Fix, opts Options) []Fix {
+	cleaned := make([]Fix, 0, len(fixes))
+	for _, f := range fixes {
+		if opts.MaxAccuracy > 0 && f.Accuracy > opts.MaxAccuracy {
+			continue
+		}
+		cleaned = append(cleaned, f)
+	}
+	if opts.MaxSpeed > 0 {
+		cleaned = dropTeleports(cleaned, opts.MaxSpeed)
+	}
+	if opts.Smooth {
+		cleaned = smooth(cleaned)
+	}
+	if opts.NoiseRadius > 0 {
+		cleaned = dropJitter(cleaned, opts.NoiseRadius)
+	}
+	return cleaned
+}
+
+// Distance sums the distances between consecutive fixes, in metres.
+func Distance(fixes []Fix) float64 {
+	total := 0.0
+	for i := 1; i < len(fixes); i++ {
+		total += geo.DistanceMeters(fixes[i-1].point(), fixes[i].point())
+	}
+	return total
+}
+
+// reachable reports whether b can follow a without exceeding maxSpeed.
+// Simultaneous fixes are reachable only if they are at the same place.
+func reachable(a, b Fix, maxSpeed float64) bool {
+	d := geo.DistanceMeters(a.point(), b.point())
+	dt := b.Time.Sub(a.Time).Seconds()
+	if dt <= 0 {
+		return d <= math.Max(a.Accuracy, b.Accuracy)
+	}
+	return d/dt <= maxSpeed
+}
+
+// dropTeleports drops fixes that could only be reached from the last kept
+// fix above maxSpeed. When teleportRecovery fixes in a row are dropped yet
+// agree with each other, the kept fixes they cannot be reached from were
+// the odd ones out: those are dropped instead and the track continues from
+// the rejected fixes.
+func dropTeleports(fixes []Fix, maxSpeed float64) []Fix {
+	var kept, rejected []Fix
+	for _, f := range fixes {
+		if len(kept) == 0 || reachable(kept[len(kept)-1], f, maxSpeed) {
+			kept = append(kept, f)
+			rejected = rejected[:0]
+			continue
+		}
+		if len(rejected) > 0 && !reachable(rejected[len(rejected)-1], f, maxSpeed) {
+			rejected = rejected[:0]
+		}
+		rejected = append(rejected, f)
+		if len(rejected) == teleportRecovery {
+			for len(kept) > 0 && !reachable(kept[len(kept)-1], rejected[0], maxSpeed) {
+				kept = kept[:len(kept)-1]
+			}
+			kept = append(kept, rejected...)
+			rejected = rejected[:0]
+		}
+	}
+	return kept
+}
+
+// smooth runs a constant-position Kalman filter over latitude and longitude,
+// weighting each fix by its reported accuracy.
+func smooth(fixes []Fix) []Fix {
+	if len(fixes) == 0 {
+		return fixes
+	}
+	smoothed := make([]Fix, len(fixes))
+	state := fixes[0]
+	variance := accuracyOf(state) * accuracyOf(state)
+	smoothed[0] = state
+	for i, f := range fixes[1:] {
+		if dt := f.Time.Sub(state.Time).Seconds(); dt > 0 {
+			variance += dt * kalmanSpeed * kalmanSpeed
+		}
+		measurement := accuracyOf(f) * accuracyOf(f)
+		gain := variance / (variance + measurement)
+		state.Lat += gain * (f.Lat - state.Lat)
+		state.Lon += gain * (f.Lon - state.Lon)
+		state.Time = f.Time
+		state.Accuracy = math.Sqrt((1 - gain) * variance)
+		variance = (1 - gain) * variance
+		smoothed[i+1] = state
+	}
+	return smoothed
+}
+
+func accuracyOf(f Fix) float64 {
+	if f.Accuracy > 0 {
+		return f.Accuracy
+	}
+	return assumedAccuracy
+}
+
+// dropJitter drops fixes closer than noiseRadius to the last kept fix. The
+// final fix is kept if the track moved at all, so a trip ends where it did.
+func dropJitter(fixes []Fix, noiseRadius float64) []Fix {
+	var kept []Fix
+	for i, f := range fixes {
+		if len(kept) == 0 {
+			kept = append(kept, f)
+			continue
+		}
+		d := geo.DistanceMeters(kept[len(kept)-1].point(), f.point())
+		if d >= noiseRadius || (i == len(fixes)-1 && d > 0) {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,118 @@
+package track
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+
+// walk returns fixes every 5 seconds, north[i] metres north and east[i]
+// metres east of a fixed origin.
+func walk(north, east []float64) []Fix {
+	const metersPerDegree = 6371000.0 * math.Pi / 180
+	fixes := make([]Fix, len(north))
+	for i := range north {
+		fixes[i] = Fix{
+			Lat:      27.7 + north[i]/metersPerDegree,
+			Lon:      85.3 + east[i]/(metersPerDegree*math.Cos(27.7*math.Pi/180)),
+			Accuracy: 5,
+			Time:     start.Add(time.Duration(i) * 5 * time.Second),
+		}
+	}
+	return fixes
+}
+
+func TestCleanDistance(t *testing.T) {
+	tests := []struct {
+		name  string
+		north []float64
+		east  []float64
+		want  float64
+	}{
+		{
+			name:  "steady walk",
+			north: []float64{0, 15, 30, 45, 60, 75, 90},
+			east:  []float64{0, 0, 0, 0, 0, 0, 0},
+			want:  90,
+		},
+		{
+			name:  "spike in the middle",
+			north: []float64{0, 15, 30, 45, 60, 75, 90},
+			east:  []float64{0, 0, 0, 1000, 0, 0, 0},
+			want:  90,
+		},
+		{
+			name:  "spike as the first fix",
+			north: []float64{0, 0, 15, 30, 45, 60, 75, 90},
+			east:  []float64{1000, 0, 0, 0, 0, 0, 0, 0},
+			want:  90,
+		},
+		{
+			name:  "spike of two fixes",
+			north: []float64{0, 15, 30, 45, 60, 75, 90},
+			east:  []float64{0, 0, 1000, 1000, 0, 0, 0},
+			want:  90,
+		},
+		{
+			name:  "standing still",
+			north: []float64{0, 2, -1, 3, 1, 2},
+			east:  []float64{0, 1, 2, -2, 0, 1},
+			want:  2.2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Distance(Clean(walk(tt.north, tt.east), DefaultOptions()))
+			if math.Abs(got-tt.want) > 1 {
+				t.Errorf("Distance(Clean()) = %.1f m, want %.1f m", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCleanDropsInaccurateFixes(t *testing.T) {
+	fixes := walk([]float64{0, 15, 30, 45}, []float64{0, 0, 0, 0})
+	fixes[2].Accuracy = 100
+	fixes[2].Lon += 0.01
+
+	got := Clean(fixes, DefaultOptions())
+	if len(got) != 3 {
+		t.Fatalf("Clean() kept %d fixes, want 3", len(got))
+	}
+	for _, f := range got {
+		if f.Accuracy > DefaultOptions().MaxAccuracy {
+			t.Errorf("Clean() kept a fix with accuracy %v", f.Accuracy)
+		}
+	}
+}
+
+func TestDetectStops(t *testing.T) {
+	// halt returns a track walking 40 m north, staying there for n fixes and
+	// walking on.
+	halt := func(n int) []float64 {
+		north := []float64{0, 20}
+		for i := 0; i < n; i++ {
+			north = append(north, 40+float64(i%3))
+		}
+		return append(north, 60, 80)
+	}
+	tests := []struct {
+		name  string
+		north []float64
+		want  int
+	}{
+		{"never halts", []float64{0, 20, 40, 60, 80, 100, 120, 140}, 0},
+		{"halts too briefly", halt(5), 0},
+		{"halts once", halt(40), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stops := DetectStops(walk(tt.north, make([]float64, len(tt.north))), DefaultStopOptions())
+			if len(stops) != tt.want {
+				t.Errorf("DetectStops() found %d stops, want %d", len(stops), tt.want)
+			}
+		})
+	}
+}